@@ -0,0 +1,103 @@
+package blockartlib
+
+import (
+	"context"
+	"fmt"
+)
+
+// Represents what happened to the miner's block chain.
+type BlockEventKind int
+
+const (
+	// A block was added to the block chain, on the longest chain or not.
+	// AddedShapes and RemovedShapes list the shapes the block adds and deletes.
+	NEWBLOCK BlockEventKind = iota
+
+	// The longest chain grew from PrevTipHash to BlockHash.
+	// AddedShapes and RemovedShapes list how the canvas changed.
+	TIPCHANGED
+
+	// The longest chain switched from PrevTipHash to BlockHash on another branch.
+	// AddedShapes and RemovedShapes list how the canvas changed, including
+	// the shapes of the abandoned branch that are no longer on the canvas.
+	REORG
+
+	// The miner replaced its block chain, or events were missed because the
+	// subscriber fell too far behind. AddedShapes lists every shape on the
+	// canvas, which should be redrawn from scratch.
+	RESET
+)
+
+var BlockEventKindName = []string{
+	NEWBLOCK:   "NEWBLOCK",
+	TIPCHANGED: "TIPCHANGED",
+	REORG:      "REORG",
+	RESET:      "RESET",
+}
+
+type BlockEvent struct {
+	// Increases by one with every event the miner records.
+	Seq uint64
+
+	Kind BlockEventKind
+
+	// Hash of the new block for NEWBLOCK, otherwise of the new tip of the longest chain.
+	BlockHash string
+
+	// Hash of the previous tip of the longest chain. Only set for TIPCHANGED and REORG.
+	PrevTipHash string
+
+	AddedShapes   []string
+	RemovedShapes []string
+}
+
+func (e BlockEvent) String() string {
+	return fmt.Sprintf("%d %s [%s] +%d -%d", e.Seq, BlockEventKindName[e.Kind], e.BlockHash, len(e.AddedShapes), len(e.RemovedShapes))
+}
+
+type BlockEventsRequest struct {
+	// Seq of the first event wanted. 0 asks only for the seq of the next event.
+	FromSeq uint64
+}
+
+type BlockEventsResponse struct {
+	Events []BlockEvent
+
+	// Seq to ask for next.
+	NextSeq uint64
+}
+
+func (c CanvasStruct) SubscribeBlocks(ctx context.Context) (events <-chan BlockEvent, err error) {
+	var resp BlockEventsResponse
+	if err = c.call(ctx, "MArtNode.GetBlockEvents", BlockEventsRequest{}, &resp); err != nil {
+		return nil, err
+	}
+
+	eventsChan := make(chan BlockEvent, 16)
+	go c.streamBlockEvents(ctx, resp.NextSeq, eventsChan)
+	return eventsChan, nil
+}
+
+// Long-polls the miner for events from seq on, until ctx is done or the miner cannot be reached.
+func (c CanvasStruct) streamBlockEvents(ctx context.Context, seq uint64, events chan<- BlockEvent) {
+	defer close(events)
+
+	for {
+		var resp BlockEventsResponse
+		if err := c.call(ctx, "MArtNode.GetBlockEvents", BlockEventsRequest{FromSeq: seq}, &resp); err != nil {
+			if err != ctx.Err() {
+				errLog.Printf("Block subscription ended: %s\n", err)
+			}
+			return
+		}
+
+		for _, event := range resp.Events {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		seq = resp.NextSeq
+	}
+}
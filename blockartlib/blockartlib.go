@@ -8,16 +8,20 @@ library (blockartlib) to be used in project 1 of UBC CS 416 2017W2.
 package blockartlib
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"net/rpc"
 	"os"
-	"strings"
 
+	"../blockchain"
 	"../util"
 )
 
@@ -34,12 +38,22 @@ const (
 	PATH ShapeType = iota
 
 	// Circle shape (extra credit).
-	// CIRCLE
+	// Described as "cx [x] cy [y] r [radius]", e.g. "cx 50 cy 50 r 10".
+	CIRCLE
 )
 
+// Returns the type of a shape drawn by an add operation
+func ShapeTypeOf(shape blockchain.Shape) ShapeType {
+	if shape.IsCircle() {
+		return CIRCLE
+	}
+	return PATH
+}
+
 type CanvasStruct struct {
 	MinerRPC  *rpc.Client
 	MinerAddr string
+	privKey   ecdsa.PrivateKey // signs every operation; never sent to the miner
 }
 
 // Settings for a canvas in BlockArt.
@@ -150,11 +164,23 @@ func (e InvalidBlockHashError) Error() string {
 
 }
 
+// Contains the hash of the cancelled operation, if it was broadcast.
+// If Broadcast is true the operation may still be added to the canvas.
+type OperationCancelledError struct {
+	OpHash    string
+	Broadcast bool
+	Err       error // the error of the context that was done
+}
+
+func (e OperationCancelledError) Error() string {
+	return fmt.Sprintf("BlockArt: Operation cancelled (%s), broadcast: %t [%s]", e.Err, e.Broadcast, e.OpHash)
+}
+
 // </ERROR DEFINITIONS>
 type InvalidPrivKey struct{}
 
 func (InvalidPrivKey) Error() string {
-	return fmt.Sprintf("BlockArt: The given private key does not match the private key at the miner address given")
+	return fmt.Sprintf("BlockArt: The miner at the given address rejected the signed challenge for this private key")
 }
 
 // CUSTOM ERROR DEFINITIONS
@@ -166,6 +192,10 @@ const (
 	INVALIDPRIVKEY
 	INVALIDBLOCKHASH
 	SHAPEOWNER
+	INVALIDSESSION
+	CANCELLED
+	OUTOFBOUNDS
+	SHAPEOVERLAP
 	MISC
 )
 
@@ -175,7 +205,54 @@ var ErrorName = []string{
 	INVALIDPRIVKEY:   "INVALIDPRIVKEY",
 	INVALIDBLOCKHASH: "INVALIDBLOCKHASH",
 	SHAPEOWNER:       "SHAPEOWNER",
-	MISC: "MISCERROR:",
+	INVALIDSESSION:   "INVALIDSESSION",
+	CANCELLED:        "CANCELLED",
+	OUTOFBOUNDS:      "OUTOFBOUNDS",
+	SHAPEOVERLAP:     "SHAPEOVERLAP",
+	MISC:             "MISCERROR:",
+}
+
+// Sent back by the miner in the reply of a failed request. net/rpc drops the reply of
+// an RPC that returns an error and keeps only its string, so errors that carry data
+// travel in the reply instead.
+type RPCError struct {
+	Kind         ErrorEnum
+	InkRemaining uint32 // set for INSUFFICIENTINK
+	Hash         string // the offending shape hash for INVALIDSHAPEHASH, SHAPEOWNER and SHAPEOVERLAP, or block hash for INVALIDBLOCKHASH
+}
+
+func (e *RPCError) Error() string {
+	if e.Hash != "" {
+		return fmt.Sprintf("%s [%s]", ErrorName[e.Kind], e.Hash)
+	}
+	return ErrorName[e.Kind]
+}
+
+// Converts the error to the BlockArt error listed for the Canvas methods
+func (e *RPCError) canvasError() error {
+	switch e.Kind {
+	case INSUFFICIENTINK:
+		return InsufficientInkError(e.InkRemaining)
+	case INVALIDSHAPEHASH:
+		return InvalidShapeHashError(e.Hash)
+	case INVALIDPRIVKEY:
+		return InvalidPrivKey{}
+	case INVALIDBLOCKHASH:
+		return InvalidBlockHashError(e.Hash)
+	case SHAPEOWNER:
+		return ShapeOwnerError(e.Hash)
+	case OUTOFBOUNDS:
+		return OutOfBoundsError{}
+	case SHAPEOVERLAP:
+		return ShapeOverlapError(e.Hash)
+	default:
+		return e
+	}
+}
+
+// Implemented by the replies that can carry an RPCError
+type errorReply interface {
+	replyError() *RPCError
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -192,6 +269,33 @@ type Canvas interface {
 	// - OutOfBoundsError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Adds the shapes to the canvas as one batch, recorded in a single
+	// block: either every shape is added or none is. The batch is
+	// validated as a whole, so the ink of all its shapes counts
+	// together. As with separate AddShape calls, shapes of the batch
+	// may overlap each other but not shapes of other art nodes.
+	// Returns the shape hashes in the order of the shapes.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	AddShapes(validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error)
+
+	// Submits a new shape to the canvas without waiting for it to be
+	// added to a block. The returned handle tracks the operation until
+	// it has validateNum blocks following it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	SubmitShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -209,6 +313,13 @@ type Canvas interface {
 	// - ShapeOwnerError
 	DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
 
+	// Submits the removal of a shape without waiting for it to be added
+	// to a block. The returned handle tracks the delete operation.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - ShapeOwnerError
+	SubmitDelete(validateNum uint8, shapeHash string) (handle *OpHandle, err error)
+
 	// Retrieves hashes contained by a specific block.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -226,178 +337,564 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
 
+	// Returns the shapes on the canvas as of the block identified by tipHash,
+	// or as of the tip of the longest chain if tipHash is "".
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetCanvasSnapshot(tipHash string) (snapshot CanvasSnapshot, err error)
+
+	// Streams the events of the miner's block chain from now on: new blocks,
+	// tip changes and reorgs. The channel is closed once ctx is done or the
+	// miner cannot be reached.
+	// Can return the following errors:
+	// - DisconnectedError
+	SubscribeBlocks(ctx context.Context) (events <-chan BlockEvent, err error)
+
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
+
+	// Variants of the methods above that give up once ctx is done, in
+	// which case they return ctx.Err(). AddShapeContext,
+	// AddShapesContext and DeleteShapeContext also stop the miner from
+	// waiting on the operation and instead return an
+	// OperationCancelledError, which reports whether the operation had
+	// already been broadcast.
+	AddShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+	AddShapesContext(ctx context.Context, validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error)
+	SubmitShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error)
+	GetSvgStringContext(ctx context.Context, shapeHash string) (svgString string, err error)
+	GetInkContext(ctx context.Context) (inkRemaining uint32, err error)
+	DeleteShapeContext(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
+	SubmitDeleteContext(ctx context.Context, validateNum uint8, shapeHash string) (handle *OpHandle, err error)
+	GetShapesContext(ctx context.Context, blockHash string) (shapeHashes []string, err error)
+	GetGenesisBlockContext(ctx context.Context) (blockHash string, err error)
+	GetChildrenContext(ctx context.Context, blockHash string) (blockHashes []string, err error)
+	CloseCanvasContext(ctx context.Context) (inkRemaining uint32, err error)
+	GetCanvasSnapshotContext(ctx context.Context, tipHash string) (snapshot CanvasSnapshot, err error)
+}
+
+// Sent to MArtNode.OpenCanvas in response to the nonce from MArtNode.GetNonce.
+// The private key never leaves the art node; only the signature of the nonce does.
+type OpenCanvasRequest struct {
+	PubKey ecdsa.PublicKey
+	SigR   *big.Int
+	SigS   *big.Int
+}
+
+// Reply to MArtNode.OpenCanvas
+type OpenCanvasResponse struct {
+	Settings CanvasSettings
+	Err      *RPCError
 }
 
 type NewShapeResponse struct {
 	ShapeHash    string
 	BlockHash    string
 	InkRemaining uint32
+	Err          *RPCError
+}
+
+// Reply to MArtNode.DeleteShape and MArtNode.SubmitDelete
+type DeleteShapeResponse struct {
+	OpHash       string
+	InkRemaining uint32
+	Err          *RPCError
+}
+
+// Reply to MArtNode.GetSvgString
+type SvgStringResponse struct {
+	SvgString string
+	Err       *RPCError
+}
+
+// Reply to MArtNode.GetOpRecord
+type OpRecordResponse struct {
+	OpRecord blockchain.OpRecord
+	Err      *RPCError
+}
+
+// Reply to MArtNode.GetShapes and MArtNode.GetChildren
+type HashesResponse struct {
+	Hashes []string
+	Err    *RPCError
+}
+
+// A shape on the canvas
+type ShapeRecord struct {
+	ShapeHash  string
+	Owner      ecdsa.PublicKey
+	ShapeType  ShapeType
+	SvgString  string // as passed to AddShape, e.g. "M 0 0 L 20 20" or "cx 50 cy 50 r 10"
+	Fill       string
+	Stroke     string
+	SvgElement string // the svg element drawing the shape
+	InkUsed    uint32
+	BlockHash  string // block the shape was added in
 }
 
+// The shapes on the canvas as of a block, in the order they were added
+type CanvasSnapshot struct {
+	TipHash string
+	Shapes  []ShapeRecord
+}
+
+// Reply to MArtNode.GetCanvasSnapshot
+type CanvasSnapshotResponse struct {
+	Snapshot CanvasSnapshot
+	Err      *RPCError
+}
+
+func (r *OpenCanvasResponse) replyError() *RPCError     { return r.Err }
+func (r *NewShapeResponse) replyError() *RPCError       { return r.Err }
+func (r *DeleteShapeResponse) replyError() *RPCError    { return r.Err }
+func (r *SvgStringResponse) replyError() *RPCError      { return r.Err }
+func (r *OpRecordResponse) replyError() *RPCError       { return r.Err }
+func (r *HashesResponse) replyError() *RPCError         { return r.Err }
+func (r *CanvasSnapshotResponse) replyError() *RPCError { return r.Err }
+func (r *AddShapesResponse) replyError() *RPCError      { return r.Err }
+
 type DeleteShapeReq struct {
 	ValidateNum uint8
 	ShapeHash   string
+	OpRecord    blockchain.OpRecord // delete operation signed by the art node
+	RequestID   string              // passed to MArtNode.CancelRequest to stop waiting on the operation
 }
 
 type AddShapeRequest struct {
-	ValidateNum   uint8
-	ShapeType     ShapeType
-	SvgString     string
-	Fill          string
-	Stroke        string
-	IsTransparent bool
-	IsClosed      bool
+	ValidateNum uint8
+	OpRecord    blockchain.OpRecord // add operation signed by the art node
+	RequestID   string              // passed to MArtNode.CancelRequest to stop waiting on the operation
+}
+
+// A shape to add with AddShapes
+type NewShape struct {
+	ShapeType ShapeType
+	SvgString string
+	Fill      string
+	Stroke    string
+}
+
+type AddShapesRequest struct {
+	ValidateNum uint8
+	OpRecords   []blockchain.OpRecord // add operations of one batch, signed by the art node
+	RequestID   string                // passed to MArtNode.CancelRequest to stop waiting on the batch
+}
+
+// Reply to MArtNode.AddShapes
+type AddShapesResponse struct {
+	ShapeHashes  []string
+	BlockHash    string
+	InkRemaining uint32
+	Err          *RPCError
+}
+
+// Reply to MArtNode.CancelRequest
+type CancelRequestResponse struct {
+	OpHash    string // hash of the request's operation, if it was broadcast
+	Broadcast bool   // true if the operation had already been sent to the network
 }
 
 func (c CanvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
-	if shapeType != PATH {
-		return "", "", 0, InvalidShapeSvgStringError("Only PATH shape is supported")
+	return c.AddShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+func (c CanvasStruct) AddShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	addShapeRequest, err := c.newAddShapeRequest(ctx, validateNum, shapeType, shapeSvgString, fill, stroke)
+	if err != nil {
+		return "", "", 0, err
 	}
 
-	// ValidateShapeSVGString will return the right type of error
-	if _, err := util.ValidateShapeSVGString(shapeSvgString); err != nil {
-		switch errorStr := err.Error(); errorStr {
-		case util.ShapeErrorName[util.INVALIDSHAPESVGSTRING]:
-			return "", "", 0, InvalidShapeSvgStringError(shapeSvgString)
-		case util.ShapeErrorName[util.SHAPESVGSTRINGTOOLONG]:
-			return "", "", 0, ShapeSvgStringTooLongError(shapeSvgString)
-		default:
-			return "", "", 0, err
+	resp := NewShapeResponse{}
+	if err = c.call(ctx, "MArtNode.AddShape", addShapeRequest, &resp); err != nil {
+		if err == ctx.Err() {
+			return "", "", 0, c.cancelRequest(addShapeRequest.RequestID, err)
 		}
+		return "", "", 0, err
 	}
+	return resp.ShapeHash, resp.BlockHash, resp.InkRemaining, nil
+}
 
-	isTransparent := false
-	isClosed := false
+func (c CanvasStruct) AddShapes(validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	return c.AddShapesContext(context.Background(), validateNum, shapes)
+}
 
-	if fill == "transparent" {
-		isTransparent = true
+func (c CanvasStruct) AddShapesContext(ctx context.Context, validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	addShapesRequest, err := c.newAddShapesRequest(ctx, validateNum, shapes)
+	if err != nil {
+		return nil, "", 0, err
 	}
 
-	lastSVGChar := string(shapeSvgString[len(shapeSvgString)-1])
-
-	if lastSVGChar == "Z" || lastSVGChar == "z" {
-		isClosed = true
+	var resp AddShapesResponse
+	if err = c.call(ctx, "MArtNode.AddShapes", addShapesRequest, &resp); err != nil {
+		if err == ctx.Err() {
+			return nil, "", 0, c.cancelRequest(addShapesRequest.RequestID, err)
+		}
+		return nil, "", 0, err
 	}
+	return resp.ShapeHashes, resp.BlockHash, resp.InkRemaining, nil
+}
+
+func (c CanvasStruct) SubmitShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error) {
+	return c.SubmitShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
 
-	addShapeRequest := AddShapeRequest{
-		ValidateNum:   validateNum,
-		ShapeType:     shapeType,
-		SvgString:     shapeSvgString,
-		Fill:          fill,
-		Stroke:        stroke,
-		IsTransparent: isTransparent,
-		IsClosed:      isClosed,
+func (c CanvasStruct) SubmitShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error) {
+	addShapeRequest, err := c.newAddShapeRequest(ctx, validateNum, shapeType, shapeSvgString, fill, stroke)
+	if err != nil {
+		return nil, err
 	}
 
 	resp := NewShapeResponse{}
-	if err = c.MinerRPC.Call("MArtNode.AddShape", addShapeRequest, &resp); err != nil {
-		errorStr := err.Error()
-		if strings.HasPrefix(errorStr, ErrorName[MISC]) {
-			return "", "", 0, err
+	if err = c.call(ctx, "MArtNode.SubmitShape", addShapeRequest, &resp); err != nil {
+		return nil, err
+	}
+	return newOpHandle(resp.ShapeHash, validateNum, c.getOpStatus), nil
+}
+
+// Validates the shape locally, then builds the request carrying the signed add operation
+func (c CanvasStruct) newAddShapeRequest(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (AddShapeRequest, error) {
+	opRecord, err := newShapeOpRecord(shapeType, shapeSvgString, fill, stroke)
+	if err != nil {
+		return AddShapeRequest{}, err
+	}
+
+	if opRecord.Seq, err = c.getNextSeq(ctx); err != nil {
+		return AddShapeRequest{}, err
+	}
+	if opRecord, err = c.signOpRecord(opRecord); err != nil {
+		return AddShapeRequest{}, err
+	}
+
+	return AddShapeRequest{
+		ValidateNum: validateNum,
+		OpRecord:    opRecord,
+		RequestID:   newRequestID(),
+	}, nil
+}
+
+// Validates the shapes locally, then builds the request carrying their signed add operations,
+// which share a GroupID so that the miners add them in the same block or not at all, and
+// carry consecutive Seqs
+func (c CanvasStruct) newAddShapesRequest(ctx context.Context, validateNum uint8, shapes []NewShape) (AddShapesRequest, error) {
+	if len(shapes) == 0 {
+		return AddShapesRequest{}, fmt.Errorf("%s no shapes to add", ErrorName[MISC])
+	}
+	nextSeq, err := c.getNextSeq(ctx)
+	if err != nil {
+		return AddShapesRequest{}, err
+	}
+
+	groupID := newRequestID()
+	opRecords := make([]blockchain.OpRecord, len(shapes))
+	for i, shape := range shapes {
+		opRecord, err := newShapeOpRecord(shape.ShapeType, shape.SvgString, shape.Fill, shape.Stroke)
+		if err != nil {
+			return AddShapesRequest{}, err
+		}
+		opRecord.GroupID = groupID
+		opRecord.GroupSize = uint32(len(shapes))
+		opRecord.Seq = nextSeq + uint64(i)
+
+		if opRecords[i], err = c.signOpRecord(opRecord); err != nil {
+			return AddShapesRequest{}, err
 		}
-		switch errorStr {
-		case ErrorName[INSUFFICIENTINK]:
-			return "", "", 0, InsufficientInkError(resp.InkRemaining)
-		case util.ShapeErrorName[util.SHAPEOVERLAP]:
-			//The returning shape hash is the overlapping one
-			return "", "", 0, ShapeOverlapError(resp.ShapeHash)
-		case util.ShapeErrorName[util.OUTOFBOUNDS]:
-			return "", "", 0, OutOfBoundsError(OutOfBoundsError{})
+	}
+
+	return AddShapesRequest{
+		ValidateNum: validateNum,
+		OpRecords:   opRecords,
+		RequestID:   newRequestID(),
+	}, nil
+}
+
+// Validates the shape and builds the unsigned op record adding it
+func newShapeOpRecord(shapeType ShapeType, shapeSvgString string, fill string, stroke string) (blockchain.OpRecord, error) {
+	var validationErr error
+	switch shapeType {
+	case PATH:
+		// ValidateShapeSVGString will return the right type of error
+		_, validationErr = util.ValidateShapeSVGString(shapeSvgString)
+	case CIRCLE:
+		_, validationErr = util.ValidateCircleSVGString(shapeSvgString)
+	default:
+		return blockchain.OpRecord{}, InvalidShapeSvgStringError("Only PATH and CIRCLE shapes are supported")
+	}
+
+	if err := validationErr; err != nil {
+		if _, isParseErr := err.(*util.PathParseError); isParseErr {
+			return blockchain.OpRecord{}, InvalidShapeSvgStringError(shapeSvgString)
+		}
+		switch errorStr := err.Error(); errorStr {
+		case util.ShapeErrorName[util.INVALIDSHAPESVGSTRING]:
+			return blockchain.OpRecord{}, InvalidShapeSvgStringError(shapeSvgString)
+		case util.ShapeErrorName[util.SHAPESVGSTRINGTOOLONG]:
+			return blockchain.OpRecord{}, ShapeSvgStringTooLongError(shapeSvgString)
 		default:
-			return "", "", 0, DisconnectedError(c.MinerAddr)
+			return blockchain.OpRecord{}, err
 		}
 	}
-	return resp.ShapeHash, resp.BlockHash, resp.InkRemaining, nil
+
+	shape := blockchain.Shape{SvgString: shapeSvgString, Fill: fill, Stroke: stroke}
+	isClosed := util.IsClosedShape(shapeSvgString)
+
+	return blockchain.OpRecord{
+		Type:    blockchain.ADD,
+		Shape:   shape,
+		InkUsed: util.CalculateShapeInkRequired(shapeSvgString, !shape.IsFilled(), isClosed),
+	}, nil
 }
 
 func (c CanvasStruct) GetSvgString(shapeHash string) (svgString string, err error) {
-	err = c.MinerRPC.Call("MArtNode.GetSvgString", shapeHash, &svgString)
+	return c.GetSvgStringContext(context.Background(), shapeHash)
+}
 
-	if err != nil {
-		if strings.EqualFold(err.Error(), ErrorName[INVALIDSHAPEHASH]) {
-			return "", InvalidShapeHashError(shapeHash)
-		}
+func (c CanvasStruct) GetSvgStringContext(ctx context.Context, shapeHash string) (svgString string, err error) {
+	var resp SvgStringResponse
+	if err = c.call(ctx, "MArtNode.GetSvgString", shapeHash, &resp); err != nil {
+		return "", err
 	}
-	
-	return svgString, InvalidShapeHashError(shapeHash)
+	return resp.SvgString, nil
 }
 
 func (c CanvasStruct) GetInk() (inkRemaining uint32, err error) {
+	return c.GetInkContext(context.Background())
+}
+
+func (c CanvasStruct) GetInkContext(ctx context.Context) (inkRemaining uint32, err error) {
 	var ignoredreq = true
-	err = c.MinerRPC.Call("MArtNode.GetInk", ignoredreq, &inkRemaining)
-	if err != nil {
-		return 0, DisconnectedError(c.MinerAddr)
+	if err = c.call(ctx, "MArtNode.GetInk", ignoredreq, &inkRemaining); err != nil {
+		return 0, err
 	}
 	return inkRemaining, nil
 }
 
 func (c CanvasStruct) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
-	req := DeleteShapeReq{
-		ValidateNum: validateNum,
-		ShapeHash:   shapeHash}
-	err = c.MinerRPC.Call("MArtNode.DeleteShape", req, &inkRemaining)
+	return c.DeleteShapeContext(context.Background(), validateNum, shapeHash)
+}
+
+func (c CanvasStruct) DeleteShapeContext(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
+	req, err := c.newDeleteShapeReq(ctx, validateNum, shapeHash)
 	if err != nil {
-		errorStr := err.Error()
-		if strings.HasPrefix(errorStr, ErrorName[MISC]) {
-			return 0, err
-		}
-		if strings.EqualFold(errorStr, ErrorName[SHAPEOWNER]) {
-			return 0, ShapeOwnerError(shapeHash)
+		return 0, err
+	}
+
+	var resp DeleteShapeResponse
+	if err = c.call(ctx, "MArtNode.DeleteShape", req, &resp); err != nil {
+		if err == ctx.Err() {
+			return 0, c.cancelRequest(req.RequestID, err)
 		}
-		return 0, DisconnectedError(c.MinerAddr)
+		return 0, err
 	}
-	return inkRemaining, nil
+	return resp.InkRemaining, nil
 }
 
-func (c CanvasStruct) GetShapes(blockHash string) (shapeHashes []string, err error) {
-	err = c.MinerRPC.Call("MArtNode.GetShapes", blockHash, &shapeHashes)
+func (c CanvasStruct) SubmitDelete(validateNum uint8, shapeHash string) (handle *OpHandle, err error) {
+	return c.SubmitDeleteContext(context.Background(), validateNum, shapeHash)
+}
+
+func (c CanvasStruct) SubmitDeleteContext(ctx context.Context, validateNum uint8, shapeHash string) (handle *OpHandle, err error) {
+	req, err := c.newDeleteShapeReq(ctx, validateNum, shapeHash)
 	if err != nil {
-		if strings.EqualFold(err.Error(), ErrorName[INVALIDBLOCKHASH]) {
-			return []string{""}, InvalidBlockHashError(blockHash)
+		return nil, err
+	}
+
+	var resp DeleteShapeResponse
+	if err = c.call(ctx, "MArtNode.SubmitDelete", req, &resp); err != nil {
+		return nil, err
+	}
+	return newOpHandle(resp.OpHash, validateNum, c.getOpStatus), nil
+}
+
+// Asks the miner for the status of a submitted operation
+func (c CanvasStruct) getOpStatus(req OpStatusRequest) (OpStatus, error) {
+	var status OpStatus
+	if err := c.MinerRPC.Call("MArtNode.GetOpStatus", req, &status); err != nil {
+		return status, DisconnectedError(c.MinerAddr)
+	}
+	return status, nil
+}
+
+// Builds the request carrying the signed delete operation for the given shape
+func (c CanvasStruct) newDeleteShapeReq(ctx context.Context, validateNum uint8, shapeHash string) (DeleteShapeReq, error) {
+	var resp OpRecordResponse
+	if err := c.call(ctx, "MArtNode.GetOpRecord", shapeHash, &resp); err != nil {
+		if _, ok := err.(InvalidShapeHashError); ok {
+			// no such shape on the canvas, so it cannot be owned by this art node
+			return DeleteShapeReq{}, ShapeOwnerError(shapeHash)
 		}
-		return []string{""}, DisconnectedError(c.MinerAddr)
+		return DeleteShapeReq{}, err
+	}
+	shapeOpRecord := resp.OpRecord
+	seq, err := c.getNextSeq(ctx)
+	if err != nil {
+		return DeleteShapeReq{}, err
+	}
+
+	// the refund must match the ink spent on the shape being deleted
+	opRecord, err := c.signOpRecord(blockchain.OpRecord{
+		Type:      blockchain.DELETE,
+		ShapeHash: shapeHash,
+		InkUsed:   shapeOpRecord.InkUsed,
+		Seq:       seq,
+	})
+	if err != nil {
+		return DeleteShapeReq{}, err
+	}
+
+	return DeleteShapeReq{
+		ValidateNum: validateNum,
+		ShapeHash:   shapeHash,
+		OpRecord:    opRecord,
+		RequestID:   newRequestID()}, nil
+}
+
+func (c CanvasStruct) GetShapes(blockHash string) (shapeHashes []string, err error) {
+	return c.GetShapesContext(context.Background(), blockHash)
+}
+
+func (c CanvasStruct) GetShapesContext(ctx context.Context, blockHash string) (shapeHashes []string, err error) {
+	var resp HashesResponse
+	if err = c.call(ctx, "MArtNode.GetShapes", blockHash, &resp); err != nil {
+		return []string{""}, err
 	}
-	return shapeHashes, nil
+	return resp.Hashes, nil
 }
 
 func (c CanvasStruct) GetGenesisBlock() (blockHash string, err error) {
+	return c.GetGenesisBlockContext(context.Background())
+}
+
+func (c CanvasStruct) GetGenesisBlockContext(ctx context.Context) (blockHash string, err error) {
 	var ignoredreq = true
-	err = c.MinerRPC.Call("MArtNode.GetGenesisBlock", ignoredreq, &blockHash)
-	if err != nil {
-		return "", DisconnectedError(c.MinerAddr)
+	if err = c.call(ctx, "MArtNode.GetGenesisBlock", ignoredreq, &blockHash); err != nil {
+		return "", err
 	}
 	return blockHash, nil
 }
 
 func (c CanvasStruct) GetChildren(blockHash string) (blockHashes []string, err error) {
-	err = c.MinerRPC.Call("MArtNode.GetChildren", blockHash, &blockHashes)
-	if err != nil {
-		if strings.EqualFold(err.Error(), ErrorName[INVALIDBLOCKHASH]) {
-			return []string{""}, InvalidBlockHashError(blockHash)
-		}
-		return []string{""}, DisconnectedError(c.MinerAddr)
+	return c.GetChildrenContext(context.Background(), blockHash)
+}
+
+func (c CanvasStruct) GetChildrenContext(ctx context.Context, blockHash string) (blockHashes []string, err error) {
+	var resp HashesResponse
+	if err = c.call(ctx, "MArtNode.GetChildren", blockHash, &resp); err != nil {
+		return []string{""}, err
 	}
-	return blockHashes, nil
+	return resp.Hashes, nil
+}
+
+func (c CanvasStruct) GetCanvasSnapshot(tipHash string) (snapshot CanvasSnapshot, err error) {
+	return c.GetCanvasSnapshotContext(context.Background(), tipHash)
+}
+
+func (c CanvasStruct) GetCanvasSnapshotContext(ctx context.Context, tipHash string) (snapshot CanvasSnapshot, err error) {
+	var resp CanvasSnapshotResponse
+	if err = c.call(ctx, "MArtNode.GetCanvasSnapshot", tipHash, &resp); err != nil {
+		return CanvasSnapshot{}, err
+	}
+	return resp.Snapshot, nil
 }
 
 func (c CanvasStruct) CloseCanvas() (inkRemaining uint32, err error) {
+	return c.CloseCanvasContext(context.Background())
+}
+
+func (c CanvasStruct) CloseCanvasContext(ctx context.Context) (inkRemaining uint32, err error) {
 	var ignoredreq = true
 	var resp uint32
-	err = c.MinerRPC.Call("MArtNode.GetInk", ignoredreq, &resp)
+	callErr := c.call(ctx, "MArtNode.GetInk", ignoredreq, &resp)
 	if err = c.MinerRPC.Close(); err != nil {
 		return 0, DisconnectedError(c.MinerAddr)
 	}
+	if callErr != nil {
+		return 0, callErr
+	}
 	return resp, nil
 }
 
+// Calls the miner and waits for the reply, or for ctx to be done, whichever comes first.
+// Returns ctx.Err() if ctx is done first, otherwise the BlockArt error for the reply.
+func (c CanvasStruct) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	call := c.MinerRPC.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return c.convertError(call.Error, reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the BlockArt error for the outcome of an RPC:
+// - the error carried in the reply, if any
+// - the error returned by the miner, such as a MISCERROR, as is
+// - DisconnectedError if the miner could not be reached
+func (c CanvasStruct) convertError(err error, reply interface{}) error {
+	if err == nil {
+		if r, ok := reply.(errorReply); ok && r.replyError() != nil {
+			return r.replyError().canvasError()
+		}
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return err
+	}
+	return DisconnectedError(c.MinerAddr)
+}
+
+// Tells the miner to stop waiting on the AddShape or DeleteShape request with the given ID,
+// and returns an OperationCancelledError reporting whether its operation was broadcast.
+func (c CanvasStruct) cancelRequest(requestID string, ctxErr error) error {
+	var resp CancelRequestResponse
+	if err := c.MinerRPC.Call("MArtNode.CancelRequest", requestID, &resp); err != nil {
+		// cannot tell whether the miner got as far as broadcasting the operation
+		return OperationCancelledError{Broadcast: true, Err: ctxErr}
+	}
+	return OperationCancelledError{OpHash: resp.OpHash, Broadcast: resp.Broadcast, Err: ctxErr}
+}
+
+// Returns a random ID that lets a pending AddShape or DeleteShape request be cancelled
+func newRequestID() string {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	return hex.EncodeToString(idBytes)
+}
+
+// Asks the miner for the Seq of the art node's next operation, which follows on from
+// its operations on the longest chain and those still pending
+func (c CanvasStruct) getNextSeq(ctx context.Context) (uint64, error) {
+	var ignoredreq = true
+	var nextSeq uint64
+	if err := c.call(ctx, "MArtNode.GetNextSeq", ignoredreq, &nextSeq); err != nil {
+		return 0, err
+	}
+	return nextSeq, nil
+}
+
+// Signs the op record with the art node's own key
+func (c CanvasStruct) signOpRecord(opRecord blockchain.OpRecord) (blockchain.OpRecord, error) {
+	if err := opRecord.Sign(&c.privKey); err != nil {
+		return blockchain.OpRecord{}, fmt.Errorf("%s unable to sign operation: %s", ErrorName[MISC], err)
+	}
+	return opRecord, nil
+}
+
 // The constructor for a new Canvas object instance. Takes the miner's
 // IP:port address string and a public-private key pair (ecdsa private
 // key type contains the public key). Returns a Canvas instance that
 // can be used for all future interactions with blockartlib.
 //
+// The private key is only used locally: to sign a nonce issued by the
+// miner, which binds the connection to the matching public key, and to
+// sign every operation. Ink is charged to this key, not the miner's, so
+// many art nodes with different keys can share one miner.
+//
 // The returned Canvas instance is a singleton: an application is
 // expected to interact with just one Canvas instance at a time.
 //
@@ -410,17 +907,31 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 	minerRPC, err := rpc.Dial("tcp", minerAddr)
 	handleError("Could not make RPC connection to miner", err)
 
-	canvasSettings := CanvasSettings{}
-	err = minerRPC.Call("MArtNode.OpenCanvas", privKey, &canvasSettings)
+	var nonce string
+	var ignoredreq = true
+	if err = minerRPC.Call("MArtNode.GetNonce", ignoredreq, &nonce); err != nil {
+		return nil, CanvasSettings{}, DisconnectedError(minerAddr)
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, blockchain.NonceDigest(nonce))
 	if err != nil {
-		if strings.EqualFold(err.Error(), ErrorName[INVALIDPRIVKEY]) {
-			return nil, canvasSettings, InvalidPrivKey(InvalidPrivKey{})
-		}
-		return nil, canvasSettings, DisconnectedError(minerAddr)
+		return nil, CanvasSettings{}, InvalidPrivKey(InvalidPrivKey{})
+	}
+
+	openCanvasRequest := OpenCanvasRequest{
+		PubKey: privKey.PublicKey,
+		SigR:   r,
+		SigS:   s,
+	}
+
+	canvasStruct := CanvasStruct{MinerRPC: minerRPC, MinerAddr: minerAddr, privKey: privKey}
+	var resp OpenCanvasResponse
+	err = minerRPC.Call("MArtNode.OpenCanvas", openCanvasRequest, &resp)
+	if err = canvasStruct.convertError(err, &resp); err != nil {
+		return nil, CanvasSettings{}, err
 	}
-	canvasStruct := CanvasStruct{MinerRPC: minerRPC, MinerAddr: minerAddr}
 
-	return canvasStruct, canvasSettings, nil
+	return canvasStruct, resp.Settings, nil
 }
 
 func handleError(msg string, e error) {
@@ -0,0 +1,29 @@
+package blockartlib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// An art node service whose GetInk always fails
+type failingInk struct{}
+
+func (f *failingInk) GetInk(ignoredreq bool, inkRemaining *uint32) error {
+	return errors.New("MISCERROR ink unavailable")
+}
+
+func TestCloseCanvasReportsGetInkError(t *testing.T) {
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("MArtNode", &failingInk{})
+	clientConn, serverConn := net.Pipe()
+	go rpcServer.ServeConn(serverConn)
+	canvas := CanvasStruct{MinerRPC: rpc.NewClient(clientConn), MinerAddr: "miner"}
+
+	inkRemaining, err := canvas.CloseCanvasContext(context.Background())
+	if err == nil || err.Error() != "MISCERROR ink unavailable" {
+		t.Errorf("Expected the GetInk error, but got %d ink and error %v", inkRemaining, err)
+	}
+}
@@ -0,0 +1,926 @@
+package blockartlib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+
+	"../blockchain"
+	"../util"
+)
+
+// Address reported in the DisconnectedError of a closed FakeCanvas.
+const FakeMinerAddr = "fake-miner"
+
+// An in-memory stand-in for the network of ink miners, for unit-testing art apps
+// without running server.go and ink-miner.go. Canvases opened on it follow the
+// same rules as the miners: shapes are validated, ink is earned by mining blocks
+// and spent on shapes, shapes of different art nodes cannot overlap, deletes
+// refund ink, each author's operations carry consecutive Seqs, and the chain
+// with the most proof-of-work decides what is on the canvas, the one whose tip
+// has the lowest hash if several have as much. Pending operations that are no
+// longer valid on that chain are dropped.
+//
+// By default every operation is mined right away by the art node's own key into
+// a block, followed by validateNum empty blocks, so blocking calls return at once.
+// After SetAutoMine(false), operations wait in the pending pool until the test
+// mines them with MineBlock or MineBlockOn, which lets it script confirmation
+// delays and forks.
+type FakeChain struct {
+	mutex    sync.Mutex
+	settings MinerNetSettings
+	autoMine bool
+
+	blocks    map[string]*fakeBlock
+	tipHash   string
+	pending   []*fakeOp // in the order they were submitted
+	submitted map[string]bool
+
+	events  []BlockEvent
+	changed chan struct{} // closed and replaced whenever the chain or the pending pool changes
+}
+
+type fakeBlock struct {
+	hash     string
+	prevHash string
+	num      uint32
+	miner    ecdsa.PublicKey
+	ops      []*fakeOp
+	children []string
+	work     *big.Int              // the cumulative proof-of-work of the chain ending at the block
+	ledger   *blockchain.InkLedger // the ink and last Seqs as of the block, as the miners keep them
+}
+
+// An operation along with its hash
+type fakeOp struct {
+	hash   string
+	record blockchain.OpRecord
+}
+
+func (op *fakeOp) isDelete() bool {
+	return op.record.IsDelete()
+}
+
+// Returns a FakeChain holding only the genesis block.
+// If settings.GenesisBlockHash is "", the genesis block is named "genesis".
+func NewFakeChain(settings MinerNetSettings) *FakeChain {
+	if settings.GenesisBlockHash == "" {
+		settings.GenesisBlockHash = "genesis"
+	}
+	genesisHash := settings.GenesisBlockHash
+	return &FakeChain{
+		settings:  settings,
+		autoMine:  true,
+		blocks:    map[string]*fakeBlock{genesisHash: {hash: genesisHash, work: new(big.Int), ledger: blockchain.NewInkLedger()}},
+		tipHash:   genesisHash,
+		submitted: make(map[string]bool),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Opens a canvas for the art node owning privKey.
+func (chain *FakeChain) OpenCanvas(privKey ecdsa.PrivateKey) (canvas *FakeCanvas, setting CanvasSettings) {
+	return &FakeCanvas{chain: chain, privKey: privKey, closed: make(chan struct{})}, chain.settings.CanvasSettings
+}
+
+// Sets whether operations are mined as soon as they are submitted.
+func (chain *FakeChain) SetAutoMine(autoMine bool) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	chain.autoMine = autoMine
+}
+
+// Mines a block on the tip of the heaviest chain holding the pending operations
+// that are still valid, and rewards miner with its ink. Returns the block hash.
+func (chain *FakeChain) MineBlock(miner ecdsa.PublicKey) (blockHash string) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.mine(chain.tipHash, miner, true)
+}
+
+// Mines a block on the block parentHash, e.g. to start or extend a fork, and
+// rewards miner with its ink. The block holds the pending operations that are
+// valid on parentHash if withPending is true, and is empty otherwise.
+// The tip switches to the new block if its chain has more proof-of-work, or as
+// much and the new block has the lower hash.
+// Can return the following errors:
+// - InvalidBlockHashError
+func (chain *FakeChain) MineBlockOn(parentHash string, miner ecdsa.PublicKey, withPending bool) (blockHash string, err error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	if _, exists := chain.blocks[parentHash]; !exists {
+		return "", InvalidBlockHashError(parentHash)
+	}
+	return chain.mine(parentHash, miner, withPending), nil
+}
+
+// Returns the hash of the tip of the longest chain.
+func (chain *FakeChain) TipHash() string {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.tipHash
+}
+
+// Returns the number of operations waiting to be mined.
+func (chain *FakeChain) PendingCount() int {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return len(chain.pending)
+}
+
+// Must hold the lock
+func (chain *FakeChain) mine(parentHash string, miner ecdsa.PublicKey, withPending bool) string {
+	parent := chain.blocks[parentHash]
+	block := &fakeBlock{prevHash: parentHash, num: parent.num + 1, miner: miner}
+	// the ops stay pending until the block is on the heaviest chain, which switchTip sees to
+	if withPending {
+		block.ops = chain.mineablePending(parentHash)
+	}
+
+	hash := md5.Sum([]byte(fmt.Sprintf("%s %d %d", parentHash, block.num, len(chain.blocks))))
+	block.hash = hex.EncodeToString(hash[:])
+	block.work = new(big.Int).Add(parent.work, chain.blockWork(block))
+	minedBlock := blockchain.Block{OpRecords: opRecordsOf(block.ops), MinerPubKey: &miner}
+	block.ledger = parent.ledger.Next(&minedBlock, chain.settings.InkPerOpBlock, chain.settings.InkPerNoOpBlock)
+	chain.blocks[block.hash] = block
+	parent.children = append(parent.children, block.hash)
+
+	added, removed := shapeChanges(block.ops)
+	chain.record(BlockEvent{Kind: NEWBLOCK, BlockHash: block.hash, AddedShapes: added, RemovedShapes: removed})
+	if chain.isHeavier(block, chain.blocks[chain.tipHash]) {
+		chain.switchTip(block.hash)
+	}
+	chain.notify()
+	return block.hash
+}
+
+// Returns the proof-of-work of the block alone, 16^difficulty, as the miners weigh it
+func (chain *FakeChain) blockWork(block *fakeBlock) *big.Int {
+	difficulty := chain.settings.PoWDifficultyNoOpBlock
+	if len(block.ops) > 0 {
+		difficulty = chain.settings.PoWDifficultyOpBlock
+	}
+	return new(big.Int).Lsh(big.NewInt(1), 4*uint(difficulty))
+}
+
+// Returns true if the chain ending at block has more proof-of-work than the one ending
+// at other, or as much and block has the lower hash
+func (chain *FakeChain) isHeavier(block *fakeBlock, other *fakeBlock) bool {
+	if cmp := block.work.Cmp(other.work); cmp != 0 {
+		return cmp > 0
+	}
+	return block.hash < other.hash
+}
+
+// Returns the pending operations that can go in a block on parentHash: the
+// valid ones that follow on from their author's Seqs, with batches left out unless
+// all of their operations are valid. Must hold the lock
+func (chain *FakeChain) mineablePending(parentHash string) []*fakeOp {
+	ledger := chain.blocks[parentHash].ledger
+	var mineable []*fakeOp
+	mined := make(map[string]bool)
+	// ops of abandoned blocks go back to the end of the pool, after the ops that follow
+	// on from them, so the pool is gone over until no more ops can be added
+	for added := true; added; {
+		added = false
+		for _, group := range groupOps(chain.pending) {
+			if mined[group[0].hash] || len(blockchain.CompleteOpGroups(opRecordsOf(group))) != len(group) {
+				continue
+			}
+			withGroup := append(append([]*fakeOp{}, mineable...), group...)
+			if len(ledger.SequencedOps(opRecordsOf(withGroup))) != len(withGroup) {
+				continue
+			}
+			var err error
+			if group[0].isDelete() {
+				err = chain.checkDelete(group[0], parentHash, mineable)
+			} else {
+				err = chain.checkShapes(group, parentHash, mineable)
+			}
+			if err == nil {
+				mineable = withGroup
+				for _, op := range group {
+					mined[op.hash] = true
+				}
+				added = true
+			}
+		}
+	}
+	return mineable
+}
+
+// Moves the tip to newTip, returning the operations of abandoned blocks to the
+// pending pool, then drops the pending operations that are already on the new
+// chain or no longer valid on it. Must hold the lock
+func (chain *FakeChain) switchTip(newTip string) {
+	prevTip := chain.tipHash
+	chain.tipHash = newTip
+
+	kind := TIPCHANGED
+	onNewChain := make(map[string]bool)
+	for _, op := range chain.chainOps(newTip) {
+		onNewChain[op.hash] = true
+	}
+	if chain.blocks[newTip].prevHash != prevTip {
+		for _, op := range chain.chainOps(prevTip) {
+			if !onNewChain[op.hash] {
+				kind = REORG
+				chain.pending = append(chain.pending, op)
+			}
+		}
+	}
+	var notOnChain []*fakeOp
+	for _, op := range chain.pending {
+		if !onNewChain[op.hash] {
+			notOnChain = append(notOnChain, op)
+		}
+	}
+	chain.pending = notOnChain
+	chain.pending = chain.mineablePending(newTip)
+
+	prevShapes := make(map[string]bool)
+	for _, op := range chain.liveShapes(prevTip) {
+		prevShapes[op.hash] = true
+	}
+	event := BlockEvent{Kind: kind, BlockHash: newTip, PrevTipHash: prevTip}
+	for _, op := range chain.liveShapes(newTip) {
+		if prevShapes[op.hash] {
+			delete(prevShapes, op.hash)
+		} else {
+			event.AddedShapes = append(event.AddedShapes, op.hash)
+		}
+	}
+	for _, op := range chain.liveShapes(prevTip) {
+		if prevShapes[op.hash] {
+			event.RemovedShapes = append(event.RemovedShapes, op.hash)
+		}
+	}
+	chain.record(event)
+}
+
+// Validates the operations and adds them to the pending pool, mining them right
+// away if auto mining is on. Must hold the lock
+func (chain *FakeChain) submit(ops []*fakeOp, validateNum uint8) error {
+	withOps := append(append([]*fakeOp{}, chain.pending...), ops...)
+	sequencedOps := chain.blocks[chain.tipHash].ledger.SequencedOps(opRecordsOf(withOps))
+	for _, op := range ops {
+		if sequencedOps[op.hash] == nil {
+			return fmt.Errorf("%s operation is out of sequence", ErrorName[MISC])
+		}
+	}
+
+	var err error
+	if ops[0].isDelete() {
+		err = chain.checkDelete(ops[0], chain.tipHash, chain.pending)
+	} else {
+		err = chain.checkShapes(ops, chain.tipHash, chain.pending)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		chain.submitted[op.hash] = true
+		chain.pending = append(chain.pending, op)
+	}
+	chain.notify()
+
+	if chain.autoMine {
+		author := ops[0].record.AuthorPubKey
+		chain.mine(chain.tipHash, author, true)
+		for i := uint8(0); i < validateNum; i++ {
+			chain.mine(chain.tipHash, author, false)
+		}
+	}
+	return nil
+}
+
+// Checks add operations of one author against the chain ending at tipHash,
+// plus the operations in others that are not on it yet. Must hold the lock
+func (chain *FakeChain) checkShapes(ops []*fakeOp, tipHash string, others []*fakeOp) error {
+	author := ops[0].record.AuthorPubKey
+	inkRemaining := chain.blocks[tipHash].ledger.Balance(author)
+	if inkRemaining <= 0 {
+		return InsufficientInkError(0)
+	}
+
+	var inkRequired int
+	canvasSettings := chain.settings.CanvasSettings
+	for _, op := range ops {
+		if util.CheckShapeOutOfBounds(op.record.Shape.SvgString, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
+			return OutOfBoundsError{}
+		}
+		for _, other := range append(chain.liveShapes(tipHash), others...) {
+			if other.isDelete() || reflect.DeepEqual(other.record.AuthorPubKey, author) {
+				continue
+			}
+			otherShape, shape := other.record.Shape, op.record.Shape
+			if util.CheckFilledShapeOverlap(otherShape.SvgString, otherShape.IsFilled(), shape.SvgString, shape.IsFilled()) != nil {
+				return ShapeOverlapError(other.hash)
+			}
+		}
+		inkRequired += int(op.record.InkUsed)
+	}
+
+	for _, other := range others {
+		if reflect.DeepEqual(other.record.AuthorPubKey, author) {
+			if other.isDelete() {
+				inkRemaining += int(other.record.InkUsed)
+			} else {
+				inkRemaining -= int(other.record.InkUsed)
+			}
+		}
+	}
+	if inkRequired > inkRemaining {
+		if inkRemaining < 0 {
+			inkRemaining = 0
+		}
+		return InsufficientInkError(inkRemaining)
+	}
+	return nil
+}
+
+// Checks that a delete operation removes a shape on the chain ending at tipHash
+// that its author owns and that no operation in others deletes already. Must hold the lock
+func (chain *FakeChain) checkDelete(op *fakeOp, tipHash string, others []*fakeOp) error {
+	for _, other := range others {
+		if other.record.ShapeHash == op.record.ShapeHash {
+			return ShapeOwnerError(op.record.ShapeHash)
+		}
+	}
+	for _, shape := range chain.liveShapes(tipHash) {
+		if shape.hash == op.record.ShapeHash && reflect.DeepEqual(shape.record.AuthorPubKey, op.record.AuthorPubKey) {
+			return nil
+		}
+	}
+	return ShapeOwnerError(op.record.ShapeHash)
+}
+
+// Returns the operations on the chain ending at tipHash, oldest first. Must hold the lock
+func (chain *FakeChain) chainOps(tipHash string) []*fakeOp {
+	var blocks []*fakeBlock
+	for hash := tipHash; hash != chain.settings.GenesisBlockHash; hash = chain.blocks[hash].prevHash {
+		blocks = append(blocks, chain.blocks[hash])
+	}
+
+	var ops []*fakeOp
+	for i := len(blocks) - 1; i >= 0; i-- {
+		ops = append(ops, blocks[i].ops...)
+	}
+	return ops
+}
+
+// Returns the add operations of the shapes on the canvas as of tipHash, oldest first.
+// A shape is only deleted by a delete of its own author. Must hold the lock
+func (chain *FakeChain) liveShapes(tipHash string) []*fakeOp {
+	ops := chain.chainOps(tipHash)
+	authors := make(map[string]string)
+	for _, op := range ops {
+		if !op.isDelete() {
+			authors[op.hash] = blockchain.PubKeyID(op.record.AuthorPubKey)
+		}
+	}
+	deleted := make(map[string]bool)
+	for _, op := range ops {
+		author, exists := authors[op.record.ShapeHash]
+		if op.isDelete() && exists && author == blockchain.PubKeyID(op.record.AuthorPubKey) {
+			deleted[op.record.ShapeHash] = true
+		}
+	}
+
+	var shapes []*fakeOp
+	for _, op := range ops {
+		if !op.isDelete() && !deleted[op.hash] {
+			shapes = append(shapes, op)
+		}
+	}
+	return shapes
+}
+
+// Returns the Seq of the author's next operation, as the miners' GetNextSeq does: the
+// first one after its last operation on the longest chain that none of its pending
+// operations uses. Must hold the lock
+func (chain *FakeChain) nextSeq(author ecdsa.PublicKey) uint64 {
+	lastSeq := chain.blocks[chain.tipHash].ledger.LastSeq(author)
+	pendingSeqs := make(map[uint64]bool)
+	for _, op := range chain.pending {
+		if blockchain.PubKeyID(op.record.AuthorPubKey) == blockchain.PubKeyID(author) {
+			pendingSeqs[op.record.Seq] = true
+		}
+	}
+	nextSeq := lastSeq + 1
+	for pendingSeqs[nextSeq] {
+		nextSeq++
+	}
+	return nextSeq
+}
+
+// Returns the add operation of a shape on the longest chain, and the block it is in. Must hold the lock
+func (chain *FakeChain) findShape(shapeHash string) (*fakeOp, string, bool) {
+	for hash := chain.tipHash; hash != chain.settings.GenesisBlockHash; hash = chain.blocks[hash].prevHash {
+		for _, op := range chain.blocks[hash].ops {
+			if op.hash == shapeHash && !op.isDelete() {
+				return op, hash, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// Must hold the lock
+func (chain *FakeChain) opStatus(opHash string, validateNum uint8) OpStatus {
+	tip := chain.blocks[chain.tipHash]
+	for hash := chain.tipHash; hash != chain.settings.GenesisBlockHash; hash = chain.blocks[hash].prevHash {
+		for _, op := range chain.blocks[hash].ops {
+			if op.hash == opHash {
+				confirmations := tip.num - chain.blocks[hash].num
+				kind := INCLUDED
+				if confirmations >= uint32(validateNum) {
+					kind = CONFIRMED
+				}
+				return OpStatus{Kind: kind, Confirmations: confirmations, BlockHash: hash}
+			}
+		}
+	}
+
+	// pending, or in a block on a side branch that may still become the heaviest chain
+	for _, op := range chain.pending {
+		if op.hash == opHash {
+			return OpStatus{Kind: PENDING}
+		}
+	}
+	for _, block := range chain.blocks {
+		for _, op := range block.ops {
+			if op.hash == opHash {
+				return OpStatus{Kind: PENDING}
+			}
+		}
+	}
+
+	if chain.submitted[opHash] {
+		return OpStatus{Kind: ORPHANED}
+	}
+	return OpStatus{Kind: REJECTED}
+}
+
+// Blocks until the operation has validateNum blocks following it on the longest chain,
+// or until ctx is done or the canvas is closed. Returns the block holding the operation.
+func (chain *FakeChain) waitConfirmed(ctx context.Context, closed <-chan struct{}, opHash string, validateNum uint8) (string, error) {
+	for {
+		chain.mutex.Lock()
+		status := chain.opStatus(opHash, validateNum)
+		changed := chain.changed
+		chain.mutex.Unlock()
+
+		if status.Kind == CONFIRMED {
+			return status.BlockHash, nil
+		}
+		select {
+		case <-changed:
+		case <-closed:
+			return "", DisconnectedError(FakeMinerAddr)
+		case <-ctx.Done():
+			return "", OperationCancelledError{OpHash: opHash, Broadcast: true, Err: ctx.Err()}
+		}
+	}
+}
+
+// Must hold the lock
+func (chain *FakeChain) record(event BlockEvent) {
+	event.Seq = uint64(len(chain.events)) + 1
+	chain.events = append(chain.events, event)
+}
+
+// Must hold the lock
+func (chain *FakeChain) notify() {
+	close(chain.changed)
+	chain.changed = make(chan struct{})
+}
+
+// Splits the operations into batches and single operations, keeping their order
+func groupOps(ops []*fakeOp) [][]*fakeOp {
+	var groups [][]*fakeOp
+	groupIndex := make(map[string]int)
+	for _, op := range ops {
+		groupID := op.record.GroupID
+		if groupID == "" {
+			groups = append(groups, []*fakeOp{op})
+		} else if i, exists := groupIndex[groupID]; exists {
+			groups[i] = append(groups[i], op)
+		} else {
+			groupIndex[groupID] = len(groups)
+			groups = append(groups, []*fakeOp{op})
+		}
+	}
+	return groups
+}
+
+// Returns the op records of the operations, by hash
+func opRecordsOf(ops []*fakeOp) map[string]*blockchain.OpRecord {
+	opRecords := make(map[string]*blockchain.OpRecord, len(ops))
+	for _, op := range ops {
+		opRecords[op.hash] = &op.record
+	}
+	return opRecords
+}
+
+// Returns the hashes of the shapes the operations add, and of the shapes they delete
+func shapeChanges(ops []*fakeOp) (added []string, removed []string) {
+	for _, op := range ops {
+		if op.isDelete() {
+			removed = append(removed, op.record.ShapeHash)
+		} else {
+			added = append(added, op.hash)
+		}
+	}
+	return added, removed
+}
+
+// A Canvas backed by a FakeChain instead of a miner.
+type FakeCanvas struct {
+	chain   *FakeChain
+	privKey ecdsa.PrivateKey
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ Canvas = (*FakeCanvas)(nil)
+
+// Returns ctx.Err() if ctx is done, or DisconnectedError if the canvas was closed
+func (canvas *FakeCanvas) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-canvas.closed:
+		return DisconnectedError(FakeMinerAddr)
+	default:
+		return nil
+	}
+}
+
+// Returns the Seq of the art node's next operation, like the real canvas asks its miner for
+func (canvas *FakeCanvas) nextSeq() uint64 {
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	return canvas.chain.nextSeq(canvas.privKey.PublicKey)
+}
+
+// Validates, signs and hashes the shape like the real canvas does
+func (canvas *FakeCanvas) newShapeOp(shape NewShape, seq uint64, groupID string, groupSize int) (*fakeOp, error) {
+	opRecord, err := newShapeOpRecord(shape.ShapeType, shape.SvgString, shape.Fill, shape.Stroke)
+	if err != nil {
+		return nil, err
+	}
+	opRecord.Seq = seq
+	opRecord.GroupID = groupID
+	opRecord.GroupSize = uint32(groupSize)
+	return canvas.newOp(opRecord)
+}
+
+// Signs and hashes the op
+func (canvas *FakeCanvas) newOp(opRecord blockchain.OpRecord) (*fakeOp, error) {
+	if err := opRecord.Sign(&canvas.privKey); err != nil {
+		return nil, fmt.Errorf("%s unable to sign operation: %s", ErrorName[MISC], err)
+	}
+	return &fakeOp{hash: blockchain.ComputeOpRecordHash(opRecord), record: opRecord}, nil
+}
+
+// Builds the signed delete operation for a shape on the longest chain
+func (canvas *FakeCanvas) newDeleteOp(shapeHash string) (*fakeOp, error) {
+	canvas.chain.mutex.Lock()
+	shape, _, exists := canvas.chain.findShape(shapeHash)
+	seq := canvas.chain.nextSeq(canvas.privKey.PublicKey)
+	canvas.chain.mutex.Unlock()
+	if !exists {
+		return nil, ShapeOwnerError(shapeHash)
+	}
+	return canvas.newOp(blockchain.OpRecord{Type: blockchain.DELETE, ShapeHash: shapeHash, InkUsed: shape.record.InkUsed, Seq: seq})
+}
+
+func (canvas *FakeCanvas) submit(ops []*fakeOp, validateNum uint8) error {
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	return canvas.chain.submit(ops, validateNum)
+}
+
+func (canvas *FakeCanvas) inkRemaining() uint32 {
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	ink := canvas.chain.blocks[canvas.chain.tipHash].ledger.Balance(canvas.privKey.PublicKey)
+	if ink < 0 {
+		return 0
+	}
+	return uint32(ink)
+}
+
+func (canvas *FakeCanvas) newOpHandle(opHash string, validateNum uint8) *OpHandle {
+	return newOpHandle(opHash, validateNum, func(req OpStatusRequest) (OpStatus, error) {
+		if err := canvas.check(context.Background()); err != nil {
+			return OpStatus{}, err
+		}
+		canvas.chain.mutex.Lock()
+		defer canvas.chain.mutex.Unlock()
+
+		return canvas.chain.opStatus(req.OpHash, req.ValidateNum), nil
+	})
+}
+
+func (canvas *FakeCanvas) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return canvas.AddShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+func (canvas *FakeCanvas) AddShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return "", "", 0, err
+	}
+	op, err := canvas.newShapeOp(NewShape{shapeType, shapeSvgString, fill, stroke}, canvas.nextSeq(), "", 0)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if err = canvas.submit([]*fakeOp{op}, validateNum); err != nil {
+		return "", "", 0, err
+	}
+	if blockHash, err = canvas.chain.waitConfirmed(ctx, canvas.closed, op.hash, validateNum); err != nil {
+		return "", "", 0, err
+	}
+	return op.hash, blockHash, canvas.inkRemaining(), nil
+}
+
+func (canvas *FakeCanvas) AddShapes(validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	return canvas.AddShapesContext(context.Background(), validateNum, shapes)
+}
+
+func (canvas *FakeCanvas) AddShapesContext(ctx context.Context, validateNum uint8, shapes []NewShape) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return nil, "", 0, err
+	}
+	if len(shapes) == 0 {
+		return nil, "", 0, fmt.Errorf("%s no shapes to add", ErrorName[MISC])
+	}
+
+	groupID := newRequestID()
+	nextSeq := canvas.nextSeq()
+	ops := make([]*fakeOp, len(shapes))
+	for i, shape := range shapes {
+		if ops[i], err = canvas.newShapeOp(shape, nextSeq+uint64(i), groupID, len(shapes)); err != nil {
+			return nil, "", 0, err
+		}
+		shapeHashes = append(shapeHashes, ops[i].hash)
+	}
+	if err = canvas.submit(ops, validateNum); err != nil {
+		return nil, "", 0, err
+	}
+	if blockHash, err = canvas.chain.waitConfirmed(ctx, canvas.closed, ops[0].hash, validateNum); err != nil {
+		return nil, "", 0, err
+	}
+	return shapeHashes, blockHash, canvas.inkRemaining(), nil
+}
+
+func (canvas *FakeCanvas) SubmitShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error) {
+	return canvas.SubmitShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+func (canvas *FakeCanvas) SubmitShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (handle *OpHandle, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return nil, err
+	}
+	op, err := canvas.newShapeOp(NewShape{shapeType, shapeSvgString, fill, stroke}, canvas.nextSeq(), "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = canvas.submit([]*fakeOp{op}, validateNum); err != nil {
+		return nil, err
+	}
+	return canvas.newOpHandle(op.hash, validateNum), nil
+}
+
+func (canvas *FakeCanvas) GetSvgString(shapeHash string) (svgString string, err error) {
+	return canvas.GetSvgStringContext(context.Background(), shapeHash)
+}
+
+func (canvas *FakeCanvas) GetSvgStringContext(ctx context.Context, shapeHash string) (svgString string, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return "", err
+	}
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	if op, _, exists := canvas.chain.findShape(shapeHash); exists {
+		return op.record.Shape.SvgElement(), nil
+	}
+	return "", InvalidShapeHashError(shapeHash)
+}
+
+func (canvas *FakeCanvas) GetInk() (inkRemaining uint32, err error) {
+	return canvas.GetInkContext(context.Background())
+}
+
+func (canvas *FakeCanvas) GetInkContext(ctx context.Context) (inkRemaining uint32, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return 0, err
+	}
+	return canvas.inkRemaining(), nil
+}
+
+func (canvas *FakeCanvas) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
+	return canvas.DeleteShapeContext(context.Background(), validateNum, shapeHash)
+}
+
+func (canvas *FakeCanvas) DeleteShapeContext(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return 0, err
+	}
+	op, err := canvas.newDeleteOp(shapeHash)
+	if err != nil {
+		return 0, err
+	}
+	if err = canvas.submit([]*fakeOp{op}, validateNum); err != nil {
+		return 0, err
+	}
+	if _, err = canvas.chain.waitConfirmed(ctx, canvas.closed, op.hash, validateNum); err != nil {
+		return 0, err
+	}
+	return canvas.inkRemaining(), nil
+}
+
+func (canvas *FakeCanvas) SubmitDelete(validateNum uint8, shapeHash string) (handle *OpHandle, err error) {
+	return canvas.SubmitDeleteContext(context.Background(), validateNum, shapeHash)
+}
+
+func (canvas *FakeCanvas) SubmitDeleteContext(ctx context.Context, validateNum uint8, shapeHash string) (handle *OpHandle, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return nil, err
+	}
+	op, err := canvas.newDeleteOp(shapeHash)
+	if err != nil {
+		return nil, err
+	}
+	if err = canvas.submit([]*fakeOp{op}, validateNum); err != nil {
+		return nil, err
+	}
+	return canvas.newOpHandle(op.hash, validateNum), nil
+}
+
+func (canvas *FakeCanvas) GetShapes(blockHash string) (shapeHashes []string, err error) {
+	return canvas.GetShapesContext(context.Background(), blockHash)
+}
+
+func (canvas *FakeCanvas) GetShapesContext(ctx context.Context, blockHash string) (shapeHashes []string, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return []string{""}, err
+	}
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	block, exists := canvas.chain.blocks[blockHash]
+	if !exists {
+		return []string{""}, InvalidBlockHashError(blockHash)
+	}
+	shapeHashes = make([]string, 0, len(block.ops))
+	for _, op := range block.ops {
+		if !op.isDelete() {
+			shapeHashes = append(shapeHashes, op.hash)
+		}
+	}
+	// as the miners list them
+	sort.Strings(shapeHashes)
+	return shapeHashes, nil
+}
+
+func (canvas *FakeCanvas) GetGenesisBlock() (blockHash string, err error) {
+	return canvas.GetGenesisBlockContext(context.Background())
+}
+
+func (canvas *FakeCanvas) GetGenesisBlockContext(ctx context.Context) (blockHash string, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return "", err
+	}
+	return canvas.chain.settings.GenesisBlockHash, nil
+}
+
+func (canvas *FakeCanvas) GetChildren(blockHash string) (blockHashes []string, err error) {
+	return canvas.GetChildrenContext(context.Background(), blockHash)
+}
+
+func (canvas *FakeCanvas) GetChildrenContext(ctx context.Context, blockHash string) (blockHashes []string, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return []string{""}, err
+	}
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	block, exists := canvas.chain.blocks[blockHash]
+	if !exists {
+		return []string{""}, InvalidBlockHashError(blockHash)
+	}
+	return append([]string{}, block.children...), nil
+}
+
+func (canvas *FakeCanvas) GetCanvasSnapshot(tipHash string) (snapshot CanvasSnapshot, err error) {
+	return canvas.GetCanvasSnapshotContext(context.Background(), tipHash)
+}
+
+func (canvas *FakeCanvas) GetCanvasSnapshotContext(ctx context.Context, tipHash string) (snapshot CanvasSnapshot, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return CanvasSnapshot{}, err
+	}
+	canvas.chain.mutex.Lock()
+	defer canvas.chain.mutex.Unlock()
+
+	if tipHash == "" {
+		tipHash = canvas.chain.tipHash
+	}
+	if _, exists := canvas.chain.blocks[tipHash]; !exists {
+		return CanvasSnapshot{}, InvalidBlockHashError(tipHash)
+	}
+
+	snapshot.TipHash = tipHash
+	blockOf := make(map[string]string)
+	for hash := tipHash; hash != canvas.chain.settings.GenesisBlockHash; hash = canvas.chain.blocks[hash].prevHash {
+		for _, op := range canvas.chain.blocks[hash].ops {
+			blockOf[op.hash] = hash
+		}
+	}
+	for _, op := range canvas.chain.liveShapes(tipHash) {
+		snapshot.Shapes = append(snapshot.Shapes, ShapeRecord{
+			ShapeHash:  op.hash,
+			Owner:      op.record.AuthorPubKey,
+			ShapeType:  ShapeTypeOf(op.record.Shape),
+			SvgString:  op.record.Shape.SvgString,
+			Fill:       op.record.Shape.Fill,
+			Stroke:     op.record.Shape.Stroke,
+			SvgElement: op.record.Shape.SvgElement(),
+			InkUsed:    op.record.InkUsed,
+			BlockHash:  blockOf[op.hash],
+		})
+	}
+	return snapshot, nil
+}
+
+func (canvas *FakeCanvas) SubscribeBlocks(ctx context.Context) (events <-chan BlockEvent, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return nil, err
+	}
+	canvas.chain.mutex.Lock()
+	next := len(canvas.chain.events)
+	canvas.chain.mutex.Unlock()
+
+	eventsChan := make(chan BlockEvent, 16)
+	go func() {
+		defer close(eventsChan)
+		for {
+			canvas.chain.mutex.Lock()
+			newEvents := append([]BlockEvent{}, canvas.chain.events[next:]...)
+			next = len(canvas.chain.events)
+			changed := canvas.chain.changed
+			canvas.chain.mutex.Unlock()
+
+			for _, event := range newEvents {
+				select {
+				case eventsChan <- event:
+				case <-canvas.closed:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-canvas.closed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventsChan, nil
+}
+
+func (canvas *FakeCanvas) CloseCanvas() (inkRemaining uint32, err error) {
+	return canvas.CloseCanvasContext(context.Background())
+}
+
+func (canvas *FakeCanvas) CloseCanvasContext(ctx context.Context) (inkRemaining uint32, err error) {
+	if err = canvas.check(ctx); err != nil {
+		return 0, err
+	}
+	inkRemaining = canvas.inkRemaining()
+	canvas.closeOnce.Do(func() { close(canvas.closed) })
+	return inkRemaining, nil
+}
@@ -0,0 +1,351 @@
+package blockartlib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"../blockchain"
+)
+
+var fakeSettings = MinerNetSettings{
+	InkPerOpBlock:   50,
+	InkPerNoOpBlock: 100,
+	CanvasSettings:  CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+}
+
+func newFakeKey(t *testing.T) *ecdsa.PrivateKey {
+	privKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privKey
+}
+
+func TestFakeCanvasInkOverlapAndDelete(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	alice, bob := newFakeKey(t), newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+	bobCanvas, _ := chain.OpenCanvas(*bob)
+
+	if _, _, _, err := aliceCanvas.AddShape(0, PATH, "M 0 0 L 10 10", "transparent", "red"); err != InsufficientInkError(0) {
+		t.Errorf("Expected InsufficientInkError(0), but got %v", err)
+	}
+
+	chain.MineBlock(alice.PublicKey)
+	chain.MineBlock(bob.PublicKey)
+	shapeHash, blockHash, inkRemaining, err := aliceCanvas.AddShape(2, PATH, "M 0 0 L 10 10", "transparent", "red")
+	if err != nil {
+		t.Fatalf("Expected shape to be added, but got %s", err)
+	}
+	// 100 for the first block, 50 for the shape's block and 100 for each of the 2 blocks following it
+	if inkRemaining != 100+50+200-14 {
+		t.Errorf("Expected %d ink remaining, but got %d", 100+50+200-14, inkRemaining)
+	}
+	if shapeHashes, _ := aliceCanvas.GetShapes(blockHash); len(shapeHashes) != 1 || shapeHashes[0] != shapeHash {
+		t.Errorf("Expected block to hold [%s], but got %v", shapeHash, shapeHashes)
+	}
+
+	if _, _, _, err := bobCanvas.AddShape(0, PATH, "M 0 10 L 10 0", "transparent", "blue"); err != ShapeOverlapError(shapeHash) {
+		t.Errorf("Expected ShapeOverlapError(%s), but got %v", shapeHash, err)
+	}
+	if _, err := bobCanvas.DeleteShape(0, shapeHash); err != ShapeOwnerError(shapeHash) {
+		t.Errorf("Expected ShapeOwnerError(%s), but got %v", shapeHash, err)
+	}
+
+	inkAfterDelete, err := aliceCanvas.DeleteShape(0, shapeHash)
+	if err != nil {
+		t.Fatalf("Expected shape to be deleted, but got %s", err)
+	}
+	if inkAfterDelete != inkRemaining+50+14 {
+		t.Errorf("Expected %d ink remaining, but got %d", inkRemaining+50+14, inkAfterDelete)
+	}
+	if _, _, _, err := bobCanvas.AddShape(0, PATH, "M 0 10 L 10 0", "transparent", "blue"); err != nil {
+		t.Errorf("Expected shape to be added once the overlapping one is deleted, but got %s", err)
+	}
+
+	aliceCanvas.CloseCanvas()
+	if _, err := aliceCanvas.GetInk(); err != DisconnectedError(FakeMinerAddr) {
+		t.Errorf("Expected DisconnectedError, but got %v", err)
+	}
+}
+
+func TestFakeCanvasReorg(t *testing.T) {
+	defer func(interval time.Duration) { OpStatusPollInterval = interval }(OpStatusPollInterval)
+	OpStatusPollInterval = 10 * time.Millisecond
+
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice, bob := newFakeKey(t), newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+
+	forkBase := chain.MineBlock(alice.PublicKey)
+	events, err := aliceCanvas.SubscribeBlocks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := aliceCanvas.SubmitShape(1, CIRCLE, "cx 50 cy 50 r 10", "transparent", "red")
+	if err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+	if chain.PendingCount() != 1 {
+		t.Errorf("Expected 1 pending operation, but got %d", chain.PendingCount())
+	}
+	chain.MineBlock(alice.PublicKey)
+	if snapshot, _ := aliceCanvas.GetCanvasSnapshot(""); len(snapshot.Shapes) != 1 {
+		t.Errorf("Expected 1 shape on the canvas, but got %d", len(snapshot.Shapes))
+	}
+
+	fork, _ := chain.MineBlockOn(forkBase, bob.PublicKey, false)
+	fork, _ = chain.MineBlockOn(fork, bob.PublicKey, false)
+	if chain.TipHash() != fork || chain.PendingCount() != 1 {
+		t.Errorf("Expected the longer fork to win and the shape to be pending again")
+	}
+	if snapshot, _ := aliceCanvas.GetCanvasSnapshot(""); len(snapshot.Shapes) != 0 {
+		t.Errorf("Expected no shapes on the canvas, but got %d", len(snapshot.Shapes))
+	}
+
+	var kinds []BlockEventKind
+	for len(kinds) < 5 {
+		select {
+		case event := <-events:
+			kinds = append(kinds, event.Kind)
+			if event.Kind == REORG && (len(event.RemovedShapes) != 1 || event.RemovedShapes[0] != handle.OpHash) {
+				t.Errorf("Expected the reorg to remove [%s], but got %v", handle.OpHash, event.RemovedShapes)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 5 events, but got %v", kinds)
+		}
+	}
+	expected := []BlockEventKind{NEWBLOCK, TIPCHANGED, NEWBLOCK, NEWBLOCK, REORG}
+	for i, kind := range expected {
+		if kinds[i] != kind {
+			t.Errorf("Expected events %v, but got %v", expected, kinds)
+			break
+		}
+	}
+
+	chain.MineBlock(alice.PublicKey)
+	chain.MineBlock(alice.PublicKey)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if status, err := handle.Wait(ctx); err != nil || status.Kind != CONFIRMED {
+		t.Errorf("Expected the shape to be confirmed on the new chain, but got %s, %v", status, err)
+	}
+}
+
+func TestFakeChainForkChoice(t *testing.T) {
+	settings := fakeSettings
+	settings.PoWDifficultyOpBlock, settings.PoWDifficultyNoOpBlock = 2, 1
+	chain := NewFakeChain(settings)
+	chain.SetAutoMine(false)
+	alice, bob := newFakeKey(t), newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+
+	forkBase := chain.MineBlock(alice.PublicKey)
+	if _, err := aliceCanvas.SubmitShape(1, PATH, "M 0 0 L 10 10", "transparent", "red"); err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+	opBlock := chain.MineBlock(alice.PublicKey)
+
+	// an op block weighs 16^2, as much as 16 no-op blocks
+	fork := forkBase
+	for i := 0; i < 15; i++ {
+		fork, _ = chain.MineBlockOn(fork, bob.PublicKey, false)
+	}
+	if chain.TipHash() != opBlock {
+		t.Errorf("Expected the op block to outweigh the longer fork, but the tip is %s", chain.TipHash())
+	}
+	fork, _ = chain.MineBlockOn(fork, bob.PublicKey, false)
+	fork, _ = chain.MineBlockOn(fork, bob.PublicKey, false)
+	if chain.TipHash() != fork {
+		t.Errorf("Expected the fork to win once it is heavier, but the tip is %s", chain.TipHash())
+	}
+
+	// of two branches with as much work, the one whose tip has the lower hash wins
+	first, _ := chain.MineBlockOn(fork, alice.PublicKey, false)
+	second, _ := chain.MineBlockOn(fork, bob.PublicKey, false)
+	lowest := first
+	if second < first {
+		lowest = second
+	}
+	if chain.TipHash() != lowest {
+		t.Errorf("Expected the lower of %s and %s to be the tip, but got %s", first, second, chain.TipHash())
+	}
+}
+
+func TestFakeChainDropsInvalidPending(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice, bob := newFakeKey(t), newFakeKey(t)
+	bobCanvas, _ := chain.OpenCanvas(*bob)
+
+	forkBase := chain.MineBlock(alice.PublicKey)
+	chain.MineBlock(bob.PublicKey)
+	if _, err := bobCanvas.SubmitShape(1, PATH, "M 0 0 L 10 10", "transparent", "red"); err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+
+	// bob has no ink on the fork, so the shape can no longer be mined
+	fork, _ := chain.MineBlockOn(forkBase, alice.PublicKey, false)
+	fork, _ = chain.MineBlockOn(fork, alice.PublicKey, false)
+	if chain.TipHash() != fork || chain.PendingCount() != 0 {
+		t.Errorf("Expected the fork to win and the shape to be dropped, but got %d pending", chain.PendingCount())
+	}
+}
+
+func TestFakeChainSideBranchOpsStayPending(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice := newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+
+	forkBase := chain.MineBlock(alice.PublicKey)
+	chain.MineBlock(alice.PublicKey)
+	chain.MineBlock(alice.PublicKey)
+	handle, err := aliceCanvas.SubmitShape(0, PATH, "M 0 0 L 10 10", "transparent", "red")
+	if err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+
+	// a block on a side branch may never make it onto the heaviest chain
+	if _, err := chain.MineBlockOn(forkBase, alice.PublicKey, true); err != nil {
+		t.Fatal(err)
+	}
+	if status := chain.opStatus(handle.OpHash, 0); status.Kind != PENDING || chain.PendingCount() != 1 {
+		t.Errorf("Expected the op to stay pending, but got %s with %d pending", status, chain.PendingCount())
+	}
+
+	blockHash := chain.MineBlock(alice.PublicKey)
+	if status := chain.opStatus(handle.OpHash, 0); status.Kind != CONFIRMED || status.BlockHash != blockHash || chain.PendingCount() != 0 {
+		t.Errorf("Expected the op to be confirmed in %s, but got %s in %s", blockHash, status, status.BlockHash)
+	}
+}
+
+func TestFakeCanvasWaitsForConfirmation(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice := newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+	chain.MineBlock(alice.PublicKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := aliceCanvas.AddShapeContext(ctx, 0, PATH, "M 0 0 L 10 10", "transparent", "red"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, but got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := aliceCanvas.AddShape(1, PATH, "M 0 0 L 10 10", "transparent", "red")
+		done <- err
+	}()
+	for chain.PendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	chain.MineBlock(alice.PublicKey)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected AddShape to wait for 1 more block, but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	chain.MineBlock(alice.PublicKey)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected shape to be added, but got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected AddShape to return once the shape is confirmed")
+	}
+}
+
+func TestFakeCanvasGetShapes(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice := newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+	chain.MineBlock(alice.PublicKey)
+
+	deleted, err := aliceCanvas.SubmitShape(0, PATH, "M 0 0 L 10 10", "transparent", "red")
+	if err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+	chain.MineBlock(alice.PublicKey)
+
+	shapeHashes := make([]string, 0, 2)
+	if _, err := aliceCanvas.SubmitDelete(0, deleted.OpHash); err != nil {
+		t.Fatalf("Expected delete to be submitted, but got %s", err)
+	}
+	for _, svgString := range []string{"M 100 100 L 110 110", "M 200 200 L 210 210"} {
+		handle, err := aliceCanvas.SubmitShape(0, PATH, svgString, "transparent", "red")
+		if err != nil {
+			t.Fatalf("Expected shape to be submitted, but got %s", err)
+		}
+		shapeHashes = append(shapeHashes, handle.OpHash)
+	}
+	blockHash := chain.MineBlock(alice.PublicKey)
+
+	// deletes are left out and the shapes are sorted, as the miners list them
+	sort.Strings(shapeHashes)
+	if got, _ := aliceCanvas.GetShapes(blockHash); !reflect.DeepEqual(got, shapeHashes) {
+		t.Errorf("Expected block to hold %v, but got %v", shapeHashes, got)
+	}
+}
+
+func TestFakeChainSeqs(t *testing.T) {
+	chain := NewFakeChain(fakeSettings)
+	chain.SetAutoMine(false)
+	alice, bob := newFakeKey(t), newFakeKey(t)
+	aliceCanvas, _ := chain.OpenCanvas(*alice)
+	chain.MineBlock(alice.PublicKey)
+
+	// a rejected op leaves no gap in the Seqs
+	if _, err := aliceCanvas.SubmitShape(0, PATH, "M 0 0 L 5000 5000", "transparent", "red"); err == nil {
+		t.Fatal("Expected an out of bounds shape to be rejected")
+	}
+	handle, err := aliceCanvas.SubmitShape(0, PATH, "M 0 0 L 10 10", "transparent", "red")
+	if err != nil {
+		t.Fatalf("Expected shape to be submitted, but got %s", err)
+	}
+	chain.MineBlock(alice.PublicKey)
+	if status := chain.opStatus(handle.OpHash, 0); status.Kind != CONFIRMED {
+		t.Errorf("Expected the op after a rejected one to be mined, but got %s", status)
+	}
+
+	// ops that replay or skip a Seq are rejected, as the miners reject them
+	for _, seq := range []uint64{1, 3} {
+		op, err := aliceCanvas.newShapeOp(NewShape{PATH, "M 100 100 L 110 110", "transparent", "red"}, seq, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.mutex.Lock()
+		err = chain.submit([]*fakeOp{op}, 0)
+		chain.mutex.Unlock()
+		if err == nil {
+			t.Errorf("Expected an op with Seq %d to be rejected", seq)
+		}
+	}
+
+	// a delete of another author, were it on the chain, does not delete the shape
+	bobCanvas, _ := chain.OpenCanvas(*bob)
+	bobDelete, err := bobCanvas.newOp(blockchain.OpRecord{Type: blockchain.DELETE, ShapeHash: handle.OpHash, InkUsed: 14, Seq: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mutex.Lock()
+	chain.blocks[chain.tipHash].ops = append(chain.blocks[chain.tipHash].ops, bobDelete)
+	liveShapes := chain.liveShapes(chain.tipHash)
+	chain.mutex.Unlock()
+	if len(liveShapes) != 1 || liveShapes[0].hash != handle.OpHash {
+		t.Errorf("Expected alice's shape to stay on the canvas, but got %d shapes", len(liveShapes))
+	}
+}
@@ -0,0 +1,160 @@
+package blockartlib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How often an OpHandle asks the miner for the status of its operation.
+var OpStatusPollInterval = 2 * time.Second
+
+// Represents the progress of a submitted operation.
+type OpStatusKind int
+
+const (
+	// Waiting to be mined into a block on the longest chain. The operation may already be in
+	// a block on a side branch, which can still become the longest chain.
+	PENDING OpStatusKind = iota
+
+	// In a block on the longest chain, with fewer than validateNum blocks following it.
+	INCLUDED
+
+	// In a block on the longest chain, with at least validateNum blocks following it.
+	CONFIRMED
+
+	// Was submitted, but is neither pending nor in any block anymore.
+	// The operation must be submitted again for it to take effect.
+	ORPHANED
+
+	// Unknown to the miner.
+	REJECTED
+)
+
+var OpStatusKindName = []string{
+	PENDING:   "PENDING",
+	INCLUDED:  "INCLUDED",
+	CONFIRMED: "CONFIRMED",
+	ORPHANED:  "ORPHANED",
+	REJECTED:  "REJECTED",
+}
+
+type OpStatus struct {
+	Kind OpStatusKind
+
+	// Number of blocks following the operation's block. Only set when INCLUDED or CONFIRMED.
+	Confirmations uint32
+
+	// Hash of the block containing the operation. Only set when INCLUDED or CONFIRMED.
+	BlockHash string
+}
+
+// Returns true if the status will not change anymore.
+func (s OpStatus) IsFinal() bool {
+	return s.Kind == CONFIRMED || s.Kind == ORPHANED || s.Kind == REJECTED
+}
+
+func (s OpStatus) String() string {
+	if s.Kind == INCLUDED || s.Kind == CONFIRMED {
+		return fmt.Sprintf("%s(%d)", OpStatusKindName[s.Kind], s.Confirmations)
+	}
+	return OpStatusKindName[s.Kind]
+}
+
+type OpStatusRequest struct {
+	OpHash      string
+	ValidateNum uint8
+}
+
+// Tracks an operation submitted with SubmitShape or SubmitDelete by polling the miner
+// in the background until the operation is CONFIRMED, ORPHANED or REJECTED.
+type OpHandle struct {
+	// Hash of the operation. For SubmitShape this is also the hash of the new shape.
+	OpHash string
+
+	validateNum uint8
+	getStatus   func(OpStatusRequest) (OpStatus, error)
+
+	mutex   sync.RWMutex
+	status  OpStatus
+	err     error
+	updates chan OpStatus
+	done    chan struct{}
+}
+
+func newOpHandle(opHash string, validateNum uint8, getStatus func(OpStatusRequest) (OpStatus, error)) *OpHandle {
+	handle := &OpHandle{
+		OpHash:      opHash,
+		validateNum: validateNum,
+		getStatus:   getStatus,
+		status:      OpStatus{Kind: PENDING},
+		updates:     make(chan OpStatus, 16),
+		done:        make(chan struct{}),
+	}
+	go handle.poll()
+	return handle
+}
+
+// Returns the last known status of the operation.
+func (h *OpHandle) Status() OpStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.status
+}
+
+// Returns a channel that receives every status change. The channel is closed once
+// the status is final or the miner cannot be reached. If the channel is not drained,
+// intermediate statuses are dropped; Status() always returns the latest one.
+func (h *OpHandle) Updates() <-chan OpStatus {
+	return h.updates
+}
+
+// Blocks until the status is final or ctx is done, and returns the last known status.
+// Can return the following errors:
+// - DisconnectedError
+// - the error of ctx, if it is done first
+func (h *OpHandle) Wait(ctx context.Context) (OpStatus, error) {
+	select {
+	case <-h.done:
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+		return h.status, h.err
+	case <-ctx.Done():
+		return h.Status(), ctx.Err()
+	}
+}
+
+func (h *OpHandle) poll() {
+	defer close(h.done)
+	defer close(h.updates)
+
+	req := OpStatusRequest{OpHash: h.OpHash, ValidateNum: h.validateNum}
+	for {
+		status, err := h.getStatus(req)
+		if err != nil {
+			h.mutex.Lock()
+			h.err = err
+			h.mutex.Unlock()
+			return
+		}
+
+		h.mutex.Lock()
+		changed := status != h.status
+		h.status = status
+		h.mutex.Unlock()
+
+		if changed {
+			select {
+			case h.updates <- status:
+			default:
+			}
+		}
+
+		if status.IsFinal() {
+			return
+		}
+		time.Sleep(OpStatusPollInterval)
+	}
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/elliptic"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// An append-only log of blocks on disk. Each record holds one block, preceded by the
+// length of its encoding and a CRC-32 checksum of it, and is synced to disk before
+// Append returns, so that a block is either fully in the log or, after a crash while
+// it was written, detectably torn.
+type BlockStore struct {
+	file *os.File
+	size int64 // the length of the log up to the end of its last whole record
+}
+
+// How a block is written to the log: gob cannot encode the curves of public keys,
+// so they are cleared from the block and stored by name instead
+type storedBlock struct {
+	Hash         string
+	Block        Block
+	MinerCurve   string
+	AuthorCurves map[string]string // by op hash
+}
+
+const blockRecordHeaderSize = 8 // the length and checksum of a record, 4 bytes each
+
+// Opens the block log at path, creating it if it does not exist, and returns the blocks
+// it holds by hash, along with their hashes in the order they were appended. A torn
+// record at the end of the log, left by a crash, is cut off, as is anything after it.
+func OpenBlockStore(path string) (*BlockStore, map[string]*Block, []string, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	store := &BlockStore{file: file}
+	blocks, blockHashes, err := store.recover()
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	return store, blocks, blockHashes, nil
+}
+
+// Appends the block to the log and syncs it to disk. If the block cannot be written
+// whole, the log is cut back to its previous end so that later records stay readable.
+func (s *BlockStore) Append(hash string, block *Block) error {
+	payload, err := encodeStoredBlock(hash, block)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, blockRecordHeaderSize, blockRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	if _, err = s.file.WriteAt(record, s.size); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *BlockStore) Close() error {
+	return s.file.Close()
+}
+
+// Reads every whole record of the log, and truncates the log after the last one
+func (s *BlockStore) recover() (map[string]*Block, []string, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(s.file)
+
+	blocks := make(map[string]*Block)
+	var blockHashes []string
+	header := make([]byte, blockRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		payloadSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		if s.size+blockRecordHeaderSize+payloadSize > info.Size() {
+			break
+		}
+		payload := make([]byte, payloadSize)
+		if _, err := io.ReadFull(reader, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		hash, block, err := decodeStoredBlock(payload)
+		if err != nil {
+			break
+		}
+
+		if _, exists := blocks[hash]; !exists {
+			blockHashes = append(blockHashes, hash)
+		}
+		blocks[hash] = block
+		s.size += int64(len(header) + len(payload))
+	}
+
+	if err := s.file.Truncate(s.size); err != nil {
+		return nil, nil, err
+	}
+	return blocks, blockHashes, s.file.Sync()
+}
+
+func encodeStoredBlock(hash string, block *Block) ([]byte, error) {
+	stored := storedBlock{Hash: hash, Block: *block, AuthorCurves: make(map[string]string, len(block.OpRecords))}
+	if block.MinerPubKey != nil {
+		minerPubKey := *block.MinerPubKey
+		stored.MinerCurve, minerPubKey.Curve = curveName(minerPubKey.Curve), nil
+		stored.Block.MinerPubKey = &minerPubKey
+	}
+	stored.Block.OpRecords = make(map[string]*OpRecord, len(block.OpRecords))
+	for opHash, opRecord := range block.OpRecords {
+		opCopy := *opRecord
+		stored.AuthorCurves[opHash], opCopy.AuthorPubKey.Curve = curveName(opCopy.AuthorPubKey.Curve), nil
+		stored.Block.OpRecords[opHash] = &opCopy
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stored); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeStoredBlock(payload []byte) (string, *Block, error) {
+	var stored storedBlock
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&stored); err != nil {
+		return "", nil, err
+	}
+
+	block := stored.Block
+	if block.OpRecords == nil {
+		block.OpRecords = make(map[string]*OpRecord)
+	}
+	if block.MinerPubKey != nil {
+		block.MinerPubKey.Curve = namedCurve(stored.MinerCurve)
+	}
+	for opHash, opRecord := range block.OpRecords {
+		opRecord.AuthorPubKey.Curve = namedCurve(stored.AuthorCurves[opHash])
+	}
+	return stored.Hash, &block, nil
+}
+
+func curveName(curve elliptic.Curve) string {
+	if curve == nil {
+		return ""
+	}
+	return curve.Params().Name
+}
+
+// Returns the standard curve with the given name, or nil if there is none
+func namedCurve(name string) elliptic.Curve {
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if curve.Params().Name == name {
+			return curve
+		}
+	}
+	return nil
+}
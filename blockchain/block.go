@@ -1,9 +1,21 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"math/big"
+
+	"../util"
 )
 
 type Block struct {
@@ -16,12 +28,184 @@ type Block struct {
 	Nonce       uint32
 }
 
+type OpType uint8
+
+const (
+	// Adds the OpRecord's Shape to the canvas, using InkUsed ink.
+	ADD OpType = iota + 1
+
+	// Deletes the shape added by the op whose hash is the OpRecord's ShapeHash,
+	// refunding InkUsed ink, which must be the ink used by that shape.
+	DELETE
+)
+
+// A shape drawn by an add operation
+type Shape struct {
+	SvgString string // path data ("M 0 0 L 50 50") or circle ("cx 50 cy 50 r 10")
+	Fill      string
+	Stroke    string
+}
+
 type OpRecord struct {
-	Op           string
+	Type         OpType
+	Shape        Shape  // set for ADD
+	ShapeHash    string // set for DELETE
 	InkUsed      uint32
+	Seq          uint64   // one more than the Seq of the author's previous op, so that no op can be replayed
 	OpSigS       *big.Int // signed with private key of art node
 	OpSigR	     *big.Int // edsca.Sign returns R, S which is both needed to verify
 	AuthorPubKey ecdsa.PublicKey
+	GroupID      string // shared by the ops of a batch, which are added in the same block or not at all
+	GroupSize    uint32 // number of ops in the batch
+}
+
+// Returns the bytes of the OpRecord that are covered by its signature: every field
+// but the signature and author, each string prefixed with its length so that no two
+// different OpRecords share an encoding
+func (o *OpRecord) SigningBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(o.Type))
+	for _, field := range []string{o.Shape.SvgString, o.Shape.Fill, o.Shape.Stroke, o.ShapeHash, o.GroupID} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, o.InkUsed)
+	binary.Write(&buf, binary.BigEndian, o.Seq)
+	binary.Write(&buf, binary.BigEndian, o.GroupSize)
+	return buf.Bytes()
+}
+
+// Compute the MD5 hash of a OpRecord from its signed fields and its author, leaving out the
+// signature so that re-encoding it cannot give the same op a different hash
+func ComputeOpRecordHash(opRecord OpRecord) string {
+	hash := md5.New()
+	hash.Write(opRecord.SigningBytes())
+	hash.Write([]byte(PubKeyID(opRecord.AuthorPubKey)))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns the SHA-256 hash of SigningBytes, which is what the signature signs.
+// ECDSA only reads as many bytes of its input as the curve order has, so signing
+// SigningBytes directly would leave everything past its first 48 bytes unsigned.
+func (o *OpRecord) signingDigest() []byte {
+	digest := sha256.Sum256(o.SigningBytes())
+	return digest[:]
+}
+
+// Returns what an art node signs to show the miner it holds its private key when opening
+// a canvas: the SHA-256 hash of the miner's nonce, which is longer than ECDSA reads
+func NonceDigest(nonce string) []byte {
+	digest := sha256.Sum256([]byte(nonce))
+	return digest[:]
+}
+
+// Returns true if the OpRecord deletes a shape rather than adding one
+func (o *OpRecord) IsDelete() bool {
+	return o.Type == DELETE
+}
+
+// Returns true if the shape is a circle rather than a path
+func (s Shape) IsCircle() bool {
+	return util.IsCircleString(s.SvgString)
+}
+
+// Returns true if the shape covers its inside as well as its outline
+func (s Shape) IsFilled() bool {
+	return s.Fill != "transparent"
+}
+
+// Returns the shape as a svg element, e.g. <path d="M 0 0 L 50 50" stroke="red" fill="transparent"/>
+func (s Shape) SvgElement() string {
+	if s.IsCircle() {
+		return util.ConvertToSvgCircleString(s.SvgString, s.Stroke, s.Fill)
+	}
+	return util.ConvertToSvgPathString(s.SvgString, s.Stroke, s.Fill)
+}
+
+// Returns the hashes of the ops in the order a block applies them: its add
+// operations, then its delete operations, each ordered by hash
+func OpApplyOrder(ops map[string]*OpRecord) []string {
+	opHashes := make([]string, 0, len(ops))
+	for opHash := range ops {
+		opHashes = append(opHashes, opHash)
+	}
+	sort.Slice(opHashes, func(i, j int) bool {
+		isDeleteI, isDeleteJ := ops[opHashes[i]].IsDelete(), ops[opHashes[j]].IsDelete()
+		if isDeleteI != isDeleteJ {
+			return isDeleteJ
+		}
+		return opHashes[i] < opHashes[j]
+	})
+	return opHashes
+}
+
+// Returns the ops that can go in a block: every op that is not part of a batch,
+// and the ops of each batch whose GroupSize ops by the same author are all present
+func CompleteOpGroups(ops map[string]*OpRecord) map[string]*OpRecord {
+	groupCounts := make(map[string]uint32)
+	for _, op := range ops {
+		if op.GroupID != "" {
+			groupCounts[op.groupKey()]++
+		}
+	}
+
+	completeOps := make(map[string]*OpRecord)
+	for opHash, op := range ops {
+		if op.GroupID == "" || groupCounts[op.groupKey()] == op.GroupSize {
+			completeOps[opHash] = op
+		}
+	}
+	return completeOps
+}
+
+// Identifies the op's batch; batches are per author so that nobody can add ops to another author's batch
+func (o *OpRecord) groupKey() string {
+	return fmt.Sprint(o.AuthorPubKey.X, o.AuthorPubKey.Y, o.GroupID, o.GroupSize)
+}
+
+// Signs the OpRecord with the author's private key and sets AuthorPubKey to the matching public key
+func (o *OpRecord) Sign(privKey *ecdsa.PrivateKey) error {
+	o.AuthorPubKey = privKey.PublicKey
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, o.signingDigest())
+	if err != nil {
+		return err
+	}
+	o.OpSigR = r
+	o.OpSigS = s
+	return nil
+}
+
+// Returns true if the OpRecord was signed by the private key matching AuthorPubKey,
+// which must be a key on NetworkCurve
+func (o *OpRecord) HasValidSignature() bool {
+	if o.OpSigR == nil || o.OpSigS == nil || !IsNetworkCurve(o.AuthorPubKey.Curve) {
+		return false
+	}
+	authorPubKey := o.AuthorPubKey
+	authorPubKey.Curve = NetworkCurve
+	return ecdsa.Verify(&authorPubKey, o.signingDigest(), o.OpSigR, o.OpSigS)
+}
+
+// The curve of the keys of every miner and art node
+var NetworkCurve = elliptic.P384()
+
+// Returns true if curve is NetworkCurve, or has all of its parameters, as the curve
+// of a key decoded from gob does. Any other curve is rejected, since whoever picks the
+// curve of a key can make a signature verify against any X and Y.
+func IsNetworkCurve(curve elliptic.Curve) bool {
+	if curve == nil {
+		return false
+	}
+	params, network := curve.Params(), NetworkCurve.Params()
+	if params == nil || params.BitSize != network.BitSize {
+		return false
+	}
+	for _, pair := range [][2]*big.Int{{params.P, network.P}, {params.N, network.N}, {params.B, network.B}, {params.Gx, network.Gx}, {params.Gy, network.Gy}} {
+		if pair[0] == nil || pair[0].Cmp(pair[1]) != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 type BlockChain struct {
@@ -29,7 +213,52 @@ type BlockChain struct {
 	// TODO-dc: [IMPORTANT] none of these fields should be publicly accessible! Causes concurrent read/write problems
 	Blocks     map[string]*Block // Map of block hashes to blocks
 	// TODO - perhaps 'newest' isn't the best term
-	newestHash string            // The tip of the longest branch
+	newestHash string            // The tip of the branch with the most proof-of-work
+	store      *BlockStore       // where added blocks are persisted, if anywhere
+
+	// The cumulative proof-of-work of the branch ending at each block, filled in as needed
+	totalWork           map[string]*big.Int
+	opBlockDifficulty   uint8
+	noOpBlockDifficulty uint8
+}
+
+// Sets the proof-of-work difficulties of op and no-op blocks, as the number of trailing
+// zeros their hashes need, by which the blocks are weighed to choose the tip. Both are 0
+// until set, which makes every block weigh the same.
+func (b *BlockChain) SetPoWDifficulties(opBlock uint8, noOpBlock uint8) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.opBlockDifficulty, b.noOpBlockDifficulty = opBlock, noOpBlock
+	b.totalWork = nil
+}
+
+// Opens the block log at path and adds the blocks it holds to the chain, in the order
+// they were appended, so that the tip moves to the heaviest branch the log holds.
+// The log is not trusted: each block is added only if isValid accepts it, given the
+// hash it was stored under, once the blocks before it in the log have been added.
+// isValid may read the chain, and must not add blocks to it.
+// Every block added to the chain from then on is appended to the log.
+func (b *BlockChain) OpenStore(path string, isValid func(hash string, block *Block) bool) error {
+	store, blocks, blockHashes, err := OpenBlockStore(path)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range blockHashes {
+		if !isValid(hash, blocks[hash]) {
+			continue
+		}
+		b.mutex.Lock()
+		b.addBlock(blocks[hash], hash)
+		b.mutex.Unlock()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.store = store
+	return nil
 }
 
 func (b *BlockChain) GetSize() int {
@@ -39,8 +268,7 @@ func (b *BlockChain) GetSize() int {
 	return len(b.Blocks)
 }
 
-// Return the length of the longest chain.
-// Assumes that newestHash points at the tip of the longest chain.
+// Return the length of the chain ending at the tip.
 func (b *BlockChain) GetLen() int {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
@@ -58,14 +286,84 @@ func (b *BlockChain) GetLen() int {
 	}
 }
 
-func (b *BlockChain) AddBlockAndUpdateTip(block *Block, hash string) {
+// Adds the block, moving the tip to it if its branch is heavier than the tip's. A block new to the
+// chain is appended to its store, if any; the block is added even if that fails, and
+// the error is returned.
+func (b *BlockChain) AddBlockAndUpdateTip(block *Block, hash string) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	if len(b.Blocks) == 0 || block.BlockNum > b.Blocks[b.newestHash].BlockNum {
-		b.newestHash = hash
+	var err error
+	if _, exists := b.Blocks[hash]; !exists && b.store != nil {
+		err = b.store.Append(hash, block)
 	}
+	b.addBlock(block, hash)
+	return err
+}
+
+func (b *BlockChain) addBlock(block *Block, hash string) {
 	b.Blocks[hash] = block
+	if b.isHeavier(hash, b.newestHash) {
+		b.newestHash = hash
+	}
+}
+
+// Returns the cumulative proof-of-work of the branch ending at the block: the sum over
+// its blocks of 16^difficulty, the number of hashes expected to be tried to mine them.
+// The genesis block, and any block not in the chain, have none.
+func (b *BlockChain) GetTotalWork(hash string) *big.Int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return new(big.Int).Set(b.getTotalWork(hash))
+}
+
+// Walks back from the block to the first one whose total work is known, then records
+// the total work of every block on the way
+func (b *BlockChain) getTotalWork(hash string) *big.Int {
+	if b.totalWork == nil {
+		b.totalWork = make(map[string]*big.Int)
+	}
+
+	work := big.NewInt(0)
+	var unknownHashes []string
+	for nextHash := hash; ; {
+		if knownWork, exists := b.totalWork[nextHash]; exists {
+			work = knownWork
+			break
+		}
+		block, exists := b.Blocks[nextHash]
+		if !exists {
+			break
+		}
+		unknownHashes = append(unknownHashes, nextHash)
+		nextHash = block.PrevHash
+	}
+
+	for i := len(unknownHashes) - 1; i >= 0; i-- {
+		work = new(big.Int).Add(work, b.getBlockWork(b.Blocks[unknownHashes[i]]))
+		b.totalWork[unknownHashes[i]] = work
+	}
+	return work
+}
+
+func (b *BlockChain) getBlockWork(block *Block) *big.Int {
+	difficulty := b.noOpBlockDifficulty
+	if len(block.OpRecords) > 0 {
+		difficulty = b.opBlockDifficulty
+	}
+	// every trailing zero is a hex digit, so it takes 16 times as many hashes
+	return new(big.Int).Lsh(big.NewInt(1), 4*uint(difficulty))
+}
+
+// Returns true if the branch ending at hash should be chosen over the one ending at
+// otherHash: it has more proof-of-work, or as much and a lower hash, so that every
+// miner breaks ties the same way whichever block it received first
+func (b *BlockChain) isHeavier(hash string, otherHash string) bool {
+	if cmp := b.getTotalWork(hash).Cmp(b.getTotalWork(otherHash)); cmp != 0 {
+		return cmp > 0
+	}
+	return hash < otherHash
 }
 
 // TODO - perhaps 'newest' isn't the best term
@@ -115,6 +413,34 @@ func (b *BlockChain) GetBlockByHash(hash string) *Block {
 	return b.Blocks[hash]
 }
 
+// Returns true if a block on any branch, the longest chain or not, holds the op
+func (b *BlockChain) IsOpInAnyBlock(opHash string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, block := range b.Blocks {
+		if _, exists := block.OpRecords[opHash]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the hashes of the blocks whose parent is the block with the given hash, which may
+// differ from it in case
+func (b *BlockChain) GetChildren(hash string) []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	children := make([]string, 0)
+	for childHash, block := range b.Blocks {
+		if strings.EqualFold(block.PrevHash, hash) {
+			children = append(children, childHash)
+		}
+	}
+	return children
+}
+
 func (b *BlockChain) DoesBlockExist(hash string) bool {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func acceptAllBlocks(hash string, block *Block) bool {
+	return true
+}
+
+func TestBlockStoreRecovery(t *testing.T) {
+	minerKey := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "blocks.log")
+	opBlock := newTestBlock(3, "two", map[string]*OpRecord{"add": newTestAddOp(1, minerKey)}, minerKey)
+
+	chain := BlockChain{Blocks: make(map[string]*Block)}
+	if err := chain.OpenStore(path, acceptAllBlocks); err != nil {
+		t.Fatal(err)
+	}
+	for hash, block := range map[string]*Block{"one": newTestBlock(1, "genesis", nil, minerKey), "two": newTestBlock(2, "one", nil, minerKey)} {
+		if err := chain.AddBlockAndUpdateTip(block, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chain.AddBlockAndUpdateTip(opBlock, "three"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while a record was being written leaves it torn
+	logFile, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	logFile.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 5})
+	logFile.Close()
+
+	reopened := BlockChain{Blocks: make(map[string]*Block)}
+	if err := reopened.OpenStore(path, acceptAllBlocks); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.GetSize() != 3 || reopened.GetNewestHash() != "three" {
+		t.Fatalf("Expected 3 blocks up to block three, but got %d up to %s", reopened.GetSize(), reopened.GetNewestHash())
+	}
+	loaded := reopened.GetBlockByHash("three")
+	if !reflect.DeepEqual(loaded, opBlock) || !loaded.OpRecords["add"].HasValidSignature() {
+		t.Error("Expected block three to be loaded as it was added")
+	}
+
+	// blocks added after the torn record was cut off are kept
+	reopened.AddBlockAndUpdateTip(newTestBlock(4, "three", nil, minerKey), "four")
+	reopenedAgain := BlockChain{Blocks: make(map[string]*Block)}
+	if err := reopenedAgain.OpenStore(path, acceptAllBlocks); err != nil {
+		t.Fatal(err)
+	}
+	if reopenedAgain.GetSize() != 4 || reopenedAgain.GetNewestHash() != "four" {
+		t.Errorf("Expected 4 blocks up to block four, but got %d up to %s", reopenedAgain.GetSize(), reopenedAgain.GetNewestHash())
+	}
+
+	// blocks the caller rejects are left out
+	filtered := BlockChain{Blocks: make(map[string]*Block)}
+	err := filtered.OpenStore(path, func(hash string, block *Block) bool {
+		return hash != "four"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered.GetSize() != 3 || filtered.DoesBlockExist("four") {
+		t.Errorf("Expected the rejected block to be left out, but got %d blocks", filtered.GetSize())
+	}
+}
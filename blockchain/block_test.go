@@ -0,0 +1,185 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	privKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privKey
+}
+
+// Returns a block on prevHash holding ops, which may be nil, mined by the owner of minerKey
+func newTestBlock(blockNum uint32, prevHash string, ops map[string]*OpRecord, minerKey *ecdsa.PrivateKey) *Block {
+	if ops == nil {
+		ops = make(map[string]*OpRecord)
+	}
+	return &Block{BlockNum: blockNum, PrevHash: prevHash, OpRecords: ops, MinerPubKey: &minerKey.PublicKey}
+}
+
+// Returns an op adding a shape, signed by the author owning privKey
+func newTestAddOp(seq uint64, privKey *ecdsa.PrivateKey) *OpRecord {
+	op := &OpRecord{Type: ADD, Shape: Shape{SvgString: "M 0 0 L 10 10", Fill: "transparent", Stroke: "red"}, InkUsed: 14, Seq: seq}
+	op.Sign(privKey)
+	return op
+}
+
+func TestForkChoice(t *testing.T) {
+	minerKey := newTestKey(t)
+	chain := BlockChain{Blocks: make(map[string]*Block)}
+	chain.SetPoWDifficulties(2, 1)
+	chain.SetNewestHash("genesis")
+
+	chain.AddBlockAndUpdateTip(newTestBlock(1, "genesis", nil, minerKey), "one")
+	chain.AddBlockAndUpdateTip(newTestBlock(2, "one", nil, minerKey), "two")
+	chain.AddBlockAndUpdateTip(newTestBlock(3, "two", nil, minerKey), "three")
+	if chain.GetNewestHash() != "three" || chain.GetTotalWork("three").Int64() != 3*16 {
+		t.Fatalf("Expected the tip to be the third no-op block with work 48, but got %s with work %s", chain.GetNewestHash(), chain.GetTotalWork(chain.GetNewestHash()))
+	}
+
+	// a shorter branch with an op block has more work behind it
+	forkBlock := newTestBlock(2, "one", map[string]*OpRecord{"add": newTestAddOp(1, minerKey)}, minerKey)
+	chain.AddBlockAndUpdateTip(forkBlock, "fork")
+	if chain.GetNewestHash() != "fork" || chain.GetTotalWork("fork").Int64() != 16+256 {
+		t.Fatalf("Expected the tip to move to the op block fork with work 272, but got %s with work %s", chain.GetNewestHash(), chain.GetTotalWork(chain.GetNewestHash()))
+	}
+
+	// siblings with as much work are chosen by the lower hash, whichever arrives first
+	for _, order := range [][]string{{"siblingA", "siblingB"}, {"siblingB", "siblingA"}} {
+		tieChain := BlockChain{Blocks: make(map[string]*Block)}
+		tieChain.SetPoWDifficulties(2, 1)
+		tieChain.AddBlockAndUpdateTip(newTestBlock(1, "genesis", nil, minerKey), "one")
+		tieChain.AddBlockAndUpdateTip(forkBlock, "fork")
+		for _, hash := range order {
+			tieChain.AddBlockAndUpdateTip(newTestBlock(3, "fork", nil, minerKey), hash)
+		}
+		if tieChain.GetNewestHash() != "siblingA" {
+			t.Errorf("Expected the tie to be broken by the lower hash siblingA, but got %s", tieChain.GetNewestHash())
+		}
+	}
+}
+
+func TestGetChildren(t *testing.T) {
+	minerKey := newTestKey(t)
+	chain := BlockChain{Blocks: make(map[string]*Block)}
+	chain.SetNewestHash("genesis")
+	chain.AddBlockAndUpdateTip(newTestBlock(1, "genesis", nil, minerKey), "one")
+	chain.AddBlockAndUpdateTip(newTestBlock(2, "one", nil, minerKey), "two")
+	chain.AddBlockAndUpdateTip(newTestBlock(2, "one", nil, minerKey), "fork")
+
+	children := chain.GetChildren("ONE")
+	sort.Strings(children)
+	if len(children) != 2 || children[0] != "fork" || children[1] != "two" {
+		t.Errorf("Expected the children fork and two, but got %v", children)
+	}
+	if children := chain.GetChildren("two"); len(children) != 0 {
+		t.Errorf("Expected no children of the tip, but got %v", children)
+	}
+}
+
+func TestCompleteOpGroups(t *testing.T) {
+	authorKey, otherKey := newTestKey(t), newTestKey(t)
+	first := OpRecord{Type: ADD, AuthorPubKey: authorKey.PublicKey, GroupID: "batch", GroupSize: 2}
+	second := OpRecord{Type: ADD, AuthorPubKey: authorKey.PublicKey, GroupID: "batch", GroupSize: 2}
+	// same group ID, but by another author
+	other := OpRecord{Type: ADD, AuthorPubKey: otherKey.PublicKey, GroupID: "batch", GroupSize: 2}
+	single := OpRecord{Type: ADD, AuthorPubKey: otherKey.PublicKey}
+
+	ops := map[string]*OpRecord{"first": &first, "other": &other, "single": &single}
+	if complete := CompleteOpGroups(ops); len(complete) != 1 || complete["single"] == nil {
+		t.Errorf("Expected only the single op, but got %v", complete)
+	}
+
+	ops["second"] = &second
+	if complete := CompleteOpGroups(ops); len(complete) != 3 || complete["other"] != nil {
+		t.Errorf("Expected the single op and the complete batch, but got %v", complete)
+	}
+}
+
+func TestSignatureCoversEverySignedField(t *testing.T) {
+	authorKey := newTestKey(t)
+	// paths long enough that the fields after them lie past the first 48 signed bytes
+	add := OpRecord{Type: ADD, Shape: Shape{SvgString: "M 0 0 L 10 10 L 20 20 L 30 30 L 40 40 L 50 50 L 60 60", Fill: "transparent", Stroke: "red"},
+		InkUsed: 85, Seq: 1, GroupID: "batch", GroupSize: 2}
+	add.Sign(authorKey)
+	del := OpRecord{Type: DELETE, ShapeHash: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", InkUsed: 85, Seq: 2}
+	del.Sign(authorKey)
+
+	tamperings := []struct {
+		name   string
+		op     OpRecord
+		tamper func(*OpRecord)
+	}{
+		{"add Type", add, func(o *OpRecord) { o.Type = DELETE }},
+		{"add SvgString", add, func(o *OpRecord) { o.Shape.SvgString = "M 0 0 L 10 10" }},
+		{"add Fill", add, func(o *OpRecord) { o.Shape.Fill = "red" }},
+		{"add Stroke", add, func(o *OpRecord) { o.Shape.Stroke = "blue" }},
+		{"add InkUsed", add, func(o *OpRecord) { o.InkUsed = 1 }},
+		{"add Seq", add, func(o *OpRecord) { o.Seq = 99 }},
+		{"add GroupID", add, func(o *OpRecord) { o.GroupID = "other" }},
+		{"add GroupSize", add, func(o *OpRecord) { o.GroupSize = 1 }},
+		{"delete ShapeHash", del, func(o *OpRecord) { o.ShapeHash = del.ShapeHash[:63] + "0" }},
+		{"delete InkUsed", del, func(o *OpRecord) { o.InkUsed = 1 }},
+		{"delete Seq", del, func(o *OpRecord) { o.Seq = 99 }},
+	}
+	for _, tampering := range tamperings {
+		op := tampering.op
+		if !op.HasValidSignature() {
+			t.Fatalf("Expected the untouched op to be valid before changing its %s", tampering.name)
+		}
+		tampering.tamper(&op)
+		if op.HasValidSignature() {
+			t.Errorf("Expected changing the %s to invalidate the signature", tampering.name)
+		}
+	}
+}
+
+func TestSignatureOnlyOnNetworkCurve(t *testing.T) {
+	victimKey := newTestKey(t)
+	op := newTestAddOp(1, victimKey)
+	if !op.HasValidSignature() {
+		t.Fatal("Expected an op signed on the network curve to be valid")
+	}
+	// as the key arrives when decoded from gob
+	decoded := *op
+	decoded.AuthorPubKey.Curve = NetworkCurve.Params()
+	if !decoded.HasValidSignature() || PubKeyID(decoded.AuthorPubKey) != PubKeyID(victimKey.PublicKey) {
+		t.Error("Expected a key with the parameters of the network curve to be the same key")
+	}
+
+	// a curve through the victim's public key, with that point as generator, so that
+	// the private key 1 signs for it
+	network := NetworkCurve.Params()
+	x, y := victimKey.PublicKey.X, victimKey.PublicKey.Y
+	b := new(big.Int).Mul(y, y)
+	b.Sub(b, new(big.Int).Exp(x, big.NewInt(3), nil))
+	b.Add(b, new(big.Int).Mul(big.NewInt(3), x))
+	b.Mod(b, network.P)
+	forgedCurve := &elliptic.CurveParams{P: network.P, N: network.N, B: b, Gx: x, Gy: y, BitSize: network.BitSize, Name: network.Name}
+	forgerKey := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: forgedCurve, X: x, Y: y}, D: big.NewInt(1)}
+
+	forged := *op
+	forged.Shape.Stroke = "blue"
+	r, s, err := ecdsa.Sign(rand.Reader, forgerKey, forged.signingDigest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.OpSigR, forged.OpSigS, forged.AuthorPubKey = r, s, forgerKey.PublicKey
+	if !ecdsa.Verify(&forged.AuthorPubKey, forged.signingDigest(), r, s) {
+		t.Fatal("Expected the forgery to verify on its own curve")
+	}
+	if forged.HasValidSignature() {
+		t.Error("Expected an op signed on another curve to be invalid")
+	}
+	if PubKeyID(forged.AuthorPubKey) == PubKeyID(victimKey.PublicKey) {
+		t.Error("Expected a key on another curve to have another ID")
+	}
+}
@@ -0,0 +1,158 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"sort"
+)
+
+// The ink balance of every miner and art node, and the Seq of the last op of every author,
+// as of one block. A block's ledger is derived from its parent's by applying only that
+// block, and is never changed afterwards. It only holds the balances and Seqs the block
+// changed, over its parent's ledger, so that ledgers of many blocks share what they have
+// in common; every InkLedgerDepth blocks, a ledger holds them all so that lookups stay short.
+type InkLedger struct {
+	parent   *InkLedger        // nil if the ledger holds every balance and Seq
+	depth    int               // number of ledgers up to the nearest one without a parent
+	balances map[string]int    // by PubKeyID
+	seqs     map[string]uint64 // by PubKeyID
+}
+
+const InkLedgerDepth = 32
+
+// Returns the ledger of the genesis block, where nobody has any ink or ops
+func NewInkLedger() *InkLedger {
+	return &InkLedger{balances: make(map[string]int), seqs: make(map[string]uint64)}
+}
+
+// Returns the ink of the public key; can be negative if a chain spends more than it earns
+func (l *InkLedger) Balance(pubKey ecdsa.PublicKey) int {
+	return l.balance(PubKeyID(pubKey))
+}
+
+// Returns the Seq of the last op by the public key, or 0 if it has none
+func (l *InkLedger) LastSeq(pubKey ecdsa.PublicKey) uint64 {
+	return l.lastSeq(PubKeyID(pubKey))
+}
+
+func (l *InkLedger) balance(id string) int {
+	for ; l != nil; l = l.parent {
+		if balance, exists := l.balances[id]; exists {
+			return balance
+		}
+	}
+	return 0
+}
+
+func (l *InkLedger) lastSeq(id string) uint64 {
+	for ; l != nil; l = l.parent {
+		if seq, exists := l.seqs[id]; exists {
+			return seq
+		}
+	}
+	return 0
+}
+
+// Returns the ops that a child block can hold: for every author, the ops whose Seqs
+// follow on from the author's last Seq, up to the first missing Seq. Ops with a Seq
+// that is already used are left out, as are all but the lowest hash of ops sharing a Seq.
+func (l *InkLedger) SequencedOps(ops map[string]*OpRecord) map[string]*OpRecord {
+	opHashesByAuthor := make(map[string][]string)
+	for opHash, op := range ops {
+		authorID := PubKeyID(op.AuthorPubKey)
+		opHashesByAuthor[authorID] = append(opHashesByAuthor[authorID], opHash)
+	}
+
+	sequencedOps := make(map[string]*OpRecord, len(ops))
+	for authorID, opHashes := range opHashesByAuthor {
+		sort.Slice(opHashes, func(i, j int) bool {
+			seqI, seqJ := ops[opHashes[i]].Seq, ops[opHashes[j]].Seq
+			if seqI != seqJ {
+				return seqI < seqJ
+			}
+			return opHashes[i] < opHashes[j]
+		})
+
+		nextSeq := l.lastSeq(authorID) + 1
+		for _, opHash := range opHashes {
+			if seq := ops[opHash].Seq; seq == nextSeq {
+				sequencedOps[opHash] = ops[opHash]
+				nextSeq++
+			} else if seq > nextSeq {
+				break
+			}
+		}
+	}
+	return sequencedOps
+}
+
+// Returns the ledger of a child block: its miner earns inkPerOpBlock or inkPerNoOpBlock,
+// the authors of its add operations pay their ink, and delete operations refund it.
+// The last Seq of each author becomes the highest Seq of their ops in the block.
+func (l *InkLedger) Next(block *Block, inkPerOpBlock uint32, inkPerNoOpBlock uint32) *InkLedger {
+	next := &InkLedger{
+		parent:   l,
+		depth:    l.depth + 1,
+		balances: make(map[string]int, len(block.OpRecords)+1),
+		seqs:     make(map[string]uint64, len(block.OpRecords)),
+	}
+
+	if block.MinerPubKey != nil {
+		minerID := PubKeyID(*block.MinerPubKey)
+		if len(block.OpRecords) == 0 {
+			next.balances[minerID] = next.balance(minerID) + int(inkPerNoOpBlock)
+		} else {
+			next.balances[minerID] = next.balance(minerID) + int(inkPerOpBlock)
+		}
+	}
+	for _, opRecord := range block.OpRecords {
+		authorID := PubKeyID(opRecord.AuthorPubKey)
+		if opRecord.IsDelete() {
+			next.balances[authorID] = next.balance(authorID) + int(opRecord.InkUsed)
+		} else {
+			next.balances[authorID] = next.balance(authorID) - int(opRecord.InkUsed)
+		}
+		if opRecord.Seq > next.lastSeq(authorID) {
+			next.seqs[authorID] = opRecord.Seq
+		}
+	}
+
+	if next.depth >= InkLedgerDepth {
+		next.flatten()
+	}
+	return next
+}
+
+// Copies every balance and Seq of the ledger's ancestors into it, and drops its parent
+func (l *InkLedger) flatten() {
+	var ancestors []*InkLedger
+	for ancestor := l.parent; ancestor != nil; ancestor = ancestor.parent {
+		ancestors = append(ancestors, ancestor)
+	}
+	balances, seqs := make(map[string]int), make(map[string]uint64)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		for id, balance := range ancestors[i].balances {
+			balances[id] = balance
+		}
+		for id, seq := range ancestors[i].seqs {
+			seqs[id] = seq
+		}
+	}
+	for id, balance := range l.balances {
+		balances[id] = balance
+	}
+	for id, seq := range l.seqs {
+		seqs[id] = seq
+	}
+	l.parent, l.depth, l.balances, l.seqs = nil, 0, balances, seqs
+}
+
+// Identifies a public key, for use as a map key. The curve is part of the ID, so that a
+// key on another curve through the same point, even one named like NetworkCurve, is another key.
+func PubKeyID(pubKey ecdsa.PublicKey) string {
+	curve := curveName(pubKey.Curve)
+	if !IsNetworkCurve(pubKey.Curve) {
+		curve = "untrusted " + curve
+	}
+	return fmt.Sprint(curve, pubKey.X, pubKey.Y)
+}
@@ -0,0 +1,39 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestInkLedgerSharesParents(t *testing.T) {
+	minerKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	authorKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	noOpBlock := &Block{OpRecords: make(map[string]*OpRecord), MinerPubKey: &minerKey.PublicKey}
+	opBlock := &Block{
+		OpRecords:   map[string]*OpRecord{"add": {Type: ADD, InkUsed: 5, Seq: 1, AuthorPubKey: authorKey.PublicKey}},
+		MinerPubKey: &minerKey.PublicKey,
+	}
+
+	ledgers := []*InkLedger{NewInkLedger().Next(opBlock, 100, 50)}
+	for i := 1; i < 3*InkLedgerDepth; i++ {
+		ledgers = append(ledgers, ledgers[i-1].Next(noOpBlock, 100, 50))
+		if ledgers[i].depth >= InkLedgerDepth {
+			t.Fatalf("Expected ledgers at most %d deep, but got %d", InkLedgerDepth, ledgers[i].depth)
+		}
+		if len(ledgers[i].balances) > 1 && ledgers[i].parent != nil {
+			t.Fatalf("Expected a ledger to only hold what its block changed, but got %d balances", len(ledgers[i].balances))
+		}
+	}
+
+	// every ledger still sees all the changes before it, across the ledgers holding everything
+	for i, ledger := range ledgers {
+		if balance := ledger.Balance(minerKey.PublicKey); balance != 100+50*i {
+			t.Errorf("Expected balance %d after %d blocks, but got %d", 100+50*i, i+1, balance)
+		}
+		if balance, seq := ledger.Balance(authorKey.PublicKey), ledger.LastSeq(authorKey.PublicKey); balance != -5 || seq != 1 {
+			t.Errorf("Expected the author's balance -5 and Seq 1, but got %d and %d", balance, seq)
+		}
+	}
+}
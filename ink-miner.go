@@ -10,10 +10,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"net/rpc"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +36,14 @@ import (
 const HeartbeatMultiplier = 2
 const FirstNonce = 0 // the first uint32
 const FirstBlockNum = 1
+const RequestRetention = time.Minute // how long a cancelled or finished art node request is remembered
+const BlockEventLogSize = 1024       // number of block events kept for art nodes that fell behind
+const BlockEventsLongPoll = 20 * time.Second
+const ShapeGridCellSize = 64                     // width and height of the cells of the spatial index of shapes
+const SyncHeadersBatchSize = 256                 // number of block headers asked for at once while syncing
+const SyncMaxHeaders = 64 * SyncHeadersBatchSize // most block headers fetched to reach a known block
+const OrphanPoolSize = 128                       // number of blocks kept while their parents are unknown
+const OrphanExpiry = 10 * time.Minute
 
 type ConnectedMiners struct {
 	sync.RWMutex
@@ -78,9 +88,679 @@ func (miners *ConnectedMiners) GetConnectionCount() uint8 {
 	return uint8(len(miners.all))
 }
 
+// Operations waiting to be mined, along with the ones selected for a block on selectionTip,
+// which are only selected again once the tip or the pending operations change
 type PendingOperations struct {
 	sync.RWMutex
-	all map[string]*blockchain.OpRecord
+	all          map[string]*blockchain.OpRecord
+	selection    map[string]*blockchain.OpRecord // nil once the pending operations change
+	selectionTip string
+}
+
+// Adds the op unless it is already pending. Returns true if it was added.
+func (ops *PendingOperations) Add(opRecordHash string, op blockchain.OpRecord) bool {
+	ops.Lock()
+	defer ops.Unlock()
+
+	if _, exists := ops.all[opRecordHash]; exists {
+		return false
+	}
+	ops.all[opRecordHash] = &op
+	ops.selection = nil
+	return true
+}
+
+// Adds back the ops of blocks that left the longest chain, unless they are already pending.
+// Those that are no longer valid, or are on the new chain too, are dropped when next selected.
+func (ops *PendingOperations) Restore(opRecords map[string]*blockchain.OpRecord) {
+	ops.Lock()
+	defer ops.Unlock()
+
+	for opHash, op := range opRecords {
+		if _, exists := ops.all[opHash]; !exists {
+			opCopy := *op
+			ops.all[opHash] = &opCopy
+			ops.selection = nil
+		}
+	}
+}
+
+func (ops *PendingOperations) Contains(opRecordHash string) bool {
+	ops.RLock()
+	defer ops.RUnlock()
+
+	_, exists := ops.all[opRecordHash]
+	return exists
+}
+
+func (ops *PendingOperations) Remove(opRecords map[string]*blockchain.OpRecord) {
+	ops.Lock()
+	defer ops.Unlock()
+
+	for opHash := range opRecords {
+		delete(ops.all, opHash)
+	}
+	ops.selection = nil
+}
+
+// Returns the pending ops that a block on the chain ending at tipHash can hold, first removing
+// the ops that can never be added on top of it. The selection is reused until the tip or the
+// pending operations change, and must not be modified.
+func (ops *PendingOperations) Selection(inkMiner *InkMiner, tipHash string) map[string]*blockchain.OpRecord {
+	ops.Lock()
+	defer ops.Unlock()
+
+	if ops.selection == nil || ops.selectionTip != tipHash {
+		ops.removeStale(inkMiner, tipHash)
+		ops.selection = selectOperations(inkMiner, ops.all, tipHash)
+		ops.selectionTip = tipHash
+	}
+	return ops.selection
+}
+
+// Removes the ops whose Seq is already used on the chain ending at tipHash, and the ops next
+// in their author's sequence that are invalid on top of it, so that no op stays pending that
+// would hold up the author's later ops for good. Must hold the lock
+func (ops *PendingOperations) removeStale(inkMiner *InkMiner, tipHash string) {
+	ledger := inkLedgers.Get(tipHash, inkMiner.settings)
+	for opHash, op := range ops.all {
+		if op.Seq <= ledger.LastSeq(op.AuthorPubKey) {
+			delete(ops.all, opHash)
+		}
+	}
+
+	// the ops are validated again after each drop, as the dropped ops may have been applied
+	for dropped := true; dropped; {
+		dropped = false
+		validation := newOpValidation(inkMiner, tipHash)
+		for _, opHash := range blockchain.OpApplyOrder(ledger.SequencedOps(ops.all)) {
+			if op := ops.all[opHash]; !validation.apply(opHash, *op) {
+				outLog.Printf("Pending operation %s is invalid on the longest chain, dropping it\n", opHash)
+				ops.removeFrom(op)
+				dropped = true
+				break
+			}
+		}
+	}
+}
+
+// Removes the op along with the rest of its batch, which can only be added whole, and the
+// ops of its author with later Seqs, which could never follow on from them. Must hold the lock
+func (ops *PendingOperations) removeFrom(invalid *blockchain.OpRecord) {
+	authorID := blockchain.PubKeyID(invalid.AuthorPubKey)
+	fromSeq := invalid.Seq
+	for _, op := range ops.all {
+		isInBatch := invalid.GroupID != "" && op.GroupID == invalid.GroupID && op.GroupSize == invalid.GroupSize
+		if isInBatch && op.Seq < fromSeq && blockchain.PubKeyID(op.AuthorPubKey) == authorID {
+			fromSeq = op.Seq
+		}
+	}
+	for opHash, op := range ops.all {
+		if op.Seq >= fromSeq && blockchain.PubKeyID(op.AuthorPubKey) == authorID {
+			delete(ops.all, opHash)
+		}
+	}
+}
+
+// Hashes of operations that art nodes submitted through this miner
+type SubmittedOperations struct {
+	sync.RWMutex
+	all map[string]bool
+}
+
+func (ops *SubmittedOperations) Add(opRecordHash string) {
+	ops.Lock()
+	defer ops.Unlock()
+
+	ops.all[opRecordHash] = true
+}
+
+func (ops *SubmittedOperations) Contains(opRecordHash string) bool {
+	ops.RLock()
+	defer ops.RUnlock()
+
+	return ops.all[opRecordHash]
+}
+
+// Events of the block chain, streamed to art nodes through GetBlockEvents
+type BlockEventLog struct {
+	sync.Mutex
+	events      []blockartlib.BlockEvent // the last BlockEventLogSize events
+	nextSeq     uint64
+	tipHash     string // tip of the longest chain as of the last event
+	genesisHash string
+	changed     chan struct{} // closed and replaced whenever events are recorded
+}
+
+func NewBlockEventLog(genesisHash string) *BlockEventLog {
+	return &BlockEventLog{nextSeq: 1, tipHash: genesisHash, genesisHash: genesisHash, changed: make(chan struct{})}
+}
+
+// Records a NEWBLOCK event for the block, followed by a TIPCHANGED or REORG
+// event if the longest chain changed
+func (l *BlockEventLog) BlockAdded(blockHash string) {
+	l.Lock()
+	defer l.Unlock()
+
+	added, removed := canvasEngine.BlockChanges(blockHash)
+	l.record(blockartlib.BlockEvent{Kind: blockartlib.NEWBLOCK, BlockHash: blockHash, AddedShapes: added, RemovedShapes: removed})
+	l.recordTipChange()
+}
+
+// Returns the events from fromSeq on, waiting up to timeout for one to be recorded.
+// A RESET event is returned in place of events that were dropped from the log.
+// Also returns the seq to ask for next.
+func (l *BlockEventLog) EventsFrom(fromSeq uint64, timeout time.Duration) ([]blockartlib.BlockEvent, uint64) {
+	deadline := time.After(timeout)
+	for {
+		l.Lock()
+		if fromSeq == 0 || fromSeq > l.nextSeq {
+			defer l.Unlock()
+			return nil, l.nextSeq
+		}
+		oldestSeq := l.nextSeq - uint64(len(l.events))
+		if fromSeq < oldestSeq {
+			defer l.Unlock()
+			event := l.resetEvent()
+			event.Seq = l.nextSeq - 1
+			return []blockartlib.BlockEvent{event}, l.nextSeq
+		}
+		if fromSeq < l.nextSeq {
+			defer l.Unlock()
+			events := make([]blockartlib.BlockEvent, l.nextSeq-fromSeq)
+			copy(events, l.events[fromSeq-oldestSeq:])
+			return events, l.nextSeq
+		}
+		changed := l.changed
+		l.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fromSeq
+		}
+	}
+}
+
+// Must hold the lock
+func (l *BlockEventLog) record(event blockartlib.BlockEvent) {
+	event.Seq = l.nextSeq
+	l.nextSeq++
+	l.events = append(l.events, event)
+	if len(l.events) > BlockEventLogSize {
+		l.events = l.events[len(l.events)-BlockEventLogSize:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Records a TIPCHANGED or REORG event if the tip of the longest chain moved. Must hold the lock
+func (l *BlockEventLog) recordTipChange() {
+	newTip := blockChain.GetNewestHash()
+	if newTip == l.tipHash {
+		return
+	}
+	prevTip := l.tipHash
+	l.tipHash = newTip
+
+	// walk both tips back to their common ancestor, netting out the shape changes
+	shapeChanges := make(map[string]int)
+	kind := blockartlib.TIPCHANGED
+	for oldHash, newHash := prevTip, newTip; oldHash != newHash; {
+		if newHash == l.genesisHash || (oldHash != l.genesisHash && blockChain.GetBlockNum(oldHash) >= blockChain.GetBlockNum(newHash)) {
+			if !blockChain.DoesBlockExist(oldHash) {
+				l.record(l.resetEvent())
+				return
+			}
+			// blocks leaving the longest chain undo their shape changes
+			kind = blockartlib.REORG
+			added, removed := canvasEngine.BlockChanges(oldHash)
+			countShapeChanges(shapeChanges, removed, added)
+			oldHash = blockChain.GetPrevHash(oldHash)
+		} else {
+			added, removed := canvasEngine.BlockChanges(newHash)
+			countShapeChanges(shapeChanges, added, removed)
+			newHash = blockChain.GetPrevHash(newHash)
+		}
+	}
+	event := blockartlib.BlockEvent{Kind: kind, BlockHash: newTip, PrevTipHash: prevTip}
+	for shapeHash, count := range shapeChanges {
+		if count > 0 {
+			event.AddedShapes = append(event.AddedShapes, shapeHash)
+		} else if count < 0 {
+			event.RemovedShapes = append(event.RemovedShapes, shapeHash)
+		}
+	}
+	l.record(event)
+}
+
+func countShapeChanges(shapeChanges map[string]int, added []string, removed []string) {
+	for _, shapeHash := range added {
+		shapeChanges[shapeHash]++
+	}
+	for _, shapeHash := range removed {
+		shapeChanges[shapeHash]--
+	}
+}
+
+// Returns a RESET event listing the shapes on the longest chain. Must hold the lock
+func (l *BlockEventLog) resetEvent() blockartlib.BlockEvent {
+	event := blockartlib.BlockEvent{Kind: blockartlib.RESET, BlockHash: l.tipHash}
+	for _, shape := range GetCanvasTraversal(l.tipHash) {
+		event.AddedShapes = append(event.AddedShapes, shape.ShapeHash)
+	}
+	return event
+}
+
+// Blocks received before their parents, by hash, kept until their ancestry arrives.
+// At most OrphanPoolSize are kept, each for up to OrphanExpiry.
+type OrphanPool struct {
+	sync.Mutex
+	all map[string]*orphanBlock
+}
+
+type orphanBlock struct {
+	block    blockchain.Block
+	received time.Time
+}
+
+// Adds the orphan, first dropping the expired orphans and, if the pool is still full,
+// the oldest one. Returns false if the pool already held it.
+func (p *OrphanPool) Add(blockHash string, block blockchain.Block) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, exists := p.all[blockHash]; exists {
+		return false
+	}
+	now := time.Now()
+	var oldestHash string
+	for hash, orphan := range p.all {
+		if now.Sub(orphan.received) > OrphanExpiry {
+			delete(p.all, hash)
+		} else if oldestHash == "" || orphan.received.Before(p.all[oldestHash].received) {
+			oldestHash = hash
+		}
+	}
+	if len(p.all) >= OrphanPoolSize {
+		delete(p.all, oldestHash)
+	}
+	p.all[blockHash] = &orphanBlock{block: block, received: now}
+	return true
+}
+
+func (p *OrphanPool) Contains(blockHash string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	_, exists := p.all[blockHash]
+	return exists
+}
+
+// Removes and returns the unexpired orphans whose parent is the block parentHash, ordered by hash
+func (p *OrphanPool) TakeChildren(parentHash string) []blockchain.Block {
+	p.Lock()
+	defer p.Unlock()
+
+	var childHashes []string
+	for hash, orphan := range p.all {
+		if orphan.block.PrevHash == parentHash {
+			childHashes = append(childHashes, hash)
+		}
+	}
+	sort.Strings(childHashes)
+
+	var children []blockchain.Block
+	for _, hash := range childHashes {
+		if time.Since(p.all[hash].received) <= OrphanExpiry {
+			children = append(children, p.all[hash].block)
+		}
+		delete(p.all, hash)
+	}
+	return children
+}
+
+// Ink ledgers of the blocks, by block hash
+type InkLedgers struct {
+	sync.Mutex
+	all map[string]*blockchain.InkLedger
+}
+
+// Returns the ink ledger as of the block blockHash, deriving the ledgers of the
+// blocks since the closest ancestor whose ledger is known.
+func (l *InkLedgers) Get(blockHash string, settings *blockartlib.MinerNetSettings) *blockchain.InkLedger {
+	l.Lock()
+	defer l.Unlock()
+
+	var blockHashes []string
+	ledger := blockchain.NewInkLedger()
+	for hash := blockHash; hash != settings.GenesisBlockHash && blockChain.DoesBlockExist(hash); hash = blockChain.GetPrevHash(hash) {
+		if known, exists := l.all[hash]; exists {
+			ledger = known
+			break
+		}
+		blockHashes = append(blockHashes, hash)
+	}
+
+	for i := len(blockHashes) - 1; i >= 0; i-- {
+		ledger = ledger.Next(blockChain.GetBlockByHash(blockHashes[i]), settings.InkPerOpBlock, settings.InkPerNoOpBlock)
+		l.all[blockHashes[i]] = ledger
+	}
+	return ledger
+}
+
+// A shape on the canvas, with the block that added it
+type CanvasShape struct {
+	Hash      string
+	OpRecord  *blockchain.OpRecord
+	BlockHash string
+	BlockNum  uint32
+	bounds    util.Bounds
+}
+
+// The changes applying one block made to the canvas, kept so that they can be undone
+type canvasChange struct {
+	blockHash string
+	added     []*CanvasShape // shapes the block added
+	removed   []*CanvasShape // shapes the block's delete operations removed, in order
+}
+
+// Looks up the shapes of a canvas, live or deleted
+type shapeLookup interface {
+	Shape(shapeHash string) (*CanvasShape, bool)
+	AnyShape(shapeHash string) (*CanvasShape, bool)
+}
+
+// The canvas as of one block: its live shapes and their owners, and the shapes that were
+// deleted, built by replaying the operations of the chain in order from the genesis block.
+type CanvasState struct {
+	genesisHash string
+	shapes      map[string]*CanvasShape // live shapes by hash
+	deleted     map[string]*CanvasShape // deleted shapes by hash
+	grid        *util.ShapeGrid
+	changes     []canvasChange  // one for every block from the genesis block to the tip
+	applied     map[string]bool // hashes of the blocks in changes
+	// the changes of every block worked out so far, by hash, which only depend on the
+	// block's ancestors and so stay the same when the state moves to another branch
+	blockChanges map[string]canvasChange
+}
+
+// Keeps the canvas state of the block it was last asked about, moving it to other
+// blocks by undoing and applying blocks, so that switching tips only replays the
+// blocks since the fork. The changes of a block are kept once worked out, so that
+// block events never move the state.
+type CanvasEngine struct {
+	sync.Mutex
+	state *CanvasState
+}
+
+func NewCanvasEngine(genesisHash string, canvasSettings blockartlib.CanvasSettings) *CanvasEngine {
+	return &CanvasEngine{state: &CanvasState{
+		genesisHash:  genesisHash,
+		shapes:       make(map[string]*CanvasShape),
+		deleted:      make(map[string]*CanvasShape),
+		grid:         util.NewShapeGrid(ShapeGridCellSize, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax),
+		applied:      make(map[string]bool),
+		blockChanges: make(map[string]canvasChange),
+	}}
+}
+
+// Calls fn with the canvas as of the block tipHash. The blocks of the current state that
+// are not ancestors of tipHash are undone, then the blocks since their common ancestor
+// are applied. A chain with a missing block is replayed from the block after the gap.
+// fn must not keep the state once it returns.
+func (e *CanvasEngine) View(tipHash string, fn func(state *CanvasState)) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.view(tipHash, fn)
+}
+
+// Must hold the lock
+func (e *CanvasEngine) view(tipHash string, fn func(state *CanvasState)) {
+	s := e.state
+	var blockHashes []string
+	hash := tipHash
+	for ; hash != s.genesisHash && blockChain.DoesBlockExist(hash) && !s.applied[hash]; hash = blockChain.GetPrevHash(hash) {
+		blockHashes = append(blockHashes, hash)
+	}
+	if !s.applied[hash] {
+		hash = s.genesisHash
+	}
+
+	for s.TipHash() != hash {
+		s.undo()
+	}
+	for i := len(blockHashes) - 1; i >= 0; i-- {
+		s.apply(blockHashes[i], blockChain.GetBlockByHash(blockHashes[i]))
+	}
+	fn(s)
+}
+
+// Returns the hashes of the shapes the block added, and of the shapes its delete operations removed.
+// The changes of a block are worked out once, without moving the state off its branch.
+func (e *CanvasEngine) BlockChanges(blockHash string) (added []string, removed []string) {
+	e.Lock()
+	defer e.Unlock()
+
+	change, exists := e.state.blockChanges[blockHash]
+	if !exists {
+		change, exists = e.state.branchChange(blockHash)
+	}
+	if !exists {
+		// the branch has blocks whose changes are unknown, so they are applied instead
+		e.view(blockHash, func(state *CanvasState) {
+			if state.TipHash() == blockHash {
+				change, exists = state.changes[len(state.changes)-1], true
+			}
+		})
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	for _, shape := range change.added {
+		added = append(added, shape.Hash)
+	}
+	for _, shape := range change.removed {
+		removed = append(removed, shape.Hash)
+	}
+	return added, removed
+}
+
+// Returns the block the state is as of
+func (s *CanvasState) TipHash() string {
+	if len(s.changes) == 0 {
+		return s.genesisHash
+	}
+	return s.changes[len(s.changes)-1].blockHash
+}
+
+// Returns the live shape with the given hash
+func (s *CanvasState) Shape(shapeHash string) (*CanvasShape, bool) {
+	shape, exists := s.shapes[shapeHash]
+	return shape, exists
+}
+
+// Returns the shape with the given hash, whether it is live or was deleted
+func (s *CanvasState) AnyShape(shapeHash string) (*CanvasShape, bool) {
+	if shape, exists := s.shapes[shapeHash]; exists {
+		return shape, true
+	}
+	shape, exists := s.deleted[shapeHash]
+	return shape, exists
+}
+
+// Returns the live shapes in the order they were added. Shapes added in the same block are ordered by hash.
+func (s *CanvasState) Shapes() []*CanvasShape {
+	shapes := make([]*CanvasShape, 0, len(s.shapes))
+	for _, shape := range s.shapes {
+		shapes = append(shapes, shape)
+	}
+	sort.Slice(shapes, func(i, j int) bool {
+		if shapes[i].BlockNum != shapes[j].BlockNum {
+			return shapes[i].BlockNum < shapes[j].BlockNum
+		}
+		return shapes[i].Hash < shapes[j].Hash
+	})
+	return shapes
+}
+
+// Returns the hashes of the live shapes whose bounds touch those of shapeString
+func (s *CanvasState) Candidates(shapeString string) []string {
+	bounds, err := util.ShapeBounds(shapeString)
+	if err != nil {
+		return nil
+	}
+	return s.grid.Candidates(bounds)
+}
+
+// Applies the block to the state
+func (s *CanvasState) apply(blockHash string, block *blockchain.Block) {
+	change := newCanvasChange(blockHash, block, s)
+	for _, shape := range change.added {
+		s.addLive(shape)
+	}
+	for _, shape := range change.removed {
+		s.removeLive(shape)
+		s.deleted[shape.Hash] = shape
+	}
+
+	s.changes = append(s.changes, change)
+	s.applied[blockHash] = true
+	s.blockChanges[blockHash] = change
+}
+
+// Returns the changes of a block on another branch than the state's, worked out against
+// the canvas as of its parent: the state with its blocks since the fork undone and the
+// blocks of the branch redone, from their known changes. Returns false if the changes of
+// a block of the branch are unknown, or the branch has a missing block.
+// Must hold the lock of the engine
+func (s *CanvasState) branchChange(blockHash string) (canvasChange, bool) {
+	block := blockChain.GetBlockByHash(blockHash)
+	if block == nil {
+		return canvasChange{}, false
+	}
+
+	// newest first, back to the fork
+	var branch []canvasChange
+	forkHash := block.PrevHash
+	for ; forkHash != s.genesisHash && !s.applied[forkHash]; forkHash = blockChain.GetPrevHash(forkHash) {
+		change, exists := s.blockChanges[forkHash]
+		if !exists || !blockChain.DoesBlockExist(forkHash) {
+			return canvasChange{}, false
+		}
+		branch = append(branch, change)
+	}
+
+	parent := canvasOverlay{state: s, shapes: make(map[string]overlayShape)}
+	for i := len(s.changes) - 1; i >= 0 && s.changes[i].blockHash != forkHash; i-- {
+		for _, shape := range s.changes[i].removed {
+			parent.shapes[shape.Hash] = overlayShape{shape: shape, live: true}
+		}
+		for _, shape := range s.changes[i].added {
+			parent.shapes[shape.Hash] = overlayShape{}
+		}
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		for _, shape := range branch[i].added {
+			parent.shapes[shape.Hash] = overlayShape{shape: shape, live: true}
+		}
+		for _, shape := range branch[i].removed {
+			parent.shapes[shape.Hash] = overlayShape{shape: shape}
+		}
+	}
+
+	change := newCanvasChange(blockHash, block, parent)
+	s.blockChanges[blockHash] = change
+	return change, true
+}
+
+// Returns the changes of the ops of the block to the canvas, applied in blockchain.OpApplyOrder:
+// it adds the shapes of its add operations, then removes the shapes its delete operations delete.
+// A delete is ignored unless its target is live and owned by its author.
+func newCanvasChange(blockHash string, block *blockchain.Block, canvas shapeLookup) canvasChange {
+	change := canvasChange{blockHash: blockHash}
+	added := make(map[string]*CanvasShape)
+	removed := make(map[string]bool)
+	for _, opHash := range blockchain.OpApplyOrder(block.OpRecords) {
+		opRecord := block.OpRecords[opHash]
+		if !opRecord.IsDelete() {
+			if _, exists := canvas.AnyShape(opHash); exists {
+				continue
+			}
+			bounds, err := util.ShapeBounds(opRecord.Shape.SvgString)
+			if err != nil {
+				continue
+			}
+			added[opHash] = &CanvasShape{Hash: opHash, OpRecord: opRecord, BlockHash: blockHash, BlockNum: block.BlockNum, bounds: bounds}
+			change.added = append(change.added, added[opHash])
+			continue
+		}
+
+		shape, isLive := added[opRecord.ShapeHash]
+		if !isLive {
+			shape, isLive = canvas.Shape(opRecord.ShapeHash)
+		}
+		if !isLive || removed[shape.Hash] || !reflect.DeepEqual(shape.OpRecord.AuthorPubKey, opRecord.AuthorPubKey) {
+			continue
+		}
+		removed[shape.Hash] = true
+		change.removed = append(change.removed, shape)
+	}
+	return change
+}
+
+// Undoes the changes of the last block applied
+func (s *CanvasState) undo() {
+	change := s.changes[len(s.changes)-1]
+	s.changes = s.changes[:len(s.changes)-1]
+	delete(s.applied, change.blockHash)
+
+	for i := len(change.removed) - 1; i >= 0; i-- {
+		delete(s.deleted, change.removed[i].Hash)
+		s.addLive(change.removed[i])
+	}
+	for _, shape := range change.added {
+		s.removeLive(shape)
+	}
+}
+
+// The canvas as of a block off the state's branch: the shapes whose state differs there
+// are looked up in shapes, the others in the state
+type canvasOverlay struct {
+	state  *CanvasState
+	shapes map[string]overlayShape
+}
+
+// A shape as of the overlay's block; shape is nil if it is not on the canvas there
+type overlayShape struct {
+	shape *CanvasShape
+	live  bool
+}
+
+func (o canvasOverlay) Shape(shapeHash string) (*CanvasShape, bool) {
+	if overlay, exists := o.shapes[shapeHash]; exists {
+		return overlay.shape, overlay.shape != nil && overlay.live
+	}
+	return o.state.Shape(shapeHash)
+}
+
+func (o canvasOverlay) AnyShape(shapeHash string) (*CanvasShape, bool) {
+	if overlay, exists := o.shapes[shapeHash]; exists {
+		return overlay.shape, overlay.shape != nil
+	}
+	return o.state.AnyShape(shapeHash)
+}
+
+func (s *CanvasState) addLive(shape *CanvasShape) {
+	s.shapes[shape.Hash] = shape
+	s.grid.Insert(shape.Hash, shape.bounds)
+}
+
+func (s *CanvasState) removeLive(shape *CanvasShape) {
+	delete(s.shapes, shape.Hash)
+	s.grid.Remove(shape.Hash)
 }
 
 type InkMiner struct {
@@ -97,18 +777,67 @@ type MinerInfo struct {
 }
 
 type MServer struct {
-	inkMiner *InkMiner // TODO: Not sure if MServer needs to know about InkMiner
+	inkMiner  *InkMiner  // TODO: Not sure if MServer needs to know about InkMiner
+	syncMutex sync.Mutex // held while syncing the block chain with other miners
+	// held while a block is checked and added to the chain or kept as an orphan, but not while
+	// blocks are sent on, as the miners they are sent to may be sending blocks here at once
+	acceptMutex sync.Mutex
 }
+
+// What identifies a block and its place in the chain, exchanged while syncing
+// to find the blocks missing locally before they are fetched
+type BlockHeader struct {
+	Hash      string
+	PrevHash  string
+	BlockNum  uint32
+	TotalWork *big.Int // cumulative proof-of-work of the branch ending at the block
+}
+
+// Asks for the headers of up to Max blocks, from FromHash back towards the genesis block
+type HeadersRequest struct {
+	FromHash string
+	Max      int
+}
+
+// A block sent to another miner, along with the address of the miner that sent it,
+// which can be asked for the block's ancestors
+type BlockMessage struct {
+	Block      blockchain.Block
+	SenderAddr string
+}
+
+// One MArtNode is created per art node connection, so that the session
+// state below is bound to that connection.
 type MArtNode struct {
 	inkMiner *InkMiner // so artnode can get instance of ink miner
+
+	sessionMutex sync.Mutex
+	nonce        string           // challenge issued by GetNonce, cleared once used
+	pubKey       *ecdsa.PublicKey // public key the session is bound to after OpenCanvas
+
+	requestsMutex sync.Mutex
+	requests      map[string]*ArtNodeRequest // AddShape and DeleteShape requests by request ID
+}
+
+// An AddShape or DeleteShape request that the art node can cancel with CancelRequest
+type ArtNodeRequest struct {
+	sync.Mutex
+	cancel    chan struct{} // closed once the request is cancelled
+	cancelled bool
+	opHash    string // hash of the operation, once it was broadcast
 }
 
 var (
-	errLog            *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
-	outLog            *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
-	connectedMiners               = ConnectedMiners{all: make(map[string]*string)}
-	pendingOperations             = PendingOperations{all: make(map[string]*blockchain.OpRecord)}
-	blockChain                    = blockchain.BlockChain{Blocks: make(map[string]*blockchain.Block)}
+	errLog              *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
+	outLog              *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
+	connectedMiners                 = ConnectedMiners{all: make(map[string]*string)}
+	pendingOperations               = PendingOperations{all: make(map[string]*blockchain.OpRecord)}
+	submittedOperations             = SubmittedOperations{all: make(map[string]bool)}
+	blockChain                      = blockchain.BlockChain{Blocks: make(map[string]*blockchain.Block)}
+	blockEvents                     = NewBlockEventLog("")
+	canvasEngine                    = NewCanvasEngine("", blockartlib.CanvasSettings{})
+	inkLedgers                      = InkLedgers{all: make(map[string]*blockchain.InkLedger)}
+	orphanBlocks                    = OrphanPool{all: make(map[string]*orphanBlock)}
 )
 
 // Start the miner.
@@ -117,14 +846,20 @@ func main() {
 	gob.Register(&elliptic.CurveParams{})
 
 	// Command line input parsing
+	blockLogPath := flag.String("blocks", "", "file the miner keeps its blocks in (default blocks-[pubKey hash].log)")
 	flag.Parse()
 	if len(flag.Args()) != 3 {
-		fmt.Fprintln(os.Stderr, "go run ink-miner.go [server ip:port] [pubKey] [privKey]")
+		fmt.Fprintln(os.Stderr, "go run ink-miner.go [-blocks file] [server ip:port] [pubKey] [privKey]")
 		os.Exit(1)
 	}
 	serverAddr := flag.Arg(0)
 	//pubKey := flag.Arg(1) // do we even need this? follow @367 on piazza
 	privKey := flag.Arg(2)
+	if *blockLogPath == "" {
+		// miners started from the same directory each keep their own blocks
+		pubKeyHash := md5.Sum([]byte(flag.Arg(1)))
+		*blockLogPath = "blocks-" + hex.EncodeToString(pubKeyHash[:4]) + ".log"
+	}
 
 	// Decode keys from strings
 	privKeyBytesRestored, _ := hex.DecodeString(privKey)
@@ -160,25 +895,31 @@ func main() {
 	settings := miner.register()
 	miner.settings = &settings
 
+	mserver := new(MServer)
+	mserver.inkMiner = miner
+
+	// resume from the blocks kept before the miner last stopped, if any, checking each
+	// as if it had been received from another miner
 	blockChain.SetNewestHash(settings.GenesisBlockHash)
+	blockChain.SetPoWDifficulties(settings.PoWDifficultyOpBlock, settings.PoWDifficultyNoOpBlock)
+	blockEvents = NewBlockEventLog(settings.GenesisBlockHash)
+	canvasEngine = NewCanvasEngine(settings.GenesisBlockHash, settings.CanvasSettings)
+	handleFatalError("Could not open block log", blockChain.OpenStore(*blockLogPath, mserver.isValidStoredBlock))
+	outLog.Printf("Loaded %d blocks from %s\n", blockChain.GetSize(), *blockLogPath)
+	blockEvents.tipHash = blockChain.GetNewestHash()
 
 	go miner.startSendingHeartbeatsToServer()
 	go miner.maintainMinerConnections()
+	// catch up on the blocks mined while the miner was stopped, or since the genesis block
+	go func() {
+		miner.getNodesFromServer()
+		mserver.syncChain()
+	}()
 	// TODO - should we attempt to download a blockchain from peers before starting
 	// TODO	  to mine off the genesis block?
-	go miner.startMiningBlocks()
+	go mserver.startMiningBlocks()
 
 	// Start listening for RPC calls from art & miner nodes
-	mserver := new(MServer)
-	mserver.inkMiner = miner
-
-	mArtNode := new(MArtNode)
-	mArtNode.inkMiner = miner
-
-	minerServer := rpc.NewServer()
-	minerServer.Register(mserver)
-	minerServer.Register(mArtNode)
-
 	handleFatalError("Listen error", err)
 	outLog.Printf("MServer started. Receiving on %s\n", fullAddress)
 
@@ -186,10 +927,22 @@ func main() {
 
 	for {
 		conn, _ := inbound.Accept()
-		go minerServer.ServeConn(conn)
+		go serveConn(conn, mserver, miner)
 	}
 }
 
+// Serve RPC calls on a single connection. Each connection gets its own MArtNode
+// so that an art node's session is bound to the connection it was opened on.
+func serveConn(conn net.Conn, mserver *MServer, miner *InkMiner) {
+	mArtNode := new(MArtNode)
+	mArtNode.inkMiner = miner
+
+	minerServer := rpc.NewServer()
+	minerServer.Register(mserver)
+	minerServer.Register(mArtNode)
+	minerServer.ServeConn(conn)
+}
+
 func getMyIP() string {
 	resp, _ := http.Get("http://myexternalip.com/raw")
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
@@ -231,67 +984,54 @@ func (m InkMiner) maintainMinerConnections() {
 
 // Broadcast the new operation
 func (m InkMiner) broadcastNewOperation(op blockchain.OpRecord, opRecordHash string) error {
-	pendingOperations.Lock()
-	if _, exists := pendingOperations.all[opRecordHash]; !exists {
-		// Add operation to pending transaction
-		// TODO : get ink for op
-		pendingOperations.all[opRecordHash] = &blockchain.OpRecord{
-			Op:           op.Op,
-			InkUsed:      op.InkUsed,
-			OpSigS:       op.OpSigS,
-			OpSigR:       op.OpSigR,
-			AuthorPubKey: op.AuthorPubKey,
-		}
-		pendingOperations.Unlock()
-
+	// Add operation to pending transaction
+	if pendingOperations.Add(opRecordHash, op) {
 		// Send operation to all connected miners
 		sendOpToAllConnectedMiners(op)
-		return nil
 	}
-	pendingOperations.Unlock()
-
 	return nil
 }
 
 // This method does not acquire lock; To use this function, acquire lock and then call function
+// The ops of the block stay pending unless it makes it onto the longest chain, as a block on
+// a side branch may never do so.
 func saveBlockToBlockChain(block blockchain.Block) {
 	blockHash := ComputeBlockHash(block)
+	prevTip := blockChain.GetNewestHash()
 
-	blockChain.AddBlockAndUpdateTip(&block, blockHash)
+	handleNonFatalError("Could not persist block", blockChain.AddBlockAndUpdateTip(&block, blockHash))
+	blockEvents.BlockAdded(blockHash)
 
-	removeOperationsFromPendingOperations(block.OpRecords)
+	updatePendingOperationsForTip(prevTip, blockChain.GetNewestHash())
 }
 
-// Get all neighbours' copies of blockchains
-func getBlockChainsFromNeighbours() []*blockchain.BlockChain {
-	outLog.Println("\u25BC Downloading blockchains from peers")
-	var chains []*blockchain.BlockChain
-
-	// TODO - maybe we just need a RLock?
-	connectedMiners.RLock()
-	for minerAddrString := range connectedMiners.all {
-		miner, err := rpc.Dial("tcp", minerAddrString)
-		if err != nil {
-			defer connectedMiners.RemoveMiner(minerAddrString)
-		}
-		handleNonFatalError("Could not dial miner", err)
-
-		var resp blockchain.BlockChain
-		if err == nil {
-			err = miner.Call("MServer.GetBlockChain", true, &resp)
-
-			// TODO - should this be fatal?
-			handleFatalError("Could not call RPC method: MServer.GetBlockChain", err)
+// Once the tip of the longest chain moves from prevTip to newTip, the ops of the blocks that
+// left the longest chain are pending again, and those of the blocks that joined it are not.
+func updatePendingOperationsForTip(prevTip string, newTip string) {
+	leftOps, joinedOps := make(map[string]*blockchain.OpRecord), make(map[string]*blockchain.OpRecord)
 
-			chains = append(chains, &resp)
-			miner.Close()
+	// walk both tips back to their common ancestor
+	for oldHash, newHash := prevTip, newTip; oldHash != newHash; {
+		if blockChain.GetBlockNum(oldHash) >= blockChain.GetBlockNum(newHash) {
+			if !blockChain.DoesBlockExist(oldHash) {
+				break
+			}
+			for opHash, op := range blockChain.GetBlockByHash(oldHash).OpRecords {
+				leftOps[opHash] = op
+			}
+			oldHash = blockChain.GetPrevHash(oldHash)
+		} else {
+			for opHash, op := range blockChain.GetBlockByHash(newHash).OpRecords {
+				joinedOps[opHash] = op
+			}
+			newHash = blockChain.GetPrevHash(newHash)
 		}
 	}
-	connectedMiners.RUnlock()
-
-	return chains
+	pendingOperations.Restore(leftOps)
+	removeOperationsFromPendingOperations(joinedOps)
 }
 
+// Get all neighbours' copies of blockchains
 func (m InkMiner) getNodesFromServer() {
 	var nodes []net.Addr
 	err := m.server.Call("RServer.GetNodes", m.pubKey, &nodes)
@@ -331,53 +1071,37 @@ func (m InkMiner) sendHeartBeat() {
 	handleFatalError("Could not send heartbeat to server", err)
 }
 
-func (m InkMiner) startMiningBlocks() {
+// Mines blocks one after another. Each is validated, added to the local blockchain and
+// broadcast like a block received from another miner, as the tip may move while it is mined.
+func (s *MServer) startMiningBlocks() {
 	for {
-		block := m.computeBlock()
-
-		hash := ComputeBlockHash(*block)
-		blockChain.AddBlockAndUpdateTip(block, hash)
-
-		broadcastNewBlock(*block)
+		s.acceptBlock(*s.inkMiner.computeBlock(), true)
 	}
 }
 
 // Mine a single block that includes a set of operations.
 func (m InkMiner) computeBlock() *blockchain.Block {
-	defer pendingOperations.Unlock()
-
 	var nonce uint32 = FirstNonce
 
 	for {
-		pendingOperations.Lock()
+		prevHash := blockChain.GetNewestHash()
+
+		// the selection is only worked out again once the tip or the pending operations change,
+		// and is never modified, so the block can hold it while pendingOperations changes
+		incorporatedOps := pendingOperations.Selection(&m, prevHash)
 
 		var numZeros uint8
 
-		if len(pendingOperations.all) == 0 {
+		if len(incorporatedOps) == 0 {
 			numZeros = m.settings.PoWDifficultyNoOpBlock
 		} else {
 			numZeros = m.settings.PoWDifficultyOpBlock
 		}
 
-		var nextBlockNum uint32
-
-		if blockChain.GetSize() == 0 {
-			nextBlockNum = FirstBlockNum
-		} else {
-			// TODO - concurrent map read and map write issue here, need to handle mutex
-			nextBlockNum = blockChain.GetNewestBlockNum() + 1
-		}
-
-		// make copy of pending OpRecords to add to newly generated block
-		// instead of using pendingOperations because pendingOperations will be modified later
-		var incorporatedOps = make(map[string]*blockchain.OpRecord)
-		for k, v := range pendingOperations.all {
-			incorporatedOps[k] = v
-		}
-
+		// GetBlockNum is 0 for the genesis block
 		block := &blockchain.Block{
-			BlockNum:    nextBlockNum,
-			PrevHash:    blockChain.GetNewestHash(),
+			BlockNum:    blockChain.GetBlockNum(prevHash) + 1,
+			PrevHash:    prevHash,
 			OpRecords:   incorporatedOps,
 			MinerPubKey: m.pubKey,
 			Nonce:       nonce,
@@ -391,28 +1115,46 @@ func (m InkMiner) computeBlock() *blockchain.Block {
 		}
 
 		nonce = nonce + 1
-
-		pendingOperations.Unlock()
 	}
 }
 
-// Broadcast the newly-mined block to the miner network, and clear the operations that were included in it.
-func broadcastNewBlock(block blockchain.Block) error {
-	removeOperationsFromPendingOperations(block.OpRecords)
+// Returns the pending ops that a block on the chain ending at prevHash can hold: each author's
+// ops in sequence, batches only once all of their ops have arrived, and no invalid deletes.
+// Leaving out an op can leave a gap in its author's Seqs or break up a batch, so the ops are
+// filtered again until nothing more is left out.
+func selectOperations(inkMiner *InkMiner, ops map[string]*blockchain.OpRecord, prevHash string) map[string]*blockchain.OpRecord {
+	ledger := inkLedgers.Get(prevHash, inkMiner.settings)
+	for {
+		selectedOps := dropInvalidDeletes(inkMiner, blockchain.CompleteOpGroups(ledger.SequencedOps(ops)), prevHash)
+		if len(selectedOps) == len(ops) {
+			return selectedOps
+		}
+		ops = selectedOps
+	}
+}
 
-	sendBlockToAllConnectedMiners(block)
-	return nil
+// Returns the ops without the deletes that other miners would reject on the chain ending at prevHash:
+// deletes that do not match a live shape of their author, and all but one delete of each shape.
+// Dropped deletes stay pending, as they can become valid once the rest of a batch arrives.
+func dropInvalidDeletes(inkMiner *InkMiner, ops map[string]*blockchain.OpRecord, prevHash string) map[string]*blockchain.OpRecord {
+	validOps := make(map[string]*blockchain.OpRecord, len(ops))
+	validation := newOpValidation(inkMiner, prevHash)
+	for _, opHash := range blockchain.OpApplyOrder(ops) {
+		op := ops[opHash]
+		if op.IsDelete() && !validation.apply(opHash, *op) {
+			continue
+		}
+		validOps[opHash] = op
+	}
+	return validOps
 }
 
 func removeOperationsFromPendingOperations(opRecords map[string]*blockchain.OpRecord) {
-	pendingOperations.Lock()
-	for opHash := range opRecords {
-		delete(pendingOperations.all, opHash)
-	}
-	pendingOperations.Unlock()
+	pendingOperations.Remove(opRecords)
 }
 
-func sendBlockToAllConnectedMiners(block blockchain.Block) {
+// Sends the block to the connected miners, along with myAddr, which they can ask for the block's ancestors
+func sendBlockToAllConnectedMiners(block blockchain.Block, myAddr string) {
 	connectedMiners.RLock()
 	for minerAddrString := range connectedMiners.all {
 		outLog.Printf("\u25B2 Sending block to miner [%s]\n", minerAddrString)
@@ -422,7 +1164,7 @@ func sendBlockToAllConnectedMiners(block blockchain.Block) {
 		}
 		handleNonFatalError("Could not dial miner", err)
 		if err == nil {
-			err = miner.Call("MServer.DisseminateBlock", block, nil)
+			err = miner.Call("MServer.DisseminateBlock", BlockMessage{Block: block, SenderAddr: myAddr}, nil)
 			handleNonFatalError("Could not call RPC method: MServer.DisseminateBlock", err)
 			miner.Close()
 		}
@@ -457,15 +1199,6 @@ func ComputeBlockHash(block blockchain.Block) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// Compute the MD5 hash of a OpRecord
-func ComputeOpRecordHash(opRecord blockchain.OpRecord) string {
-	opBytes, err := json.Marshal(opRecord)
-	handleFatalError("Could not marshal block to JSON", err)
-	hash := md5.New()
-	hash.Write(opBytes)
-	return hex.EncodeToString(hash.Sum(nil))
-}
-
 // Verify that a hash ends with some number of zeros
 func verifyTrailingZeros(hash string, numZeros uint8) bool {
 	for i := uint8(0); i < numZeros; i++ {
@@ -476,178 +1209,653 @@ func verifyTrailingZeros(hash string, numZeros uint8) bool {
 	return true
 }
 
+// Issue a fresh challenge nonce to the art node. The art node must sign it
+// and send the signature back through OpenCanvas.
+func (a *MArtNode) GetNonce(ignoredreq bool, nonce *string) error {
+	outLog.Printf("Reached GetNonce\n")
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return miscErr("GetNonce: could not generate nonce")
+	}
+
+	a.sessionMutex.Lock()
+	defer a.sessionMutex.Unlock()
+
+	a.nonce = hex.EncodeToString(nonceBytes)
+	*nonce = a.nonce
+	return nil
+}
+
 // Give requesting art node the canvas settings
-// Also check if the art node knows your private key
-func (a *MArtNode) OpenCanvas(privKey ecdsa.PrivateKey, canvasSettings *blockartlib.CanvasSettings) error {
+// Also check that the art node signed the nonce from GetNonce with the private key
+// matching the public key it claims, and bind this session to that public key.
+// Any art node may connect; it draws with its own key and ink.
+func (a *MArtNode) OpenCanvas(req blockartlib.OpenCanvasRequest, resp *blockartlib.OpenCanvasResponse) error {
 	outLog.Printf("Reached OpenCanvas\n")
-	if reflect.DeepEqual(privKey, *a.inkMiner.privKey) {
-		*canvasSettings = a.inkMiner.settings.CanvasSettings
+	a.sessionMutex.Lock()
+	defer a.sessionMutex.Unlock()
+
+	nonce := a.nonce
+	a.nonce = "" // a nonce can only be used once
+	// a key on a curve of the client's choosing could be made to verify for anybody's X and Y
+	if nonce == "" || req.SigR == nil || req.SigS == nil || !blockchain.IsNetworkCurve(req.PubKey.Curve) {
+		resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDPRIVKEY}
+		return nil
+	}
+
+	verifyKey := req.PubKey
+	verifyKey.Curve = blockchain.NetworkCurve
+	if !ecdsa.Verify(&verifyKey, blockchain.NonceDigest(nonce), req.SigR, req.SigS) {
+		resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDPRIVKEY}
 		return nil
 	}
-	return errors.New(blockartlib.ErrorName[blockartlib.INVALIDPRIVKEY])
+
+	pubKey := req.PubKey
+	a.pubKey = &pubKey
+	resp.Settings = a.inkMiner.settings.CanvasSettings
+	return nil
+}
+
+// Returns an error unless OpenCanvas has succeeded on this connection
+func (a *MArtNode) checkSession() error {
+	a.sessionMutex.Lock()
+	defer a.sessionMutex.Unlock()
+
+	if a.pubKey == nil {
+		return errors.New(blockartlib.ErrorName[blockartlib.INVALIDSESSION])
+	}
+	return nil
+}
+
+// Returns an error unless the op record was signed by the public key this session is bound to
+func (a *MArtNode) checkOpAuthor(op blockchain.OpRecord) error {
+	a.sessionMutex.Lock()
+	defer a.sessionMutex.Unlock()
+
+	if a.pubKey == nil || !VerifyOpRecordAuthor(*a.pubKey, op) {
+		return miscErr("operation is not signed by the key this canvas was opened with")
+	}
+	return nil
+}
+
+// Returns the public key this session is bound to
+func (a *MArtNode) sessionPubKey() *ecdsa.PublicKey {
+	a.sessionMutex.Lock()
+	defer a.sessionMutex.Unlock()
+
+	return a.pubKey
 }
 
+// Adds the shape in the op record signed by the art node, charging its ink to the op's author.
+// Blocks until the shape has validateNum blocks following it on the longest chain.
 func (a *MArtNode) AddShape(shapeRequest blockartlib.AddShapeRequest, newShapeResp *blockartlib.NewShapeResponse) error {
 	outLog.Printf("Reached AddShape\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+
+	opRecord := shapeRequest.OpRecord
+	authorPubKey := &opRecord.AuthorPubKey
+	request := a.startRequest(shapeRequest.RequestID)
+	defer a.finishRequest(shapeRequest.RequestID)
+
+	for {
+		opRecordHash, inkRequired, err := request.submit(func() (string, uint32, error) {
+			return a.submitShape(opRecord)
+		})
+		if err != nil {
+			return replyError(err, &newShapeResp.Err)
+		}
+
+		// wait until return from validateNum validation
+		if blockHash, validated := IsValidatedByValidateNum(opRecordHash, shapeRequest.ValidateNum, a.inkMiner.settings.GenesisBlockHash, authorPubKey, request.Done()); validated {
+			newShapeResp.ShapeHash = opRecordHash
+			newShapeResp.BlockHash = blockHash
+			inkRemaining := GetInkTraversal(a.inkMiner, authorPubKey)
+			if inkRemaining < 0 {
+				return miscErr("AddShape: Shouldn't have negative ink after successful implementation of block")
+			}
+			newShapeResp.InkRemaining = uint32(inkRemaining)
+			outLog.Printf("Add Shape was successful: svgPath: %s, shapeHash: %s, blockHash: %s, inkRequired: %d, inkRemaining: %d",
+				opRecord.Shape.SvgString, opRecordHash, blockHash, inkRequired, inkRemaining)
+			return nil
+		}
+		outLog.Printf("Shape was not added to longest chain, trying again...")
+		//return miscErr("AddShape was unsuccessful")
+	}
+}
+
+// Adds the shapes in the op records of one batch signed by the art node, charging their ink to its author.
+// The shapes are mined into the same block or not at all.
+// Blocks until the batch has validateNum blocks following it on the longest chain.
+func (a *MArtNode) AddShapes(shapesRequest blockartlib.AddShapesRequest, resp *blockartlib.AddShapesResponse) error {
+	outLog.Printf("Reached AddShapes\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	if err := checkOpGroup(shapesRequest.OpRecords); err != nil {
+		return err
+	}
+
+	authorPubKey := &shapesRequest.OpRecords[0].AuthorPubKey
+	request := a.startRequest(shapesRequest.RequestID)
+	defer a.finishRequest(shapesRequest.RequestID)
+
+	for {
+		var opRecordHashes []string
+		_, inkRequired, err := request.submit(func() (string, uint32, error) {
+			hashes, inkRequired, err := a.submitShapes(shapesRequest.OpRecords)
+			if err != nil {
+				return "", 0, err
+			}
+			opRecordHashes = hashes
+			return hashes[0], inkRequired, nil
+		})
+		if err != nil {
+			return replyError(err, &resp.Err)
+		}
+
+		// the whole batch is in one block, so waiting on its first op is enough
+		if blockHash, validated := IsValidatedByValidateNum(opRecordHashes[0], shapesRequest.ValidateNum, a.inkMiner.settings.GenesisBlockHash, authorPubKey, request.Done()); validated {
+			inkRemaining := GetInkTraversal(a.inkMiner, authorPubKey)
+			if inkRemaining < 0 {
+				return miscErr("AddShapes: Shouldn't have negative ink after successful implementation of block")
+			}
+			resp.ShapeHashes = opRecordHashes
+			resp.BlockHash = blockHash
+			resp.InkRemaining = uint32(inkRemaining)
+			outLog.Printf("Add Shapes was successful: shapes: %d, blockHash: %s, inkRequired: %d, inkRemaining: %d",
+				len(opRecordHashes), blockHash, inkRequired, inkRemaining)
+			return nil
+		}
+		outLog.Printf("Shapes were not added to longest chain, trying again...")
+	}
+}
+
+// Validates and broadcasts the shape in the op record signed by the art node, without
+// waiting for it to be added to a block. The returned shape hash can be passed to GetOpStatus.
+func (a *MArtNode) SubmitShape(shapeRequest blockartlib.AddShapeRequest, newShapeResp *blockartlib.NewShapeResponse) error {
+	outLog.Printf("Reached SubmitShape\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+
+	opRecordHash, _, err := a.submitShape(shapeRequest.OpRecord)
+	if err != nil {
+		return replyError(err, &newShapeResp.Err)
+	}
+
+	inkRemaining := GetInkTraversal(a.inkMiner, &shapeRequest.OpRecord.AuthorPubKey)
+	if inkRemaining < 0 {
+		inkRemaining = 0
+	}
+	newShapeResp.ShapeHash = opRecordHash
+	newShapeResp.InkRemaining = uint32(inkRemaining)
+	return nil
+}
+
+// Checks the add op record against the canvas and pending operations, then broadcasts it.
+// Returns the op record hash and the ink it uses.
+func (a *MArtNode) submitShape(opRecord blockchain.OpRecord) (string, uint32, error) {
+	if opRecord.GroupID != "" {
+		return "", 0, miscErr("AddShape: operation is part of a batch")
+	}
+	opRecordHashes, inkRequired, err := a.submitShapes([]blockchain.OpRecord{opRecord})
+	if err != nil {
+		return "", 0, err
+	}
+	return opRecordHashes[0], inkRequired, nil
+}
+
+// Checks the add op records as a whole against the canvas and pending operations, then broadcasts them.
+// Returns the op record hashes and the ink they use together.
+func (a *MArtNode) submitShapes(opRecords []blockchain.OpRecord) ([]string, uint32, error) {
+	for _, opRecord := range opRecords {
+		if err := a.checkOpAuthor(opRecord); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := a.checkOpSeqs(opRecords); err != nil {
+		return nil, 0, err
+	}
+	authorPubKey := &opRecords[0].AuthorPubKey
+
+	inkRemaining := GetInkTraversal(a.inkMiner, authorPubKey)
+	if inkRemaining <= 0 {
+		return nil, 0, insufficientInkErr(inkRemaining)
+	}
+
+	var inkRequired uint32
+	for _, opRecord := range opRecords {
+		if opRecord.Type != blockchain.ADD {
+			return nil, 0, miscErr("AddShape: operation does not add a shape")
+		}
+		requestedShape, isTransparent, isClosed := getShapeProperties(opRecord.Shape)
+
+		// check if shape is in bound
+		canvasSettings := a.inkMiner.settings.CanvasSettings
+		if util.CheckShapeOutOfBounds(requestedShape, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
+			return nil, 0, &blockartlib.RPCError{Kind: blockartlib.OUTOFBOUNDS}
+		}
+
+		// check if shape overlaps with shapes from OTHER application
+		if overlappingHash, overlaps := GetOverlappingShapeHash(blockChain.GetNewestHash(), authorPubKey, opRecord.Shape); overlaps {
+			return nil, 0, &blockartlib.RPCError{Kind: blockartlib.SHAPEOVERLAP, Hash: overlappingHash}
+		}
+
+		// if shape is inbound and does not overlap, then calculate the ink required
+		shapeInkRequired := util.CalculateShapeInkRequired(requestedShape, isTransparent, isClosed)
+		if shapeInkRequired != opRecord.InkUsed {
+			return nil, 0, miscErr("AddShape: ink used by the operation does not match the shape")
+		}
+		inkRequired += shapeInkRequired
+	}
+	if inkRequired > uint32(inkRemaining) {
+		return nil, 0, insufficientInkErr(inkRemaining)
+	}
+
+	// validate against pending operations
+	var pendingInkUsed int
+	pendingOperations.RLock()
+	for pendingOpHash, pendingOp := range pendingOperations.all {
+		if reflect.DeepEqual(pendingOp.AuthorPubKey, *authorPubKey) {
+			if pendingOp.IsDelete() {
+				pendingInkUsed -= int(pendingOp.InkUsed)
+			} else {
+				pendingInkUsed += int(pendingOp.InkUsed)
+			}
+		} else if !pendingOp.IsDelete() {
+			for _, opRecord := range opRecords {
+				if shapesOverlap(opRecord.Shape, pendingOp.Shape) {
+					pendingOperations.RUnlock()
+					return nil, 0, &blockartlib.RPCError{Kind: blockartlib.SHAPEOVERLAP, Hash: pendingOpHash}
+				}
+			}
+		}
+	}
+	pendingOperations.RUnlock()
+
+	if pendingInkUsed+int(inkRequired) > inkRemaining {
+		return nil, 0, insufficientInkErr(inkRemaining - pendingInkUsed)
+	}
+
+	opRecordHashes := make([]string, len(opRecords))
+	for i, opRecord := range opRecords {
+		opRecordHashes[i] = blockchain.ComputeOpRecordHash(opRecord)
+		submittedOperations.Add(opRecordHashes[i])
+		a.inkMiner.broadcastNewOperation(opRecord, opRecordHashes[i])
+	}
+	return opRecordHashes, inkRequired, nil
+}
+
+// Returns an error unless the op records form one whole batch: they share a GroupID
+// and their GroupSize is the size of the batch
+func checkOpGroup(opRecords []blockchain.OpRecord) error {
+	if len(opRecords) == 0 {
+		return miscErr("AddShapes: no operations in the batch")
+	}
+	groupID := opRecords[0].GroupID
+	for _, opRecord := range opRecords {
+		if groupID == "" || opRecord.GroupID != groupID || opRecord.GroupSize != uint32(len(opRecords)) {
+			return miscErr("AddShapes: operations do not form one batch")
+		}
+	}
+	return nil
+}
+
+// Returns an error unless the op records, all by one author, carry consecutive Seqs that
+// neither the author's ops on the longest chain nor their other pending operations use,
+// and that leave no gap after the Seqs those use. The same op records can be submitted
+// again, so that an op that fell off the longest chain can be retried.
+func (a *MArtNode) checkOpSeqs(opRecords []blockchain.OpRecord) error {
+	opRecordHashes := make(map[string]bool, len(opRecords))
+	for i, opRecord := range opRecords {
+		if opRecord.Seq != opRecords[0].Seq+uint64(i) {
+			return miscErr("operations are out of sequence")
+		}
+		opRecordHashes[blockchain.ComputeOpRecordHash(opRecord)] = true
+	}
+
+	lastSeq, pendingSeqs := getUsedSeqs(a.inkMiner, opRecords[0].AuthorPubKey, opRecordHashes)
+	if opRecords[0].Seq <= lastSeq {
+		return miscErr("operation is replayed")
+	}
+	for _, opRecord := range opRecords {
+		if pendingSeqs[opRecord.Seq] {
+			return miscErr("operation uses the sequence number of a pending operation")
+		}
+	}
+	if opRecords[0].Seq-lastSeq-1 > uint64(len(pendingSeqs)) {
+		return miscErr("operation is out of sequence")
+	}
+	for seq := lastSeq + 1; seq < opRecords[0].Seq; seq++ {
+		if !pendingSeqs[seq] {
+			return miscErr("operation is out of sequence")
+		}
+	}
+	return nil
+}
+
+// Returns the Seq of the author's last op on the longest chain, and the Seqs after it
+// that are used by the author's pending operations, apart from excludedHashes. Pending
+// operations that can no longer be added are dropped first, which frees their Seqs.
+func getUsedSeqs(inkMiner *InkMiner, authorPubKey ecdsa.PublicKey, excludedHashes map[string]bool) (uint64, map[uint64]bool) {
+	tipHash := blockChain.GetNewestHash()
+	lastSeq := inkLedgers.Get(tipHash, inkMiner.settings).LastSeq(authorPubKey)
+	pendingOperations.Selection(inkMiner, tipHash)
+
+	pendingSeqs := make(map[uint64]bool)
+	pendingOperations.RLock()
+	for pendingOpHash, pendingOp := range pendingOperations.all {
+		if !excludedHashes[pendingOpHash] && pendingOp.Seq > lastSeq && reflect.DeepEqual(pendingOp.AuthorPubKey, authorPubKey) {
+			pendingSeqs[pendingOp.Seq] = true
+		}
+	}
+	pendingOperations.RUnlock()
+	return lastSeq, pendingSeqs
+}
+
+// Returns the Seq the art node's next op must carry: the first one after its last op
+// on the longest chain that none of its pending operations still use
+func (a *MArtNode) GetNextSeq(ignoredreq bool, nextSeq *uint64) error {
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	lastSeq, pendingSeqs := getUsedSeqs(a.inkMiner, *a.sessionPubKey(), nil)
+	for *nextSeq = lastSeq + 1; pendingSeqs[*nextSeq]; *nextSeq++ {
+	}
+	return nil
+}
+
+func (a *MArtNode) GetSvgString(shapeHash string, resp *blockartlib.SvgStringResponse) error {
+	outLog.Printf("Reached GetSvgString\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	if shape, _, exists := GetShapeOnLongestChain(shapeHash); exists {
+		resp.SvgString = shape.OpRecord.Shape.SvgElement()
+		return nil
+	}
+	resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDSHAPEHASH, Hash: shapeHash}
+	return nil
+}
+
+// Returns the op record of a shape on the longest chain, so that the art node
+// can build and sign the matching delete operation. Like GetSvgString, it also finds
+// shapes that were deleted, whose deletes DeleteShape then rejects.
+func (a *MArtNode) GetOpRecord(shapeHash string, resp *blockartlib.OpRecordResponse) error {
+	outLog.Printf("Reached GetOpRecord\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	if shape, _, exists := GetShapeOnLongestChain(shapeHash); exists {
+		resp.OpRecord = *shape.OpRecord
+		return nil
+	}
+	resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDSHAPEHASH, Hash: shapeHash}
+	return nil
+}
+
+// Returns the ink owned by the public key this session is bound to
+func (a *MArtNode) GetInk(ignoredreq bool, inkRemaining *uint32) error {
+	outLog.Printf("Reached GetInk\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	ink := GetInkTraversal(a.inkMiner, a.sessionPubKey())
+	if ink < 0 {
+		fmt.Printf("Get ink got back negative ink %d", *inkRemaining)
+	}
+	*inkRemaining = uint32(ink)
+	return nil
+}
+
+// Deletes a shape using the delete op record signed by the art node, refunding the ink to its author.
+// Blocks until the delete has validateNum blocks following it on the longest chain.
+func (a *MArtNode) DeleteShape(deleteShapeReq blockartlib.DeleteShapeReq, resp *blockartlib.DeleteShapeResponse) error {
+	outLog.Printf("Reached DeleteShape\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+
+	newOpRecord := deleteShapeReq.OpRecord
+	authorPubKey := &newOpRecord.AuthorPubKey
+	request := a.startRequest(deleteShapeReq.RequestID)
+	defer a.finishRequest(deleteShapeReq.RequestID)
 
 	for {
-		inkRemaining := GetInkTraversal(a.inkMiner, a.inkMiner.pubKey)
-		if inkRemaining <= 0 {
-			return errors.New(blockartlib.ErrorName[blockartlib.INSUFFICIENTINK])
+		opRecordHash, inkRefunded, err := request.submit(func() (string, uint32, error) {
+			return a.submitDelete(deleteShapeReq)
+		})
+		if err != nil {
+			return replyError(err, &resp.Err)
 		}
-		requestedSVGPath, _ := util.ConvertPathToPoints(shapeRequest.SvgString)
-		isTransparent := shapeRequest.IsTransparent
-		isClosed := shapeRequest.IsClosed
 
-		// check if shape is in bound
-		canvasSettings := a.inkMiner.settings.CanvasSettings
-		if util.CheckOutOfBounds(requestedSVGPath, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
-			return errors.New(util.ShapeErrorName[util.OUTOFBOUNDS])
-		}
+		// wait until return from validateNum validation
+		if blockHash, validated := IsValidatedByValidateNum(opRecordHash, deleteShapeReq.ValidateNum, a.inkMiner.settings.GenesisBlockHash, authorPubKey, request.Done()); validated {
+			newInkRemaining := GetInkTraversal(a.inkMiner, authorPubKey)
 
-		// check if shape overlaps with shapes from OTHER application
-		currentSVGStringsOnCanvas := GetShapeTraversal(a.inkMiner, a.inkMiner.pubKey)
-		for _, svgPathString := range currentSVGStringsOnCanvas {
-			svgPath, _ := util.ConvertPathToPoints(svgPathString)
-			if util.CheckOverlap(svgPath, requestedSVGPath) != nil {
-				return errors.New(util.ShapeErrorName[util.SHAPEOVERLAP])
+			if newInkRemaining < 0 {
+				return miscErr("DeleteShape: Shouldn't have negative ink after successful implementation of block")
 			}
+			resp.OpHash = opRecordHash
+			resp.InkRemaining = uint32(newInkRemaining)
+			outLog.Printf("Delete Shape was successful: deletedShapeHash: %s, opHash: %s, blockHash: %s, inkRefunded: %d, inkRemaining: %d",
+				newOpRecord.ShapeHash, opRecordHash, blockHash, inkRefunded, newInkRemaining)
+			return nil
 		}
+		outLog.Printf("Delete shape operation was not added to the longest chain, trying again...")
+		//return miscErr("Delete Shape was unsuccessful")
+	}
+}
 
-		// if shape is inbound and does not overlap, then calculate the ink required
-		inkRequired := util.CalculateInkRequired(requestedSVGPath, isTransparent, isClosed)
-		if inkRequired > uint32(inkRemaining) {
-			return errors.New(blockartlib.ErrorName[blockartlib.INSUFFICIENTINK])
-		}
-
-		// validate against pending operations
-		var pendingInkUsed int
-		for _, pendingOp := range pendingOperations.all {
-			if reflect.DeepEqual(pendingOp.AuthorPubKey, *a.inkMiner.pubKey) {
-				if isOpDelete(pendingOp.Op) {
-					pendingInkUsed -= int(pendingOp.InkUsed)
-				} else {
-					pendingInkUsed += int(pendingOp.InkUsed)
-				}
-			} else {
-				svgPathString, _ := parsePath(pendingOp.Op)
-				svgPathCoords, _ := util.ConvertPathToPoints(svgPathString)
-				if util.CheckOverlap(requestedSVGPath, svgPathCoords) != nil {
-					return errors.New(util.ShapeErrorName[util.SHAPEOVERLAP])
-				}
-			}
-		}
+// Validates and broadcasts the delete op record signed by the art node, without waiting
+// for it to be added to a block. Returns the hash of the delete operation, which can be
+// passed to GetOpStatus.
+func (a *MArtNode) SubmitDelete(deleteShapeReq blockartlib.DeleteShapeReq, resp *blockartlib.DeleteShapeResponse) error {
+	outLog.Printf("Reached SubmitDelete\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
 
-		if pendingInkUsed+int(inkRequired) > inkRemaining {
-			return errors.New(blockartlib.ErrorName[blockartlib.INSUFFICIENTINK])
-		}
+	opRecordHash, _, err := a.submitDelete(deleteShapeReq)
+	if err != nil {
+		return replyError(err, &resp.Err)
+	}
+	resp.OpHash = opRecordHash
+	return nil
+}
 
-		// create svg path
-		shapeSvgPathString := util.ConvertToSvgPathString(shapeRequest.SvgString, shapeRequest.Stroke, shapeRequest.Fill)
+// Checks that the delete op record targets a shape owned by its author, then broadcasts it.
+// Returns the op record hash and the ink it refunds.
+func (a *MArtNode) submitDelete(deleteShapeReq blockartlib.DeleteShapeReq) (string, uint32, error) {
+	newOpRecord := deleteShapeReq.OpRecord
+	if err := a.checkOpAuthor(newOpRecord); err != nil {
+		return "", 0, err
+	}
+	if err := a.checkOpSeqs([]blockchain.OpRecord{newOpRecord}); err != nil {
+		return "", 0, err
+	}
+
+	shape, live, _ := GetShapeOnLongestChain(deleteShapeReq.ShapeHash)
+	if !live || !VerifyOpRecordAuthor(newOpRecord.AuthorPubKey, *shape.OpRecord) {
+		return "", 0, &blockartlib.RPCError{Kind: blockartlib.SHAPEOWNER, Hash: deleteShapeReq.ShapeHash}
+	}
 
-		// sign the shape
-		r, s, err := ecdsa.Sign(rand.Reader, a.inkMiner.privKey, []byte(shapeSvgPathString))
-		handleFatalError("unable to sign shape", err)
+	inkRefunded := shape.OpRecord.InkUsed
+	if newOpRecord.Type != blockchain.DELETE || newOpRecord.ShapeHash != deleteShapeReq.ShapeHash || newOpRecord.InkUsed != inkRefunded {
+		return "", 0, miscErr("DeleteShape: operation does not match the shape being deleted")
+	}
 
-		opRecord := blockchain.OpRecord{
-			Op:           shapeSvgPathString,
-			OpSigS:       s,
-			OpSigR:       r,
-			InkUsed:      inkRequired,
-			AuthorPubKey: *a.inkMiner.pubKey,
+	// the shape can only be refunded once, though the same delete can be broadcast again
+	opRecordHash := blockchain.ComputeOpRecordHash(newOpRecord)
+	pendingOperations.RLock()
+	for pendingOpHash, pendingOp := range pendingOperations.all {
+		if pendingOp.IsDelete() && pendingOp.ShapeHash == newOpRecord.ShapeHash && pendingOpHash != opRecordHash {
+			pendingOperations.RUnlock()
+			return "", 0, &blockartlib.RPCError{Kind: blockartlib.SHAPEOWNER, Hash: deleteShapeReq.ShapeHash}
 		}
+	}
+	pendingOperations.RUnlock()
 
-		opRecordHash := ComputeOpRecordHash(opRecord)
-		a.inkMiner.broadcastNewOperation(opRecord, opRecordHash)
+	submittedOperations.Add(opRecordHash)
+	a.inkMiner.broadcastNewOperation(newOpRecord, opRecordHash)
+	return opRecordHash, inkRefunded, nil
+}
 
-		// wait until return from validateNum validation
-		if blockHash, validated := IsValidatedByValidateNum(opRecordHash, shapeRequest.ValidateNum, a.inkMiner.settings.GenesisBlockHash, a.inkMiner.pubKey); validated {
-			newShapeResp.ShapeHash = opRecordHash
-			newShapeResp.BlockHash = blockHash
-			inkRemaining := GetInkTraversal(a.inkMiner, a.inkMiner.pubKey)
-			if inkRemaining < 0 {
-				return miscErr("AddShape: Shouldn't have negative ink after successful implementation of block")
-			}
-			newShapeResp.InkRemaining = uint32(inkRemaining)
-			outLog.Printf("Add Shape was successful: svgPath: %s, shapeHash: %s, blockHash: %s, inkRequired: %d, inkRemaining: %d",
-				shapeSvgPathString, opRecordHash, blockHash, inkRequired, inkRemaining)
-			return nil
-		}
-		outLog.Printf("Shape was not added to longest chain, trying again...")
-		//return miscErr("AddShape was unsuccessful")
+// Returns the status of an operation submitted through this miner, relative to validateNum
+func (a *MArtNode) GetOpStatus(req blockartlib.OpStatusRequest, status *blockartlib.OpStatus) error {
+	if err := a.checkSession(); err != nil {
+		return err
 	}
+	*status = getOpStatus(req.OpHash, req.ValidateNum, a.inkMiner.settings.GenesisBlockHash)
+	return nil
 }
 
-func (a *MArtNode) GetSvgString(shapeHash string, svgString *string) error {
-	outLog.Printf("Reached GetSvgString\n")
-	if opRecord, _, exists := GetOpRecordTraversal(shapeHash, a.inkMiner.settings.GenesisBlockHash); exists {
-		*svgString = opRecord.Op
+// Replies with the shapes on the canvas as of the block tipHash, or as of the
+// tip of the longest chain if tipHash is ""
+func (a *MArtNode) GetCanvasSnapshot(tipHash string, resp *blockartlib.CanvasSnapshotResponse) error {
+	outLog.Printf("Reached GetCanvasSnapshot\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	genesisBlockHash := a.inkMiner.settings.GenesisBlockHash
+	if tipHash == "" {
+		tipHash = blockChain.GetNewestHash()
+	}
+	if tipHash != genesisBlockHash && !blockChain.DoesBlockExist(tipHash) {
+		resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDBLOCKHASH, Hash: tipHash}
 		return nil
 	}
-	return errors.New(blockartlib.ErrorName[blockartlib.INVALIDSHAPEHASH])
+	resp.Snapshot = blockartlib.CanvasSnapshot{TipHash: tipHash, Shapes: GetCanvasTraversal(tipHash)}
+	return nil
 }
 
-func (a *MArtNode) GetInk(ignoredreq bool, inkRemaining *uint32) error {
-	outLog.Printf("Reached GetInk\n")
-	ink := GetInkTraversal(a.inkMiner, a.inkMiner.pubKey)
-	if ink < 0 {
-		fmt.Printf("Get ink got back negative ink %d", *inkRemaining)
+// Replies with the block events from req.FromSeq on, waiting up to BlockEventsLongPoll for one
+func (a *MArtNode) GetBlockEvents(req blockartlib.BlockEventsRequest, resp *blockartlib.BlockEventsResponse) error {
+	if err := a.checkSession(); err != nil {
+		return err
 	}
-	*inkRemaining = uint32(ink)
+	resp.Events, resp.NextSeq = blockEvents.EventsFrom(req.FromSeq, BlockEventsLongPoll)
 	return nil
 }
 
-func concatStrings(strArray []string) string {
-	var buf bytes.Buffer
-	for i := 0; i < len(strArray); i++ {
-		buf.WriteString(strArray[i])
+// Stops the AddShape or DeleteShape request with the given ID from waiting on its operation.
+// If the request has not arrived yet, it is cancelled as soon as it does.
+// Replies with whether the request's operation was already broadcast.
+func (a *MArtNode) CancelRequest(requestID string, resp *blockartlib.CancelRequestResponse) error {
+	outLog.Printf("Reached CancelRequest\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+
+	request := a.startRequest(requestID)
+	if request == nil {
+		return miscErr("CancelRequest: missing request ID")
+	}
+	request.Lock()
+	defer request.Unlock()
+
+	if !request.cancelled {
+		request.cancelled = true
+		close(request.cancel)
 	}
-	return buf.String()
+	resp.OpHash = request.opHash
+	resp.Broadcast = request.opHash != ""
+	return nil
 }
 
-func (a *MArtNode) DeleteShape(deleteShapeReq blockartlib.DeleteShapeReq, inkRemaining *uint32) error {
-	outLog.Printf("Reached DeleteShape\n")
+// Returns the request with the given ID, registering it if it is new.
+// Returns nil for an empty ID, which cannot be cancelled.
+func (a *MArtNode) startRequest(requestID string) *ArtNodeRequest {
+	if requestID == "" {
+		return nil
+	}
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
 
-	for {
-		if opRecord, _, exists := GetOpRecordTraversal(deleteShapeReq.ShapeHash, a.inkMiner.settings.GenesisBlockHash); exists {
-			if VerifyOpRecordAuthor(*a.inkMiner.pubKey, opRecord) {
-				newOp := concatStrings([]string{"delete ", opRecord.Op})
-
-				// sign the shape
-				r, s, err := ecdsa.Sign(rand.Reader, a.inkMiner.privKey, []byte(newOp))
-				handleFatalError("unable to sign shape", err)
-
-				inkRefunded := opRecord.InkUsed
-
-				newOpRecord := blockchain.OpRecord{
-					Op:           newOp,
-					InkUsed:      inkRefunded,
-					OpSigS:       s,
-					OpSigR:       r,
-					AuthorPubKey: *a.inkMiner.pubKey,
-				}
-				opRecordHash := ComputeOpRecordHash(newOpRecord)
-				a.inkMiner.broadcastNewOperation(newOpRecord, opRecordHash)
+	if a.requests == nil {
+		a.requests = make(map[string]*ArtNodeRequest)
+	}
+	request, exists := a.requests[requestID]
+	if !exists {
+		request = &ArtNodeRequest{cancel: make(chan struct{})}
+		a.requests[requestID] = request
+		// forget requests that never finish, e.g. a cancel whose request never arrived
+		time.AfterFunc(RequestRetention, func() { a.removeRequest(requestID, request) })
+	}
+	return request
+}
+
+// Keeps the request around for RequestRetention, so that a CancelRequest that
+// crossed the reply on the wire still learns what happened to the operation.
+func (a *MArtNode) finishRequest(requestID string) {
+	a.requestsMutex.Lock()
+	request, exists := a.requests[requestID]
+	a.requestsMutex.Unlock()
+	if exists {
+		time.AfterFunc(RequestRetention, func() { a.removeRequest(requestID, request) })
+	}
+}
 
-				// wait until return from validateNum validation
-				if blockHash, validated := IsValidatedByValidateNum(opRecordHash, deleteShapeReq.ValidateNum, a.inkMiner.settings.GenesisBlockHash, a.inkMiner.pubKey); validated {
-					newInkRemaining := GetInkTraversal(a.inkMiner, a.inkMiner.pubKey)
+func (a *MArtNode) removeRequest(requestID string, request *ArtNodeRequest) {
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
 
-					if newInkRemaining < 0 {
-						return miscErr("DeleteShape: Shouldn't have negative ink after successful implementation of block")
-					}
-					*inkRemaining = uint32(newInkRemaining)
-					outLog.Printf("Delete Shape was successful: svgPath: %s, shapeHash: %s, blockHash: %s, inkRefunded: %d, inkRemaining: %d",
-						newOp, opRecordHash, blockHash, inkRefunded, newInkRemaining)
-					return nil
-				}
-				outLog.Printf("Delete shape operation was not added to the longest chain, trying again...")
-				continue 
-				//return miscErr("Delete Shape was unsuccessful")
-			}
+	if a.requests[requestID] == request {
+		delete(a.requests, requestID)
+	}
+}
+
+// Returns a channel that is closed once the request is cancelled, or nil if the request cannot be cancelled
+func (r *ArtNodeRequest) Done() <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	return r.cancel
+}
+
+// Runs submit unless the request was cancelled, recording the hash of the operation it broadcast
+func (r *ArtNodeRequest) submit(submit func() (string, uint32, error)) (string, uint32, error) {
+	if r == nil {
+		return submit()
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.cancelled {
+		return "", 0, &blockartlib.RPCError{Kind: blockartlib.CANCELLED}
+	}
+	opRecordHash, ink, err := submit()
+	if err == nil {
+		r.opHash = opRecordHash
+	}
+	return opRecordHash, ink, err
+}
+
+// Pending:   the op is waiting to be mined, or is in a block on a side branch that may still
+//            become the longest chain
+// Included:  the op is on the longest chain with fewer than validateNum blocks following it
+// Confirmed: the op is on the longest chain with at least validateNum blocks following it
+// Orphaned:  the op was submitted here but is neither pending nor in any block
+// Rejected:  this miner does not know about the op
+func getOpStatus(opRecordHash string, validateNum uint8, genesisBlockHash string) blockartlib.OpStatus {
+	if _, blockHash, exists := GetOpRecordTraversal(opRecordHash, genesisBlockHash); exists {
+		confirmations := blockChain.GetNewestBlockNum() - blockChain.GetBlockNum(blockHash)
+		kind := blockartlib.INCLUDED
+		if confirmations >= uint32(validateNum) {
+			kind = blockartlib.CONFIRMED
 		}
-		return errors.New(blockartlib.ErrorName[blockartlib.SHAPEOWNER])
+		return blockartlib.OpStatus{Kind: kind, Confirmations: confirmations, BlockHash: blockHash}
+	}
+
+	if pendingOperations.Contains(opRecordHash) || blockChain.IsOpInAnyBlock(opRecordHash) {
+		return blockartlib.OpStatus{Kind: blockartlib.PENDING}
+	}
+	if submittedOperations.Contains(opRecordHash) {
+		return blockartlib.OpStatus{Kind: blockartlib.ORPHANED}
 	}
+	return blockartlib.OpStatus{Kind: blockartlib.REJECTED}
 }
 
 // 1) Wait until op is taken off pending list => this means op has been incorporated into a block
@@ -656,13 +1864,15 @@ func (a *MArtNode) DeleteShape(deleteShapeReq blockartlib.DeleteShapeReq, inkRem
 // 4) if it doesn't meet validateNum # of blocks following it yet, periodically repeat steps 2-3
 // case 0: if during a check, it does have validateNum # of blocks following it, return the blockHash of the block
 //         the op was incorporated in AND return true
-// case 1: if during a check, the op is no longer found in the longest chain, then it means it was
+// case 1: if during a check, the op is no longer pending nor in any block, then it means it was
 //    	   rejected because either the artnode's miner is malicious or was building off the wrong chain to begin with.
-//    	   In this case, the op is lost and we return false
-func IsValidatedByValidateNum(opRecordHash string, validateNum uint8, genesisBlockHash string, pubKey *ecdsa.PublicKey) (string, bool) {
+//    	   In this case, the op is lost and we return false. An op in a block on a side branch is
+//    	   waited for, as the branch may still become the longest chain.
+// case 2: if cancel is closed before either of the above, return false
+func IsValidatedByValidateNum(opRecordHash string, validateNum uint8, genesisBlockHash string, pubKey *ecdsa.PublicKey, cancel <-chan struct{}) (string, bool) {
 	//TODO: need to lock when periodically checking blockchain?
 	for {
-		if _, exists := pendingOperations.all[opRecordHash]; !exists {
+		if !pendingOperations.Contains(opRecordHash) {
 			for {
 				if opRecord, blockHash, exists := GetOpRecordTraversal(opRecordHash, genesisBlockHash); exists {
 					blockNumOfOp := blockChain.GetBlockNum(blockHash)
@@ -672,23 +1882,30 @@ func IsValidatedByValidateNum(opRecordHash string, validateNum uint8, genesisBlo
 							return blockHash, true
 						}
 					}
-				} else {
+				} else if !pendingOperations.Contains(opRecordHash) && !blockChain.IsOpInAnyBlock(opRecordHash) {
+					return "", false
+				}
+				//TODO: what's an optimal time to check?
+				select {
+				case <-cancel:
 					return "", false
+				case <-time.After(2 * time.Second):
 				}
-				time.Sleep(2 * time.Second) //TODO: what's an optimal time to check?
 			}
 		}
-		time.Sleep(2 * time.Second)
+		select {
+		case <-cancel:
+			return "", false
+		case <-time.After(2 * time.Second):
+		}
 	}
-	return "", false
 }
 
 // Return true if the miner's public key matches author's public key of the OpRecord
 // and also decodes the opSigS and opSigR of the opRecord to verify it was signed by the author
 // listed in the OpRecord
 func VerifyOpRecordAuthor(requestorPublicKey ecdsa.PublicKey, opRecord blockchain.OpRecord) bool {
-	return reflect.DeepEqual(requestorPublicKey, opRecord.AuthorPubKey) &&
-		ecdsa.Verify(&opRecord.AuthorPubKey, []byte(opRecord.Op), opRecord.OpSigR, opRecord.OpSigS)
+	return reflect.DeepEqual(requestorPublicKey, opRecord.AuthorPubKey) && opRecord.HasValidSignature()
 }
 
 // given the shapeHash, return true if it is in the longest chain of the blockchain
@@ -706,125 +1923,115 @@ func GetOpRecordTraversal(shapeHash string, genesisBlockHash string) (blockchain
 	return blockchain.OpRecord{}, "", false
 }
 
-// returns the amount of ink owned by @param pubKey
-func GetInkTraversal(inkMiner *InkMiner, pubKey *ecdsa.PublicKey) int {
-	inkRemaining := 0
-	newestHash := blockChain.GetNewestHash()
-	for blockHash := newestHash; blockHash != inkMiner.settings.GenesisBlockHash; blockHash = blockChain.GetPrevHash(blockHash) {
-		block := blockChain.GetBlockByHash(blockHash)
-		if len(block.OpRecords) == 0 { // NoOp block
-			if reflect.DeepEqual(*block.MinerPubKey, *pubKey) {
-				inkRemaining += int(inkMiner.settings.InkPerNoOpBlock)
-			}
-		} else { // Op Block
-			if reflect.DeepEqual(*block.MinerPubKey, *pubKey) {
-				inkRemaining += int(inkMiner.settings.InkPerOpBlock)
-			}
-			for _, opRecord := range block.OpRecords {
-				if reflect.DeepEqual(opRecord.AuthorPubKey, *pubKey) {
-					// fmt.Println("found op record with author:", opRecord.AuthorPubKey)
-					if isOpDelete(opRecord.Op) {
-						inkRemaining += int(opRecord.InkUsed)
-					} else { // Add block
-						inkRemaining -= int(opRecord.InkUsed)
-					}
-				}
-			}
+// Returns the shape with the given hash on the longest chain, whether it is still on the
+// canvas or was deleted, and true if it is still on the canvas
+func GetShapeOnLongestChain(shapeHash string) (shape CanvasShape, live bool, exists bool) {
+	canvasEngine.View(blockChain.GetNewestHash(), func(state *CanvasState) {
+		if found, isLive := state.Shape(shapeHash); isLive {
+			shape, live, exists = *found, true, true
+		} else if found, wasDeleted := state.AnyShape(shapeHash); wasDeleted {
+			shape, exists = *found, true
 		}
-	}
-	return inkRemaining
+	})
+	return shape, live, exists
 }
 
-// returns all the shapes on the canvas EXCEPT the ones drawn by @param pubKey
-// strings are in the form of "M 0 0 L 50 50"
-func GetShapeTraversal(inkMiner *InkMiner, pubKey *ecdsa.PublicKey) []string {
-	newestHash := blockChain.GetNewestHash()
-	var shapesDrawnByOtherApps []string
-	for blockHash := newestHash; blockHash != inkMiner.settings.GenesisBlockHash; blockHash = blockChain.GetPrevHash(blockHash) {
-		block := blockChain.GetBlockByHash(blockHash)
-		if len(block.OpRecords) != 0 {
-			shapesDrawnByOtherApps = append(shapesDrawnByOtherApps, getShapesFromOpRecords(block.OpRecords, pubKey)...)
-		}
-	}
-
-	return shapesDrawnByOtherApps
+// returns the amount of ink owned by @param pubKey on the longest chain
+func GetInkTraversal(inkMiner *InkMiner, pubKey *ecdsa.PublicKey) int {
+	return inkLedgers.Get(blockChain.GetNewestHash(), inkMiner.settings).Balance(*pubKey)
 }
 
-// returns all the shapes in the opRecords EXCEPT the ones drawn by @param pubKey
-func getShapesFromOpRecords(opRecords map[string]*blockchain.OpRecord, pubKey *ecdsa.PublicKey) []string {
-	var shapesDrawnByOtherApps []string
-	var shapesToDelete []string
-	for _, opRecord := range opRecords {
-		if !reflect.DeepEqual(opRecord.AuthorPubKey, *pubKey) {
-			svgPath, _ := parsePath(opRecord.Op)
-			if isOpDelete(opRecord.Op) {
-				shapesToDelete = append(shapesToDelete, svgPath)
-			} else {
-				shapesDrawnByOtherApps = append(shapesDrawnByOtherApps, svgPath)
-			}
+// Returns the shapes on the canvas as of the block tipHash, in the order they were added.
+// Shapes added in the same block are ordered by hash.
+func GetCanvasTraversal(tipHash string) []blockartlib.ShapeRecord {
+	var shapes []blockartlib.ShapeRecord
+	canvasEngine.View(tipHash, func(state *CanvasState) {
+		for _, shape := range state.Shapes() {
+			shapes = append(shapes, newShapeRecord(shape.Hash, *shape.OpRecord, shape.BlockHash))
 		}
+	})
+	return shapes
+}
+
+func newShapeRecord(opHash string, opRecord blockchain.OpRecord, blockHash string) blockartlib.ShapeRecord {
+	return blockartlib.ShapeRecord{
+		ShapeHash:  opHash,
+		Owner:      opRecord.AuthorPubKey,
+		ShapeType:  blockartlib.ShapeTypeOf(opRecord.Shape),
+		SvgString:  opRecord.Shape.SvgString,
+		Fill:       opRecord.Shape.Fill,
+		Stroke:     opRecord.Shape.Stroke,
+		SvgElement: opRecord.Shape.SvgElement(),
+		InkUsed:    opRecord.InkUsed,
+		BlockHash:  blockHash,
 	}
-
-	// remove shapes that was deleted
-	shapesDrawnByOtherApps = removeShapesDeleted(shapesDrawnByOtherApps, shapesToDelete)
-
-	return shapesDrawnByOtherApps
 }
 
-// Returns all operations in the given blockchain
-// Must supply valid corresponding genesisBlockHash
-func GetAllOperationsFromBlockChain(bc blockchain.BlockChain, genesisBlockHash string) map[string]*blockchain.OpRecord {
-	allOps := make(map[string]*blockchain.OpRecord)
-	for blockHash := bc.GetNewestHash(); blockHash != genesisBlockHash; blockHash = bc.GetPrevHash(blockHash) {
-		// TODO-dc - potential concurrency issue, accesses OpRecords map directly
-		blockOpRecords := bc.GetBlockByHash(blockHash).OpRecords
-		if len(blockOpRecords) != 0 {
-			for opHash, op := range blockOpRecords {
-				allOps[opHash] = op
+// Returns the hash of a shape on the chain ending at @param tipHash, not drawn by @param pubKey,
+// that overlaps with @param shape.
+// Only the shapes whose bounds touch those of the shape are checked.
+func GetOverlappingShapeHash(tipHash string, pubKey *ecdsa.PublicKey, shape blockchain.Shape) (overlappingHash string, overlaps bool) {
+	canvasEngine.View(tipHash, func(state *CanvasState) {
+		for _, opHash := range state.Candidates(shape.SvgString) {
+			opRecord := state.shapes[opHash].OpRecord
+			if reflect.DeepEqual(opRecord.AuthorPubKey, *pubKey) {
+				continue
+			}
+			if shapesOverlap(opRecord.Shape, shape) {
+				overlappingHash, overlaps = opHash, true
+				return
 			}
 		}
-	}
-	return allOps
+	})
+	return overlappingHash, overlaps
 }
 
-func (a *MArtNode) GetShapes(blockHash string, shapeHashes *[]string) error {
+func (a *MArtNode) GetShapes(blockHash string, resp *blockartlib.HashesResponse) error {
 	outLog.Printf("Reached GetShapes\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
 	// TODO: Can each key (blockhash) have more than 1 blocks??
 
 	exists := blockChain.DoesBlockExist(blockHash)
 	if exists {
 		block := blockChain.GetBlockByHash(blockHash)
-		tempShapeHashes := make([]string, len(block.OpRecords))
-		var i = 0
-		for _, v := range block.OpRecords {
-			tempShapeHashes[i] = v.Op
-			i++
+		shapeHashes := make([]string, 0, len(block.OpRecords))
+		for opHash, opRecord := range block.OpRecords {
+			if !opRecord.IsDelete() {
+				shapeHashes = append(shapeHashes, opHash)
+			}
 		}
-		*shapeHashes = tempShapeHashes
+		sort.Strings(shapeHashes)
+		resp.Hashes = shapeHashes
 		return nil
 	}
-	return errors.New(blockartlib.ErrorName[blockartlib.INVALIDBLOCKHASH])
+	resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDBLOCKHASH, Hash: blockHash}
+	return nil
 }
 
 func (a *MArtNode) GetGenesisBlock(ignoredreq bool, blockHash *string) error {
 	outLog.Printf("Reached GetGenesisBlock\n")
+	if err := a.checkSession(); err != nil {
+		return err
+	}
 	*blockHash = a.inkMiner.settings.GenesisBlockHash
 	return nil
 }
 
-func (a *MArtNode) GetChildren(blockHash string, blockHashes *[]string) error {
+func (a *MArtNode) GetChildren(blockHash string, resp *blockartlib.HashesResponse) error {
 	outLog.Printf("Reached GetChildren\n")
-	*blockHashes = make([]string, 0)
+	if err := a.checkSession(); err != nil {
+		return err
+	}
+	resp.Hashes = make([]string, 0)
 	genesisBlockHash := a.inkMiner.settings.GenesisBlockHash
 	exists := blockChain.DoesBlockExist(blockHash)
 	if !strings.EqualFold(genesisBlockHash, blockHash) && !exists {
-		return errors.New(blockartlib.ErrorName[blockartlib.INVALIDBLOCKHASH])
-	}
-	for hash, block := range blockChain.Blocks { // TODO-dc: potential concurrent map read problem here
-		if strings.EqualFold(block.PrevHash, blockHash) {
-			*blockHashes = append(*blockHashes, hash)
-		}
+		resp.Err = &blockartlib.RPCError{Kind: blockartlib.INVALIDBLOCKHASH, Hash: blockHash}
+		return nil
 	}
+	resp.Hashes = blockChain.GetChildren(blockHash)
 	return nil
 }
 
@@ -840,30 +2047,32 @@ func handleFatalError(msg string, e error) {
 	}
 }
 
-// removes all strings in shapesToDelete from allShapes
-func removeShapesDeleted(allShapes []string, shapesToDelete []string) []string {
-	for i, svgShape := range allShapes {
-		for _, shapesToDelete := range shapesToDelete {
-			if svgShape == shapesToDelete {
-				allShapes = append(allShapes[:i], allShapes[i+1:]...)
-			}
-		}
-	}
-	return allShapes
+// returns the shape string of a shape, whether it is transparent and whether it is a closed shape
+func getShapeProperties(shape blockchain.Shape) (string, bool, bool) {
+	return shape.SvgString, !shape.IsFilled(), util.IsClosedShape(shape.SvgString)
+}
+
+// returns true if two shapes overlap, a filled shape covering its inside as well as its outline
+func shapesOverlap(shapeOne blockchain.Shape, shapeTwo blockchain.Shape) bool {
+	return util.CheckFilledShapeOverlap(shapeOne.SvgString, shapeOne.IsFilled(), shapeTwo.SvgString, shapeTwo.IsFilled()) != nil
 }
 
-// returns the d and fill attributes from a full svg path
-func parsePath(shapeSVGString string) (string, string) {
-	buf := strings.Split(shapeSVGString, "d=\"")
-	bufTwo := strings.Split(buf[1], "\" s")
-	bufThree := strings.Split(bufTwo[1], "fill=\"")
-	bufFour := strings.Split(bufThree[1], "\"")
-	return bufTwo[0], bufFour[0]
+// Returns an INSUFFICIENTINK error reporting the ink that is left, if any
+func insufficientInkErr(inkRemaining int) error {
+	if inkRemaining < 0 {
+		inkRemaining = 0
+	}
+	return &blockartlib.RPCError{Kind: blockartlib.INSUFFICIENTINK, InkRemaining: uint32(inkRemaining)}
 }
 
-func isOpDelete(shapeSvgString string) bool {
-	buf := strings.Split(shapeSvgString, " ")
-	return strings.EqualFold(buf[0], "delete")
+// Moves a blockartlib.RPCError into the reply, where net/rpc keeps its data.
+// Other errors are returned as is.
+func replyError(err error, replyErr **blockartlib.RPCError) error {
+	if rpcErr, ok := err.(*blockartlib.RPCError); ok {
+		*replyErr = rpcErr
+		return nil
+	}
+	return err
 }
 
 func miscErr(msg string) error {
@@ -875,77 +2084,121 @@ func miscErr(msg string) error {
 }
 
 // RPC Target
-// Disseminate Block to connected miners, if it passes validation.
-// TODO - I think we can delete these steps or at least move them to isValidBlock()
-// If block number is greater than the local blockchain's latest block number by 1:
-// 1) Validate this block
-//		a) Verify all operations within the block are valid
-//		b) Verify that it used a valid prevHash
-//		c) Verify that the blockhash contains a valid number of zeroes at the end
-// 2) Add this block to the blockchain and start build off this newest block
-//
-// If block number is greater than the local blockchain's latest block number by more than 1:
-// 1) Fetch all block numbers between local blockchain's latest block and this block number
-// 		a) Verify all operations within the block are valid
-//		b) Verify that it used a valid prevHash
-//		c) Verify that the blockhash contains a valid number of zeroes at the end
-// 2) Validate this block
-//		a) Verify all operations within the block are valid
-//		b) Verify that it used a valid prevHash
-//		c) Verify that the blockhash contains a valid number of zeroes at the end
-// 3) Add all fetched blocks and this block to the blockchain and build off this newest block
-//
-// When to disseminate:
-// 1) If the block is valid AND
-// 2) If blockHash does not exist in local blockchain AND
-// 3) If block number is greater than local blockchain's latest block number
-// Otherwise, do not disseminate
-func (s *MServer) DisseminateBlock(block blockchain.Block, _ignore *bool) error {
-
-	if s.isValidBlock(block) {
-		switchToLongestBranch()
-		saveBlockToBlockChain(block)
-		sendBlockToAllConnectedMiners(block)
+// Receives a block from another miner. A block whose parent is known is validated, added
+// to the local blockchain and disseminated to the connected miners, followed by the orphans
+// waiting on it. A block whose parent is unknown waits in orphanBlocks instead, while its
+// missing ancestors are requested from its sender. As its ops cannot be checked yet, an
+// orphan must at least carry a valid proof-of-work and a BlockNum its ancestors can reach.
+func (s *MServer) DisseminateBlock(msg BlockMessage, _ignore *bool) error {
+	block := msg.Block
+	restoreOpRecords(&block)
+
+	// the parent is looked for and the orphan kept in one go, so that the parent cannot be
+	// added in between, which would leave the orphan waiting for it for good
+	s.acceptMutex.Lock()
+	if s.isKnownBlock(block.PrevHash) {
+		s.acceptMutex.Unlock()
+		s.acceptBlock(block, true)
+		return nil
+	}
+	kept := s.keepOrphan(block)
+	s.acceptMutex.Unlock()
+
+	// an orphan whose parent is an orphan too waits for the ancestors of that one
+	if kept && !orphanBlocks.Contains(block.PrevHash) {
+		go s.requestAncestors(msg.SenderAddr, block)
 	}
 	return nil
 }
 
-// RPC Target
-func (s *MServer) DisseminateOperation(op blockchain.OpRecord, _ignore *bool) error {
-	pendingOperations.Lock()
+// Keeps a block whose parent is unknown in orphanBlocks, if it carries a valid proof-of-work
+// and a BlockNum its ancestors can reach. Returns true if it was kept. Must hold acceptMutex
+func (s *MServer) keepOrphan(block blockchain.Block) bool {
+	hash := ComputeBlockHash(block)
+	if blockChain.DoesBlockExist(hash) {
+		return false
+	}
+	if !s.hasValidPoW(hash, block) {
+		errLog.Printf("Block received [\u2717] orphan with invalid proof-of-work: %s\n", hash)
+		return false
+	}
+	// the parent of block 1 is the genesis block, which is always known
+	maxBlockNum := blockChain.GetBlockNum(blockChain.GetNewestHash()) + SyncMaxHeaders
+	if block.BlockNum < 2 || block.BlockNum > maxBlockNum {
+		errLog.Printf("Block received [\u2717] orphan with invalid BlockNum [%d]\n", block.BlockNum)
+		return false
+	}
+	if !orphanBlocks.Add(hash, block) {
+		return false
+	}
+	outLog.Printf("Block received [?] orphan %s, parent %s unknown\n", hash, block.PrevHash)
+	return true
+}
+
+// Validates a block whose parent is known and adds it to the local blockchain, then
+// does the same for the orphans waiting on it, which are disseminated to the connected
+// miners, as is the block itself if disseminate is set. Returns the number of blocks added.
+func (s *MServer) acceptBlock(block blockchain.Block, disseminate bool) int {
+	s.acceptMutex.Lock()
+	addedBlocks := s.addBlockAndOrphans(block)
+	s.acceptMutex.Unlock()
 
-	opRecordHash := ComputeOpRecordHash(op)
-	if _, exists := pendingOperations.all[opRecordHash]; !exists {
-		// Add operation to pending transaction
-		// TODO : get ink for op
-		pendingOperations.all[opRecordHash] = &blockchain.OpRecord{
-			Op:           op.Op,
-			InkUsed:      op.InkUsed,
-			OpSigS:       op.OpSigS,
-			OpSigR:       op.OpSigR,
-			AuthorPubKey: op.AuthorPubKey,
+	for i, added := range addedBlocks {
+		if i > 0 || disseminate {
+			sendBlockToAllConnectedMiners(added, s.inkMiner.addr)
 		}
-		pendingOperations.Unlock()
+	}
+	return len(addedBlocks)
+}
 
-		// Send operation to all connected miners
-		sendOpToAllConnectedMiners(op)
+// Validates a block whose parent is known and adds it to the local blockchain, then does
+// the same for the orphans waiting on it. Returns the blocks added, in the order they were
+// added. Must hold acceptMutex
+func (s *MServer) addBlockAndOrphans(block blockchain.Block) []blockchain.Block {
+	if !s.checkBlock(block) {
 		return nil
 	}
-	pendingOperations.Unlock()
+	saveBlockToBlockChain(block)
 
-	return nil
+	addedBlocks := []blockchain.Block{block}
+	for _, child := range orphanBlocks.TakeChildren(ComputeBlockHash(block)) {
+		addedBlocks = append(addedBlocks, s.addBlockAndOrphans(child)...)
+	}
+	return addedBlocks
 }
 
 // RPC Target
-// Return entire block chain
-func (s *MServer) GetBlockChain(_ignore bool, bc *blockchain.BlockChain) error {
-	outLog.Println("\u25B2 Uploading blockchain to peer.")
-	*bc = blockChain
+func (s *MServer) DisseminateOperation(op blockchain.OpRecord, _ignore *bool) error {
+	// a replayed op can never be added again, and a forged or malformed one would get the
+	// blocks holding it rejected, so neither is kept or passed on
+	if op.Seq <= inkLedgers.Get(blockChain.GetNewestHash(), s.inkMiner.settings).LastSeq(op.AuthorPubKey) {
+		return nil
+	}
+	if !isWellFormedOperation(s.inkMiner, op) {
+		errLog.Printf("Operation received [\u2717] forged or malformed: %s\n", blockchain.ComputeOpRecordHash(op))
+		return nil
+	}
+
+	// Add operation to pending transaction
+	if pendingOperations.Add(blockchain.ComputeOpRecordHash(op), op) {
+		// Send operation to all connected miners
+		sendOpToAllConnectedMiners(op)
+	}
 	return nil
 }
 
-// Checks if a block is valid, including its operations.
-func (s *MServer) isValidBlock(block blockchain.Block) bool {
+// Checks a block loaded from the block log, which must still be stored under its own hash
+// and be valid on the blocks loaded before it
+func (s *MServer) isValidStoredBlock(hash string, block *blockchain.Block) bool {
+	if ComputeBlockHash(*block) != hash {
+		errLog.Printf("Stored block [\u2717] does not match its hash %s\n", hash)
+		return false
+	}
+	return s.checkBlock(*block)
+}
+
+// Checks if a block is valid, including its operations. Its parent must be known.
+func (s *MServer) checkBlock(block blockchain.Block) bool {
 
 	hash := ComputeBlockHash(block)
 
@@ -957,41 +2210,31 @@ func (s *MServer) isValidBlock(block blockchain.Block) bool {
 	}
 
 	// 1. Check for valid block num
-	prevBlockExistsLocally := blockChain.DoesBlockExist(block.PrevHash)
-	if !prevBlockExistsLocally {
-		s.updateBlockChain()
-	}
-
-	prevBlockExistsLocally = blockChain.DoesBlockExist(block.PrevHash)
-	if !prevBlockExistsLocally {
+	if !s.isKnownBlock(block.PrevHash) {
 		errLog.Printf("Block received [\u2717] no previous block found\n")
 		return false
 	}
 
-	prevBlock := blockChain.GetBlockByHash(block.PrevHash)
-	isNextBlock := block.BlockNum == prevBlock.BlockNum+1
+	// GetBlockNum is 0 for the genesis block
+	isNextBlock := block.BlockNum == blockChain.GetBlockNum(block.PrevHash)+1
 	if !isNextBlock {
 		errLog.Printf("Block received [\u2717] invalid BlockNum [%d]\n", block.BlockNum)
 		return false
 	}
 
 	// 2. Check hash for valid proof-of-work
-	var proofDifficulty uint8
-	if len(block.OpRecords) == 0 {
-		proofDifficulty = s.inkMiner.settings.PoWDifficultyNoOpBlock
-	} else {
-		proofDifficulty = s.inkMiner.settings.PoWDifficultyOpBlock
-	}
-
-	hasValidPoW := verifyTrailingZeros(hash, proofDifficulty)
-	if !hasValidPoW {
+	if !s.hasValidPoW(hash, block) {
 		errLog.Printf("Block received [\u2717] invalid proof-of-work\n")
 		return false
 	}
 
 	// 3. Check operations for validity
-	if !hasValidOperations(s.inkMiner, block.OpRecords) {
-		errLog.Printf("Invalid block received: invalid operations\n")
+	if len(blockchain.CompleteOpGroups(block.OpRecords)) != len(block.OpRecords) {
+		errLog.Printf("Invalid block received: incomplete batch of operations: %s\n", hash)
+		return false
+	}
+	if !hasValidOperations(s.inkMiner, block.OpRecords, block.PrevHash) {
+		errLog.Printf("Invalid block received: invalid operations: %s\n", hash)
 		return false
 	}
 
@@ -999,172 +2242,371 @@ func (s *MServer) isValidBlock(block blockchain.Block) bool {
 	return true
 }
 
-func switchToLongestBranch() string {
-	maxBlockNum := uint32(0)
-	var newestHash string
-
-	for hash, block := range blockChain.Blocks { // TODO-dc: potential concurrent map read problem here
-		if block.BlockNum > maxBlockNum {
-			maxBlockNum = block.BlockNum
-			newestHash = hash
+// Checks that the hash of a block has the trailing zeros its kind of block needs
+func (s *MServer) hasValidPoW(hash string, block blockchain.Block) bool {
+	proofDifficulty := s.inkMiner.settings.PoWDifficultyOpBlock
+	if len(block.OpRecords) == 0 {
+		proofDifficulty = s.inkMiner.settings.PoWDifficultyNoOpBlock
+	}
+	return verifyTrailingZeros(hash, proofDifficulty)
+}
+
+// Checks that the ops of a block are stored under their own hashes, signed by their authors
+// and valid when applied in blockchain.OpApplyOrder to the chain ending at prevHash, each op
+// being checked against the ops before it as well: shapes of different authors in the block must not overlap,
+// the adds of one author must not use more ink than they have together, and no two
+// deletes can refund the same shape. The ops of each author must also carry the Seqs
+// that follow on from the author's last Seq, so that no op is replayed or skipped.
+func hasValidOperations(inkMiner *InkMiner, ops map[string]*blockchain.OpRecord, prevHash string) bool {
+	validation := newOpValidation(inkMiner, prevHash)
+	if sequencedOps := validation.ledger.SequencedOps(ops); len(sequencedOps) != len(ops) {
+		for opHash := range ops {
+			if sequencedOps[opHash] == nil {
+				errLog.Printf("Operation [\u2717] replayed or out of sequence: %s on top of block %s\n", opHash, prevHash)
+			}
+		}
+		return false
+	}
+	for _, opHash := range blockchain.OpApplyOrder(ops) {
+		op := ops[opHash]
+		if opHash != blockchain.ComputeOpRecordHash(*op) {
+			errLog.Printf("Operation [\u2717] not stored under its own hash: %s on top of block %s\n", opHash, prevHash)
+			return false
+		}
+		if !op.HasValidSignature() {
+			errLog.Printf("Operation [\u2717] not signed by its author: %s on top of block %s\n", opHash, prevHash)
+			return false
+		}
+		if !validation.apply(opHash, *op) {
+			return false
 		}
 	}
+	return true
+}
 
-	blockChain.SetNewestHash(newestHash)
-	return newestHash
+// check if the given operation is valid on the chain ending at prevHash
+func isValidOperation(inkMiner *InkMiner, op blockchain.OpRecord, prevHash string) bool {
+	return newOpValidation(inkMiner, prevHash).apply(blockchain.ComputeOpRecordHash(op), op)
 }
 
-// Checks if ALL operations as a set can be executed.
-// Must check for ink level and shape overlap.
-func hasValidOperations(inkMiner *InkMiner, ops map[string]*blockchain.OpRecord) bool {
-	for _, op := range ops {
-		if !isValidOperation(inkMiner, *op) {
+// Returns true if the op is signed by its author and valid on its own, whatever chain it
+// ends up on: an add draws a shape within the canvas using the ink the shape needs, and
+// a delete names the shape it deletes
+func isWellFormedOperation(inkMiner *InkMiner, op blockchain.OpRecord) bool {
+	if !op.HasValidSignature() {
+		return false
+	}
+	switch op.Type {
+	case blockchain.ADD:
+		requestedShape, isTransparent, isClosed := getShapeProperties(op.Shape)
+		canvasSettings := inkMiner.settings.CanvasSettings
+		if util.CheckShapeOutOfBounds(requestedShape, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
 			return false
 		}
+		return op.InkUsed == util.CalculateShapeInkRequired(requestedShape, isTransparent, isClosed)
+	case blockchain.DELETE:
+		return op.ShapeHash != ""
+	}
+	return false
+}
+
+// The state the ops of a block are validated against: the chain ending at the block's
+// parent, plus the changes of the block's ops validated so far
+type opValidation struct {
+	inkMiner *InkMiner
+	prevHash string
+	ledger   *blockchain.InkLedger
+	inkUsed  map[string]int                  // ink used by the ops so far, by PubKeyID of their author
+	added    map[string]*blockchain.OpRecord // shapes added by the ops so far, by hash
+	deleted  map[string]bool                 // hashes of the shapes deleted by the ops so far
+}
+
+func newOpValidation(inkMiner *InkMiner, prevHash string) *opValidation {
+	return &opValidation{
+		inkMiner: inkMiner,
+		prevHash: prevHash,
+		ledger:   inkLedgers.Get(prevHash, inkMiner.settings),
+		inkUsed:  make(map[string]int),
+		added:    make(map[string]*blockchain.OpRecord),
+		deleted:  make(map[string]bool),
+	}
+}
+
+// Returns true if the op is valid after the ops applied so far, and applies it if so
+func (v *opValidation) apply(opHash string, op blockchain.OpRecord) bool {
+	authorID := blockchain.PubKeyID(op.AuthorPubKey)
+	switch {
+	case op.Type == blockchain.ADD && v.isValidAdd(opHash, op):
+		v.inkUsed[authorID] += int(op.InkUsed)
+		v.added[opHash] = &op
+	case op.Type == blockchain.DELETE && v.isValidDelete(opHash, op):
+		v.inkUsed[authorID] -= int(op.InkUsed)
+		v.deleted[op.ShapeHash] = true
+	default:
+		return false
 	}
 	return true
 }
 
-// check if the given operation is valid
+// check if the given add operation is valid
 // checks for ink and shape overlap
-func isValidOperation(inkMiner *InkMiner, op blockchain.OpRecord) bool {
-	inkRemaining := GetInkTraversal(inkMiner, &op.AuthorPubKey)
+func (v *opValidation) isValidAdd(opHash string, op blockchain.OpRecord) bool {
+	inkRemaining := v.ledger.Balance(op.AuthorPubKey) - v.inkUsed[blockchain.PubKeyID(op.AuthorPubKey)]
 	if inkRemaining <= 0 {
+		errLog.Printf("Operation [\u2717] author has no ink: %s on top of block %s\n", opHash, v.prevHash)
 		return false
 	}
-	svgPathString, transparency := parsePath(op.Op)
-	requestedSVGPath, _ := util.ConvertPathToPoints(svgPathString)
-	isTransparent := false
-	isClosed := false
-
-	if transparency == "transparent" {
-		isTransparent = true
-	}
-
-	lastSVGChar := string(svgPathString[len(svgPathString)-1])
-
-	if lastSVGChar == "Z" || lastSVGChar == "z" {
-		isClosed = true
-	}
+	requestedShape, isTransparent, isClosed := getShapeProperties(op.Shape)
 
 	// check if shape is in bound
-	canvasSettings := inkMiner.settings.CanvasSettings
-	if util.CheckOutOfBounds(requestedSVGPath, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
-		fmt.Println("shape out of bounds")
+	canvasSettings := v.inkMiner.settings.CanvasSettings
+	if util.CheckShapeOutOfBounds(requestedShape, canvasSettings.CanvasXMax, canvasSettings.CanvasYMax) != nil {
+		errLog.Printf("Operation [\u2717] shape out of bounds: %s on top of block %s\n", opHash, v.prevHash)
 		return false
 	}
 
-	// check if shape overlaps with shapes from OTHER application
-	currentSVGStringsOnCanvas := GetShapeTraversal(inkMiner, &op.AuthorPubKey)
-	for _, svgPathString := range currentSVGStringsOnCanvas {
-		svgPath, _ := util.ConvertPathToPoints(svgPathString)
-		if util.CheckOverlap(svgPath, requestedSVGPath) != nil {
-			fmt.Println("shape overlaps")
+	// check if shape overlaps with shapes from OTHER application, on the chain or earlier in the block
+	if overlappingHash, overlaps := GetOverlappingShapeHash(v.prevHash, &op.AuthorPubKey, op.Shape); overlaps {
+		errLog.Printf("Operation [\u2717] overlaps %s: %s on top of block %s\n", overlappingHash, opHash, v.prevHash)
+		return false
+	}
+	for addedHash, added := range v.added {
+		if !v.deleted[addedHash] && !reflect.DeepEqual(added.AuthorPubKey, op.AuthorPubKey) && shapesOverlap(added.Shape, op.Shape) {
+			errLog.Printf("Operation [\u2717] overlaps %s in the same block: %s on top of block %s\n", addedHash, opHash, v.prevHash)
 			return false
 		}
 	}
 
-	// if shape is inbound and does not overlap, then calculate the ink required
-	inkRequired := util.CalculateInkRequired(requestedSVGPath, isTransparent, isClosed)
+	// if shape is inbound and does not overlap, then check the ink it uses
+	inkRequired := util.CalculateShapeInkRequired(requestedShape, isTransparent, isClosed)
+	if op.InkUsed != inkRequired {
+		errLog.Printf("Operation [\u2717] ink used does not match the shape: %s on top of block %s\n", opHash, v.prevHash)
+		return false
+	}
 	if inkRequired > uint32(inkRemaining) {
-		fmt.Println("not enough ink")
+		errLog.Printf("Operation [\u2717] not enough ink: %s on top of block %s\n", opHash, v.prevHash)
 		return false
 	}
 
 	return true
 }
 
-// Update local block chain and pending operations if majority block chain
-// is different from current local block chain
-func (s *MServer) updateBlockChain() {
-	majorityBlockChain := getMajorityBlockChainFromNeighbours()
-	majorityBlockChainHash := computeBlockChainHash(majorityBlockChain)
+// check if the given delete operation is valid: its target must be a live shape drawn by
+// its author, on the chain or added earlier in the block, and it must refund exactly the
+// ink that shape used
+func (v *opValidation) isValidDelete(opHash string, op blockchain.OpRecord) bool {
+	if v.deleted[op.ShapeHash] {
+		errLog.Printf("Operation [\u2717] deletes %s, which is already deleted in the same block: %s on top of block %s\n", op.ShapeHash, opHash, v.prevHash)
+		return false
+	}
 
-	if majorityBlockChainHash != computeBlockChainHash(blockChain) {
-		outLog.Println("Updating blockchain")
-		blockChain = majorityBlockChain
-		switchToLongestBranch()
-		s.updatePendingOperations()
+	target, isLive := v.added[op.ShapeHash]
+	if !isLive {
+		canvasEngine.View(v.prevHash, func(state *CanvasState) {
+			if shape, exists := state.Shape(op.ShapeHash); exists {
+				target, isLive = shape.OpRecord, true
+			}
+		})
+	}
+	if !isLive || !reflect.DeepEqual(target.AuthorPubKey, op.AuthorPubKey) || target.InkUsed != op.InkUsed {
+		errLog.Printf("Operation [\u2717] deletes %s, which is not a live shape of its author using that ink: %s on top of block %s\n", op.ShapeHash, opHash, v.prevHash)
+		return false
 	}
+	return true
 }
 
-// Downloads the entire BlockChain from all connected miners and updates the local
-// version with the majority copy (including itself).
-// If tie, pick the one with highest block num.
-// If multiple contain highest block num, pick one at random.
-// Returns the majority block chain
-func getMajorityBlockChainFromNeighbours() blockchain.BlockChain {
-	blockChains := getBlockChainsFromNeighbours()
+// Returns true if the block is the genesis block or is in the local block chain
+func (s *MServer) isKnownBlock(blockHash string) bool {
+	return blockHash == s.inkMiner.settings.GenesisBlockHash || blockChain.DoesBlockExist(blockHash)
+}
 
-	// Add own block chain
-	blockChains = append(blockChains, &blockChain)
+// Brings the local block chain up to the tips of the connected miners. The pending
+// operations follow the tip as each block is added.
+func (s *MServer) syncChain() {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
 
-	hashesToChains := make(map[string]blockchain.BlockChain)
-	hashCounts := make(map[string]int)
+	connectedMiners.RLock()
+	minerAddrs := make([]string, 0, len(connectedMiners.all))
+	for minerAddrString := range connectedMiners.all {
+		minerAddrs = append(minerAddrs, minerAddrString)
+	}
+	connectedMiners.RUnlock()
 
-	maxCount := 0
-	for _, blockChain := range blockChains {
-		hash := computeBlockChainHash(*blockChain)
-		hashesToChains[hash] = *blockChain
-		hashCounts[hash] = hashCounts[hash] + 1
+	blocksAdded := 0
+	for _, minerAddrString := range minerAddrs {
+		added, err := s.syncFromMiner(minerAddrString)
+		handleNonFatalError("Could not sync with miner ["+minerAddrString+"]", err)
+		blocksAdded += added
+	}
+	if blocksAdded > 0 {
+		outLog.Printf("\u25BC Synced %d blocks from peers\n", blocksAdded)
+	}
+}
 
-		if hashCounts[hash] > maxCount {
-			maxCount = hashCounts[hash]
-		}
+// Syncs the local block chain with the miner at minerAddrString: if its tip is unknown
+// and has more proof-of-work behind it than the local one, the blocks missing locally are fetched from it.
+// Returns the number of blocks added.
+func (s *MServer) syncFromMiner(minerAddrString string) (int, error) {
+	miner, err := rpc.Dial("tcp", minerAddrString)
+	if err != nil {
+		connectedMiners.RemoveMiner(minerAddrString)
+		return 0, err
 	}
+	defer miner.Close()
 
-	// Remove hashes lower than maxCount
-	for hash, count := range hashCounts {
-		if count < maxCount {
-			delete(hashCounts, hash)
+	var tip BlockHeader
+	if err := miner.Call("MServer.GetTip", true, &tip); err != nil {
+		return 0, err
+	}
+	if s.isKnownBlock(tip.Hash) || tip.TotalWork == nil || tip.TotalWork.Cmp(blockChain.GetTotalWork(blockChain.GetNewestHash())) <= 0 {
+		return 0, nil
+	}
+	return s.fetchMissingBlocks(miner, tip.Hash, tip.BlockNum)
+}
+
+// Fetches the missing ancestors of an orphan from the miner that sent it, which connects
+// the orphan once they are added. Falls back on syncing with the connected miners if the
+// sender cannot provide them.
+func (s *MServer) requestAncestors(senderAddr string, orphan blockchain.Block) {
+	s.syncMutex.Lock()
+	err := fmt.Errorf("orphan block %d has no ancestors to request", orphan.BlockNum)
+	if orphan.BlockNum > 0 {
+		var miner *rpc.Client
+		if miner, err = rpc.Dial("tcp", senderAddr); err == nil {
+			_, err = s.fetchMissingBlocks(miner, orphan.PrevHash, orphan.BlockNum-1)
+			miner.Close()
 		}
 	}
+	s.syncMutex.Unlock()
 
-	currLargestBlockNum := uint32(0)
-	currLongestBlockChain := blockChain
+	if err != nil {
+		handleNonFatalError("Could not fetch the ancestors of an orphan block from ["+senderAddr+"]", err)
+		s.syncChain()
+	}
+}
 
-	if len(hashCounts) == 0 {
-		// hashCounts will be empty if all hashes equal maxCount (ie. all hashes were unique)
-		// Pick the one with largest block num from original list
-		for _, blockChain := range blockChains {
-			if blockChain.GetNewestBlockNum() > currLargestBlockNum {
-				currLargestBlockNum = blockChain.GetNewestBlockNum()
-				currLongestBlockChain = *blockChain
-			}
+// Fetches the blocks missing locally that lead up to the block fromHash, numbered fromNum:
+// their headers are fetched going back from it until a known block, then the blocks are
+// fetched by hash, oldest first, and each is validated and added as it arrives, along
+// with the orphans waiting on it. Returns the number of blocks added.
+// The miner is not trusted: at most SyncMaxHeaders headers are fetched, and the walk stops
+// at the first header without enough proof-of-work or out of line with the one before it.
+func (s *MServer) fetchMissingBlocks(miner *rpc.Client, fromHash string, fromNum uint32) (int, error) {
+	minDifficulty := s.inkMiner.settings.PoWDifficultyOpBlock
+	if s.inkMiner.settings.PoWDifficultyNoOpBlock < minDifficulty {
+		minDifficulty = s.inkMiner.settings.PoWDifficultyNoOpBlock
+	}
+
+	// newest first, each the parent of the one before it
+	var missingHeaders []BlockHeader
+	nextHash, nextNum := fromHash, fromNum
+	for !s.isKnownBlock(nextHash) {
+		if len(missingHeaders) >= SyncMaxHeaders {
+			return 0, fmt.Errorf("headers from block %s do not lead to a known block within %d blocks", fromHash, SyncMaxHeaders)
 		}
-	} else {
-		// Out of the ties, pick the one with the largest block num
-		// If there are multiple, pick the first one encountered
-		for hash := range hashCounts {
-			blockChain := hashesToChains[hash]
-			if blockChain.GetNewestBlockNum() > currLargestBlockNum {
-				currLargestBlockNum = blockChain.GetNewestBlockNum()
-				currLongestBlockChain = blockChain
+		var headers []BlockHeader
+		if err := miner.Call("MServer.GetHeaders", HeadersRequest{FromHash: nextHash, Max: SyncHeadersBatchSize}, &headers); err != nil {
+			return 0, err
+		}
+		if len(headers) == 0 || len(headers) > SyncHeadersBatchSize {
+			return 0, fmt.Errorf("no usable headers from block %s", nextHash)
+		}
+		for _, header := range headers {
+			if s.isKnownBlock(nextHash) {
+				break
+			}
+			// the genesis block is always known, so no missing block can be numbered below 1
+			if header.Hash != nextHash || header.BlockNum != nextNum || nextNum < FirstBlockNum {
+				return 0, fmt.Errorf("headers from block %s do not form a chain", fromHash)
 			}
+			if !verifyTrailingZeros(header.Hash, minDifficulty) {
+				return 0, fmt.Errorf("header of block %s has invalid proof-of-work", header.Hash)
+			}
+			missingHeaders = append(missingHeaders, header)
+			nextHash, nextNum = header.PrevHash, header.BlockNum-1
+		}
+	}
+	if blockChain.GetBlockNum(nextHash) != nextNum {
+		return 0, fmt.Errorf("headers from block %s do not lead to a known block", fromHash)
+	}
+
+	blocksAdded := 0
+	for i := len(missingHeaders) - 1; i >= 0; i-- {
+		blockHash := missingHeaders[i].Hash
+		if blockChain.DoesBlockExist(blockHash) {
+			continue
+		}
+
+		var block blockchain.Block
+		if err := miner.Call("MServer.GetBlock", blockHash, &block); err != nil {
+			return blocksAdded, err
+		}
+		restoreOpRecords(&block)
+		if ComputeBlockHash(block) != blockHash {
+			return blocksAdded, fmt.Errorf("block does not match its hash %s", blockHash)
 		}
+		added := s.acceptBlock(block, false)
+		if added == 0 {
+			return blocksAdded, fmt.Errorf("invalid block %s", blockHash)
+		}
+		blocksAdded += added
 	}
+	return blocksAdded, nil
+}
 
-	return currLongestBlockChain
+// RPC Target
+// Returns the header of the tip of the longest chain
+func (s *MServer) GetTip(_ignore bool, tip *BlockHeader) error {
+	tipHash := blockChain.GetNewestHash()
+	if header, exists := getBlockHeader(tipHash); exists {
+		*tip = header
+	} else {
+		*tip = BlockHeader{Hash: tipHash}
+	}
+	return nil
 }
 
-// Traverse block chain and remove operations from pendingOperations
-func (s *MServer) updatePendingOperations() {
-	allOps := GetAllOperationsFromBlockChain(blockChain, s.inkMiner.settings.GenesisBlockHash)
+// RPC Target
+// Returns the headers of up to req.Max blocks, from req.FromHash back towards the
+// genesis block, newest first
+func (s *MServer) GetHeaders(req HeadersRequest, headers *[]BlockHeader) error {
+	for blockHash := req.FromHash; len(*headers) < req.Max; {
+		header, exists := getBlockHeader(blockHash)
+		if !exists {
+			break
+		}
+		*headers = append(*headers, header)
+		blockHash = header.PrevHash
+	}
+	return nil
+}
 
-	pendingOperations.Lock()
-	for opHash := range allOps {
-		delete(pendingOperations.all, opHash)
+// RPC Target
+// Returns the block with the given hash
+func (s *MServer) GetBlock(blockHash string, block *blockchain.Block) error {
+	found := blockChain.GetBlockByHash(blockHash)
+	if found == nil {
+		return fmt.Errorf("unknown block %s", blockHash)
 	}
-	pendingOperations.Unlock()
+	*block = *found
+	return nil
 }
 
-func computeBlockChainHash(blockChain blockchain.BlockChain) string {
-	chainBytes, err := json.Marshal(blockChain)
-	handleFatalError("Could not marshal blockchain to JSON", err)
+func getBlockHeader(blockHash string) (BlockHeader, bool) {
+	block := blockChain.GetBlockByHash(blockHash)
+	if block == nil {
+		return BlockHeader{}, false
+	}
+	return BlockHeader{Hash: blockHash, PrevHash: block.PrevHash, BlockNum: block.BlockNum, TotalWork: blockChain.GetTotalWork(blockHash)}, true
+}
 
-	hash := md5.New()
-	hash.Write(chainBytes)
-	return hex.EncodeToString(hash.Sum(nil))
+// Restores the OpRecords map of a no-op block received from another miner: gob
+// leaves empty maps out, and the block would not hash the same without it
+func restoreOpRecords(block *blockchain.Block) {
+	if block.OpRecords == nil {
+		block.OpRecords = make(map[string]*blockchain.OpRecord)
+	}
 }
 
 // RPC Target
@@ -1190,7 +2632,7 @@ func PrintBlockChain() {
 		} else {
 			fmt.Printf("Block %d contain the the following operations: \n", block.BlockNum)
 			for k := range block.OpRecords {
-				fmt.Println(block.OpRecords[k].Op)
+				fmt.Printf("%+v\n", *block.OpRecords[k])
 				fmt.Println("The above Operation was done by: ", block.OpRecords[k].AuthorPubKey)
 			}
 			fmt.Println("")
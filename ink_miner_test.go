@@ -8,23 +8,35 @@ import (
 	"./blockartlib"
 	"./blockchain"
 
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/rpc"
+	"path/filepath"
 	"testing"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const GENESIS_BLOCK_HASH = "83218ac34c1834c26781fe4bde918ee4"
 const RANDOM_NONCE = 1 // just putting a random nonce in the block since we are not testing it
-const SVG_OP_ONE = "<path d=\"M 0 0 L 20 20\" stroke=\"red\" fill=\"transparent\"/>"
-const SVG_OP_TWO = "<path d=\"M 30 30 L 40 40\" stroke=\"red\" fill=\"transparent\"/>"
-const SVG_OP_THREE = "<path d=\"M 50 50 L 60 60\" stroke=\"red\" fill=\"transparent\"/>"
-const SVG_INVALID_OP_ONE = "<path d=\"M 30 30 L 30 800\" stroke=\"red\" fill=\"transparent\"/>"
-const SVG_VALID_OP_ONE = "<path d=\"M 300 300 L 310 310\" stroke=\"red\" fill=\"transparent\"/>"
-
-var p256 = elliptic.P256()
-var minerOnePrivateKey, _ = ecdsa.GenerateKey(p256, rand.Reader)
+var SVG_OP_ONE = redShape("M 0 0 L 20 20")
+var SVG_OP_TWO = redShape("M 30 30 L 40 40")
+var SVG_OP_THREE = redShape("M 50 50 L 60 60")
+var SVG_INVALID_OP_ONE = redShape("M 30 30 L 30 800")
+var SVG_VALID_OP_ONE = redShape("M 300 300 L 310 310")
+var SVG_VALID_CIRCLE_OP = redShape("cx 500 cy 500 r 10")
+var SVG_INVALID_CIRCLE_OP = redShape("cx 995 cy 500 r 10")
+var SVG_OVERLAPPING_CIRCLE_OP = redShape("cx 35 cy 35 r 5")
+
+var p384 = elliptic.P384()
+var minerOnePrivateKey, _ = ecdsa.GenerateKey(p384, rand.Reader)
 var minerOnePublicKey = minerOnePrivateKey.PublicKey
-var minerTwoPrivateKey, _ = ecdsa.GenerateKey(p256, rand.Reader)
+var minerTwoPrivateKey, _ = ecdsa.GenerateKey(p384, rand.Reader)
 var minerTwoPublicKey = minerTwoPrivateKey.PublicKey
 var mockInkMiner = InkMiner{
 	settings: &minerNetSettings,
@@ -58,41 +70,15 @@ var noOPBlockMinerTwo = blockchain.Block{
 }
 var blockTwoHash = ComputeBlockHash(noOPBlockMinerTwo)
 
-// Generate OP-SIG
-var svgOPOne = []byte(SVG_OP_ONE)
-var r1, s1, _ = ecdsa.Sign(rand.Reader, minerOnePrivateKey, svgOPOne)
-var svgOpTwo = []byte(SVG_OP_TWO)
-var r2, s2, _ = ecdsa.Sign(rand.Reader, minerTwoPrivateKey, svgOpTwo)
-var svgOpThree = []byte(SVG_OP_THREE)
-var r3, s3, _ = ecdsa.Sign(rand.Reader, minerTwoPrivateKey, svgOpThree)
-
-// Generate OpRecords
-var minerOneOpRecordOne = blockchain.OpRecord{
-	Op:           SVG_OP_ONE,
-	InkUsed:      20,
-	OpSigR:       r1,
-	OpSigS:       s1,
-	AuthorPubKey: minerOnePublicKey,
-}
-var opRecOneHash = ComputeOpRecordHash(minerOneOpRecordOne)
-
-var minerOneOpRecordTwo = blockchain.OpRecord{
-	Op:           SVG_OP_TWO,
-	InkUsed:      10,
-	OpSigR:       r2,
-	OpSigS:       s2,
-	AuthorPubKey: minerTwoPublicKey,
-}
-var opRecTwoHash = ComputeOpRecordHash(minerOneOpRecordTwo)
-
-var minerTwoOpRecord = blockchain.OpRecord{
-	Op:           SVG_OP_THREE,
-	InkUsed:      10,
-	OpSigR:       r3,
-	OpSigS:       s3,
-	AuthorPubKey: minerTwoPublicKey,
-}
-var opRecThreeHash = ComputeOpRecordHash(minerTwoOpRecord)
+// Generate signed OpRecords; on the chain, miner one's last Seq is 1 and miner two's is 2
+var minerOneOpRecordOne = newAddOp(SVG_OP_ONE, 20, 1, minerOnePrivateKey)
+var opRecOneHash = blockchain.ComputeOpRecordHash(minerOneOpRecordOne)
+
+var minerOneOpRecordTwo = newAddOp(SVG_OP_TWO, 10, 1, minerTwoPrivateKey)
+var opRecTwoHash = blockchain.ComputeOpRecordHash(minerOneOpRecordTwo)
+
+var minerTwoOpRecord = newAddOp(SVG_OP_THREE, 10, 2, minerTwoPrivateKey)
+var opRecThreeHash = blockchain.ComputeOpRecordHash(minerTwoOpRecord)
 
 // Generate Blocks
 var opRecordsBlockThree = make(map[string]*blockchain.OpRecord)
@@ -117,7 +103,45 @@ var blockFourHash = ComputeBlockHash(opBlockMinerTwo)
 
 var blockChainMock blockchain.BlockChain
 
-var allOpRecords map[string]*blockchain.OpRecord
+// Returns a transparent path or circle with a red stroke
+func redShape(svgString string) blockchain.Shape {
+	return blockchain.Shape{SvgString: svgString, Fill: "transparent", Stroke: "red"}
+}
+
+func newSignedOp(op blockchain.OpRecord, privKey *ecdsa.PrivateKey) blockchain.OpRecord {
+	op.Sign(privKey)
+	return op
+}
+
+// Returns an op adding shape, signed by the author owning privKey
+func newAddOp(shape blockchain.Shape, inkUsed uint32, seq uint64, privKey *ecdsa.PrivateKey) blockchain.OpRecord {
+	return newSignedOp(blockchain.OpRecord{Type: blockchain.ADD, Shape: shape, InkUsed: inkUsed, Seq: seq}, privKey)
+}
+
+// Returns an op deleting the shape shapeHash, signed by the author owning privKey
+func newDeleteOp(shapeHash string, inkUsed uint32, seq uint64, privKey *ecdsa.PrivateKey) blockchain.OpRecord {
+	return newSignedOp(blockchain.OpRecord{Type: blockchain.DELETE, ShapeHash: shapeHash, InkUsed: inkUsed, Seq: seq}, privKey)
+}
+
+// Returns the ops by their hashes, as a block holds them
+func opsByHash(ops ...*blockchain.OpRecord) map[string]*blockchain.OpRecord {
+	opRecords := make(map[string]*blockchain.OpRecord, len(ops))
+	for _, op := range ops {
+		opRecords[blockchain.ComputeOpRecordHash(*op)] = op
+	}
+	return opRecords
+}
+
+// Returns an op adding shape as one of the groupSize ops of the batch groupID
+func newBatchOp(shape blockchain.Shape, inkUsed uint32, seq uint64, groupID string, groupSize uint32, privKey *ecdsa.PrivateKey) blockchain.OpRecord {
+	op := blockchain.OpRecord{Type: blockchain.ADD, Shape: shape, InkUsed: inkUsed, Seq: seq, GroupID: groupID, GroupSize: groupSize}
+	return newSignedOp(op, privKey)
+}
+
+// Returns a block without ops, mined by the owner of minerPubKey
+func newNoOpBlock(blockNum uint32, prevHash string, minerPubKey *ecdsa.PublicKey, nonce uint32) blockchain.Block {
+	return blockchain.Block{BlockNum: blockNum, PrevHash: prevHash, OpRecords: make(map[string]*blockchain.OpRecord), MinerPubKey: minerPubKey, Nonce: nonce}
+}
 
 func setUpBlockChain() {
 	opRecordsBlockThree[opRecOneHash] = &minerOneOpRecordOne
@@ -140,11 +164,8 @@ func setUpBlockChain() {
 	//init global vars
 	pendingOperations = PendingOperations{all: make(map[string]*blockchain.OpRecord)}
 	blockChain = blockChainMock
-
-	allOpRecords = make(map[string]*blockchain.OpRecord)
-	allOpRecords[opRecOneHash] = &minerOneOpRecordOne
-	allOpRecords[opRecTwoHash] = &minerOneOpRecordTwo
-	allOpRecords[opRecThreeHash] = &minerTwoOpRecord
+	canvasEngine = NewCanvasEngine(GENESIS_BLOCK_HASH, minerNetSettings.CanvasSettings)
+	inkLedgers = InkLedgers{all: make(map[string]*blockchain.InkLedger)}
 
 
 	// Traverses the chain and print out content of each block in the chain
@@ -181,19 +202,52 @@ func TestGetInkTraversal(t *testing.T) {
 	}
 }
 
-func TestGetShapesTraversal(t *testing.T) {
+// Returns the svg strings of the live shapes as of the block tipHash that were not drawn by pubKey
+func shapesNotDrawnBy(tipHash string, pubKey ecdsa.PublicKey) []string {
+	var svgStrings []string
+	canvasEngine.View(tipHash, func(state *CanvasState) {
+		for _, shape := range state.Shapes() {
+			if !reflect.DeepEqual(shape.OpRecord.AuthorPubKey, pubKey) {
+				svgStrings = append(svgStrings, shape.OpRecord.Shape.SvgString)
+			}
+		}
+	})
+	return svgStrings
+}
+
+func TestCanvasStateShapes(t *testing.T) {
 	setUpBlockChain()
-	shapesDrawnByMinersOtherThanMinerOne := []string{"M 50 50 L 60 60", "M 30 30 L 40 40"}
-	if shapes := GetShapeTraversal(&mockInkMiner, &minerOnePublicKey); !reflect.DeepEqual(shapesDrawnByMinersOtherThanMinerOne, shapes) {
+	shapesDrawnByMinersOtherThanMinerOne := []string{"M 30 30 L 40 40", "M 50 50 L 60 60"}
+	if shapes := shapesNotDrawnBy(blockFourHash, minerOnePublicKey); !reflect.DeepEqual(shapesDrawnByMinersOtherThanMinerOne, shapes) {
 		t.Errorf("Expected shapes for miner 1: %v, but got %v", shapesDrawnByMinersOtherThanMinerOne, shapes)
 	}
 
 	shapesDrawnByMinersOtherThanMinerTwo := []string{"M 0 0 L 20 20"}
-	if shapes := GetShapeTraversal(&mockInkMiner, &minerTwoPublicKey); !reflect.DeepEqual(shapesDrawnByMinersOtherThanMinerTwo, shapes) {
+	if shapes := shapesNotDrawnBy(blockFourHash, minerTwoPublicKey); !reflect.DeepEqual(shapesDrawnByMinersOtherThanMinerTwo, shapes) {
 		t.Errorf("Expected shapes for miner 2: %v, but got %v", shapesDrawnByMinersOtherThanMinerTwo, shapes)
 	}
 }
 
+func TestOpRecordHashLeavesOutSignature(t *testing.T) {
+	op := newAddOp(SVG_OP_ONE, 28, 1, minerOnePrivateKey)
+
+	// (R, N-S) is just as valid a signature as (R, S), and must not make the op a new one
+	malleated := op
+	malleated.OpSigS = new(big.Int).Sub(p384.Params().N, op.OpSigS)
+	if !malleated.HasValidSignature() {
+		t.Fatal("Expected the malleated signature to verify")
+	}
+	if blockchain.ComputeOpRecordHash(malleated) != blockchain.ComputeOpRecordHash(op) {
+		t.Error("Expected the same op hash whatever its signature")
+	}
+
+	// the same op by another author is another op
+	otherAuthor := newAddOp(SVG_OP_ONE, 28, 1, minerTwoPrivateKey)
+	if blockchain.ComputeOpRecordHash(otherAuthor) == blockchain.ComputeOpRecordHash(op) {
+		t.Error("Expected the ops of different authors to hash differently")
+	}
+}
+
 func TestGetOpRecordTraversal(t *testing.T) {
 	setUpBlockChain()
 	opRec, blockHash, exists := GetOpRecordTraversal(opRecThreeHash, mockInkMiner.settings.GenesisBlockHash)
@@ -204,10 +258,10 @@ func TestGetOpRecordTraversal(t *testing.T) {
 
 func TestIsValidatedByValidateNumOf1(t *testing.T) {
 	setUpBlockChain()
-	blockHash, validated := IsValidatedByValidateNum(opRecOneHash, 1, mockInkMiner.settings.GenesisBlockHash, &minerOnePublicKey)
+	blockHash, validated := IsValidatedByValidateNum(opRecOneHash, 1, mockInkMiner.settings.GenesisBlockHash, &minerOnePublicKey, nil)
 	if !strings.EqualFold(blockHash, blockThreeHash) || !validated {
-		t.Errorf("Expected opRecordHash %s with validateNum of %d to be validated: %d, but got %d"+
-			";and to be in block with blockhash: %s, but got %s ", opRecOneHash, true, validated, blockThreeHash, blockHash)
+		t.Errorf("Expected opRecordHash %s with validateNum of %d to be validated: %t, but got %t"+
+			";and to be in block with blockhash: %s, but got %s ", opRecOneHash, 1, true, validated, blockThreeHash, blockHash)
 	}
 }
 
@@ -222,42 +276,137 @@ func TestVerifyOpRecordAuthor(t *testing.T) {
 	}
 
 	// if miner two was malicious and changed the author public key to it's own, author verification should fail for the opRecord
-	minerOneOpRecordOne.AuthorPubKey = minerTwoPublicKey
-	if authorVerified := VerifyOpRecordAuthor(minerTwoPublicKey, minerOneOpRecordOne); authorVerified {
-		t.Errorf("Expected author with pub key %+v to be not verified for opRecord %v", minerTwoPublicKey, minerOneOpRecordOne)
+	forgedOpRecord := minerOneOpRecordOne
+	forgedOpRecord.AuthorPubKey = minerTwoPublicKey
+	if authorVerified := VerifyOpRecordAuthor(minerTwoPublicKey, forgedOpRecord); authorVerified {
+		t.Errorf("Expected author with pub key %+v to be not verified for opRecord %v", minerTwoPublicKey, forgedOpRecord)
 	}
 }
 
 func TestIsValidOperation(t *testing.T) {
 	setUpBlockChain()
 	minerOneInvalidOp := blockchain.OpRecord{
-		Op: SVG_INVALID_OP_ONE,
+		Type: blockchain.ADD,
+		Shape: SVG_INVALID_OP_ONE,
 		InkUsed: 900,
-		OpSigR: r1,
-		OpSigS: s1,
 		AuthorPubKey: minerOnePublicKey,
 	}
 	minerOneValidOp := blockchain.OpRecord{
-		Op: SVG_VALID_OP_ONE,
-		InkUsed: 10,
-		OpSigR: r1,
-		OpSigS: s1,
+		Type: blockchain.ADD,
+		Shape: SVG_VALID_OP_ONE,
+		InkUsed: 14,
 		AuthorPubKey: minerOnePublicKey,
 	}
 
-	if isValidOperation(&mockInkMiner, minerOneInvalidOp) {
+	if isValidOperation(&mockInkMiner, minerOneInvalidOp, blockFourHash) {
 		t.Error("Expected isValidOperation to return false, but returned true")
 	}
 
-	if !isValidOperation(&mockInkMiner, minerOneValidOp) {
+	if !isValidOperation(&mockInkMiner, minerOneValidOp, blockFourHash) {
 		t.Error("Expected isValidOperation to return true, but returned false")
 	}
+
+	// the ink used must be the ink the shape requires
+	understatedOp := minerOneValidOp
+	understatedOp.InkUsed = 10
+	if isValidOperation(&mockInkMiner, understatedOp, blockFourHash) {
+		t.Error("Expected isValidOperation to return false for understated ink, but returned true")
+	}
+
+	// malformed ops from other miners are rejected rather than panicking
+	for _, malformedShape := range []blockchain.Shape{redShape("M 0"), {SvgString: "l 1 1"}, redShape("garbage"), {}} {
+		minerOneValidOp.Shape = malformedShape
+		if isValidOperation(&mockInkMiner, minerOneValidOp, blockFourHash) {
+			t.Errorf("Expected isValidOperation to return false for %+v, but returned true", malformedShape)
+		}
+	}
+
+	// ops of no known type are rejected
+	minerOneValidOp.Shape = SVG_VALID_OP_ONE
+	minerOneValidOp.Type = 0
+	if isValidOperation(&mockInkMiner, minerOneValidOp, blockFourHash) {
+		t.Error("Expected isValidOperation to return false for an op without a type, but returned true")
+	}
+}
+
+func TestHasValidOperations(t *testing.T) {
+	setUpBlockChain()
+	minerOneOp := newAddOp(redShape("M 300 300 L 310 310"), 14, 2, minerOnePrivateKey)
+	crossingOp := newAddOp(redShape("M 300 310 L 310 300"), 14, 3, minerOnePrivateKey)
+
+	// shapes of one author can overlap
+	if !hasValidOperations(&mockInkMiner, opsByHash(&minerOneOp, &crossingOp), blockFourHash) {
+		t.Error("Expected overlapping shapes of one author to be valid")
+	}
+
+	// but not shapes of different authors in the same block
+	minerTwoCrossingOp := newAddOp(redShape("M 300 310 L 310 300"), 14, 3, minerTwoPrivateKey)
+	if hasValidOperations(&mockInkMiner, opsByHash(&minerOneOp, &minerTwoCrossingOp), blockFourHash) {
+		t.Error("Expected overlapping shapes of different authors in one block to be invalid")
+	}
+
+	// each add fits in miner one's 130 ink, but not both
+	longOp := newAddOp(redShape("M 100 100 L 200 100"), 100, 2, minerOnePrivateKey)
+	otherLongOp := newAddOp(redShape("M 100 200 L 200 200"), 100, 3, minerOnePrivateKey)
+	if !hasValidOperations(&mockInkMiner, opsByHash(&longOp), blockFourHash) {
+		t.Error("Expected a single add within the author's ink to be valid")
+	}
+	if hasValidOperations(&mockInkMiner, opsByHash(&longOp, &otherLongOp), blockFourHash) {
+		t.Error("Expected adds that overspend together to be invalid")
+	}
+
+	// ops changed after signing are forged
+	forgedOp := minerOneOp
+	forgedOp.Shape = redShape("M 400 400 L 410 410")
+	if hasValidOperations(&mockInkMiner, opsByHash(&forgedOp), blockFourHash) {
+		t.Error("Expected a forged op to be invalid")
+	}
+
+	// a signed op stored under another key would burn its author's Seq under a hash they never see
+	if hasValidOperations(&mockInkMiner, map[string]*blockchain.OpRecord{"rekeyed": &minerOneOp}, blockFourHash) {
+		t.Error("Expected an op stored under a key other than its hash to be invalid")
+	}
+
+	// a shape added earlier in the block can be deleted by its author
+	minerOneOpHash := blockchain.ComputeOpRecordHash(minerOneOp)
+	deleteOp := newDeleteOp(minerOneOpHash, 14, 3, minerOnePrivateKey)
+	if !hasValidOperations(&mockInkMiner, opsByHash(&minerOneOp, &deleteOp), blockFourHash) {
+		t.Error("Expected the delete of a shape added in the same block to be valid")
+	}
 }
 
-func TestGetAllOperationsFromBlockChain(t *testing.T) {
+func TestIsValidCircleOperation(t *testing.T) {
 	setUpBlockChain()
-	if opRecs := GetAllOperationsFromBlockChain(blockChainMock, GENESIS_BLOCK_HASH); !reflect.DeepEqual(opRecs, allOpRecords) {
-		t.Errorf("Expected all opRecords to match")
+	minerOneValidCircle := blockchain.OpRecord{
+		Type:         blockchain.ADD,
+		Shape:        SVG_VALID_CIRCLE_OP,
+		InkUsed:      62,
+		AuthorPubKey: minerOnePublicKey,
+	}
+	minerOneOutOfBoundsCircle := blockchain.OpRecord{
+		Type:         blockchain.ADD,
+		Shape:        SVG_INVALID_CIRCLE_OP,
+		InkUsed:      62,
+		AuthorPubKey: minerOnePublicKey,
+	}
+	// crosses "M 30 30 L 40 40" drawn by miner two
+	minerOneOverlappingCircle := blockchain.OpRecord{
+		Type:         blockchain.ADD,
+		Shape:        SVG_OVERLAPPING_CIRCLE_OP,
+		InkUsed:      31,
+		AuthorPubKey: minerOnePublicKey,
+	}
+
+	if !isValidOperation(&mockInkMiner, minerOneValidCircle, blockFourHash) {
+		t.Error("Expected isValidOperation to return true for circle, but returned false")
+	}
+
+	if isValidOperation(&mockInkMiner, minerOneOutOfBoundsCircle, blockFourHash) {
+		t.Error("Expected isValidOperation to return false for out of bounds circle, but returned true")
+	}
+
+	if isValidOperation(&mockInkMiner, minerOneOverlappingCircle, blockFourHash) {
+		t.Error("Expected isValidOperation to return false for overlapping circle, but returned true")
 	}
 }
 
@@ -267,22 +416,9 @@ func TestDeletedRefundsInk(t *testing.T) {
 
 	// Set up delete operation for minerTwo's opBlockMinerTwo
 
-	// svg string
-	const SVG_DELETE_OP_THREE = "delete <path d=\"M 50 50 L 60 60\" stroke=\"red\" fill=\"transparent\"/>"
-	var svgOpThreeDelete = []byte(SVG_DELETE_OP_THREE)
-
-	// opSigR, opSigS
-	var r4, s4, _ = ecdsa.Sign(rand.Reader, minerTwoPrivateKey, svgOpThreeDelete)
-
 	// op
-	var minerTwoOpRecordDelete = blockchain.OpRecord{
-		Op:           SVG_DELETE_OP_THREE,
-		InkUsed:      10,
-		OpSigR:       r4,
-		OpSigS:       s4,
-		AuthorPubKey: minerTwoPublicKey,
-	}
-	var opRecFourHash = ComputeOpRecordHash(minerTwoOpRecordDelete)
+	var minerTwoOpRecordDelete = newDeleteOp(opRecThreeHash, 10, 3, minerTwoPrivateKey)
+	var opRecFourHash = blockchain.ComputeOpRecordHash(minerTwoOpRecordDelete)
 
 	// block
 	var opRecordsBlockFive = make(map[string]*blockchain.OpRecord)
@@ -303,3 +439,902 @@ func TestDeletedRefundsInk(t *testing.T) {
 		t.Errorf("Expected ink for miner 2: 240, but got %d", ink)
 	}
 }
+
+func TestIsValidDelete(t *testing.T) {
+	setUpBlockChain()
+	deleteThree := newDeleteOp(opRecThreeHash, 10, 3, minerTwoPrivateKey)
+
+	if !isValidOperation(&mockInkMiner, deleteThree, blockFourHash) {
+		t.Error("Expected delete of a live shape by its author to be valid")
+	}
+	invalidDeletes := map[string]blockchain.OpRecord{
+		"wrong refund":     newDeleteOp(opRecThreeHash, 20, 3, minerTwoPrivateKey),
+		"not the owner":    newDeleteOp(opRecThreeHash, 10, 3, minerOnePrivateKey),
+		"unknown shape":    newDeleteOp("unknown", 10, 3, minerTwoPrivateKey),
+		"not drawn yet":    newDeleteOp(opRecTwoHash, 10, 3, minerTwoPrivateKey),
+		"delete of delete": newDeleteOp(blockchain.ComputeOpRecordHash(deleteThree), 10, 3, minerTwoPrivateKey),
+	}
+	for name, op := range invalidDeletes {
+		prevHash := blockFourHash
+		if name == "not drawn yet" {
+			prevHash = blockTwoHash
+		}
+		if isValidOperation(&mockInkMiner, op, prevHash) {
+			t.Errorf("Expected delete to be invalid: %s", name)
+		}
+	}
+
+	// the same shape cannot be refunded twice, in one block or in later blocks
+	deleteThreeAgain := newDeleteOp(opRecThreeHash, 10, 4, minerTwoPrivateKey)
+	ops := opsByHash(&deleteThree, &deleteThreeAgain)
+	if hasValidOperations(&mockInkMiner, ops, blockFourHash) {
+		t.Error("Expected two deletes of the same shape in one block to be invalid")
+	}
+	if validOps := dropInvalidDeletes(&mockInkMiner, ops, blockFourHash); len(validOps) != 1 {
+		t.Errorf("Expected only one of the deletes to be mined, but got %v", validOps)
+	}
+
+	deleteBlock := blockchain.Block{BlockNum: 5, PrevHash: blockFourHash, OpRecords: map[string]*blockchain.OpRecord{"first": &deleteThree}, MinerPubKey: &minerTwoPublicKey}
+	deleteBlockHash := ComputeBlockHash(deleteBlock)
+	blockChain.Blocks[deleteBlockHash] = &deleteBlock
+	if isValidOperation(&mockInkMiner, deleteThreeAgain, deleteBlockHash) {
+		t.Error("Expected delete of an already deleted shape to be invalid")
+	}
+}
+
+func TestOpenCanvasChallenge(t *testing.T) {
+	inkMiner := InkMiner{pubKey: &minerOnePublicKey, privKey: minerOnePrivateKey, settings: &minerNetSettings}
+	artNode := MArtNode{inkMiner: &inkMiner}
+	var resp blockartlib.OpenCanvasResponse
+	// Returns the error in the reply of OpenCanvas
+	openCanvas := func(req blockartlib.OpenCanvasRequest) *blockartlib.RPCError {
+		resp = blockartlib.OpenCanvasResponse{}
+		if err := artNode.OpenCanvas(req, &resp); err != nil {
+			t.Fatalf("Expected the error in the reply, but got %s", err)
+		}
+		return resp.Err
+	}
+
+	// OpenCanvas without a nonce must fail
+	if err := openCanvas(blockartlib.OpenCanvasRequest{PubKey: minerOnePublicKey}); err == nil || err.Kind != blockartlib.INVALIDPRIVKEY {
+		t.Error("Expected OpenCanvas without a nonce to fail")
+	}
+
+	// A signature by another key must fail
+	var nonce string
+	artNode.GetNonce(true, &nonce)
+	r, s, _ := ecdsa.Sign(rand.Reader, minerTwoPrivateKey, blockchain.NonceDigest(nonce))
+	if err := openCanvas(blockartlib.OpenCanvasRequest{PubKey: minerOnePublicKey, SigR: r, SigS: s}); err == nil || err.Kind != blockartlib.INVALIDPRIVKEY {
+		t.Error("Expected OpenCanvas with a signature from another key to fail")
+	}
+
+	// A key on a curve of the client's choosing must fail, here one named like the network
+	// curve that goes through miner one's key with it as generator, so that 1 is its private key
+	network := blockchain.NetworkCurve.Params()
+	x, y := minerOnePublicKey.X, minerOnePublicKey.Y
+	b := new(big.Int).Mul(y, y)
+	b.Sub(b, new(big.Int).Exp(x, big.NewInt(3), nil))
+	b.Add(b, new(big.Int).Mul(big.NewInt(3), x))
+	b.Mod(b, network.P)
+	forgedCurve := &elliptic.CurveParams{P: network.P, N: network.N, B: b, Gx: x, Gy: y, BitSize: network.BitSize, Name: network.Name}
+	forgerKey := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: forgedCurve, X: x, Y: y}, D: big.NewInt(1)}
+	artNode.GetNonce(true, &nonce)
+	r, s, _ = ecdsa.Sign(rand.Reader, forgerKey, blockchain.NonceDigest(nonce))
+	if err := openCanvas(blockartlib.OpenCanvasRequest{PubKey: forgerKey.PublicKey, SigR: r, SigS: s}); err == nil || err.Kind != blockartlib.INVALIDPRIVKEY {
+		t.Error("Expected OpenCanvas with a key on another curve to fail")
+	}
+
+	// A signature over the raw nonce, which ECDSA cuts short, must fail
+	artNode.GetNonce(true, &nonce)
+	r, s, _ = ecdsa.Sign(rand.Reader, minerOnePrivateKey, []byte(nonce))
+	if err := openCanvas(blockartlib.OpenCanvasRequest{PubKey: minerOnePublicKey, SigR: r, SigS: s}); err == nil || err.Kind != blockartlib.INVALIDPRIVKEY {
+		t.Error("Expected OpenCanvas with a signature over the raw nonce to fail")
+	}
+
+	// The correct signature succeeds and binds the session
+	artNode.GetNonce(true, &nonce)
+	r, s, _ = ecdsa.Sign(rand.Reader, minerOnePrivateKey, blockchain.NonceDigest(nonce))
+	req := blockartlib.OpenCanvasRequest{PubKey: minerOnePublicKey, SigR: r, SigS: s}
+	if err := openCanvas(req); err != nil {
+		t.Errorf("Expected OpenCanvas to succeed, but got %s", err)
+	}
+	if resp.Settings != minerNetSettings.CanvasSettings {
+		t.Errorf("Expected canvas settings %+v, but got %+v", minerNetSettings.CanvasSettings, resp.Settings)
+	}
+	if err := artNode.checkSession(); err != nil {
+		t.Errorf("Expected session to be open, but got %s", err)
+	}
+
+	// The nonce cannot be replayed
+	if err := openCanvas(req); err == nil || err.Kind != blockartlib.INVALIDPRIVKEY {
+		t.Error("Expected OpenCanvas with a replayed nonce to fail")
+	}
+}
+
+func TestCheckOpAuthor(t *testing.T) {
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+
+	// op signed on the art node with the session's key
+	op := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14}
+	op.Sign(minerOnePrivateKey)
+	if err := artNode.checkOpAuthor(op); err != nil {
+		t.Errorf("Expected op signed by the session key to be accepted, but got %s", err)
+	}
+
+	// op signed by another art node's key
+	otherOp := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14}
+	otherOp.Sign(minerTwoPrivateKey)
+	if err := artNode.checkOpAuthor(otherOp); err == nil {
+		t.Error("Expected op signed by another key to be rejected")
+	}
+
+	// op tampered with after signing
+	op.Shape = SVG_OP_ONE
+	if err := artNode.checkOpAuthor(op); err == nil {
+		t.Error("Expected tampered op to be rejected")
+	}
+
+	// the type and target of a delete are signed too
+	deleteOp := newDeleteOp(opRecOneHash, 20, 0, minerOnePrivateKey)
+	deleteOp.ShapeHash = opRecTwoHash
+	if err := artNode.checkOpAuthor(deleteOp); err == nil {
+		t.Error("Expected delete retargeted after signing to be rejected")
+	}
+}
+
+func TestGetOpStatus(t *testing.T) {
+	setUpBlockChain()
+	submittedOperations = SubmittedOperations{all: make(map[string]bool)}
+
+	// in block three, followed by block four
+	if status := getOpStatus(opRecOneHash, 1, GENESIS_BLOCK_HASH); status.Kind != blockartlib.CONFIRMED || status.Confirmations != 1 || status.BlockHash != blockThreeHash {
+		t.Errorf("Expected CONFIRMED(1) in block %s, but got %s in block %s", blockThreeHash, status, status.BlockHash)
+	}
+
+	if status := getOpStatus(opRecOneHash, 2, GENESIS_BLOCK_HASH); status.Kind != blockartlib.INCLUDED || status.Confirmations != 1 {
+		t.Errorf("Expected INCLUDED(1), but got %s", status)
+	}
+
+	pendingOp := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14, AuthorPubKey: minerOnePublicKey}
+	pendingOpHash := blockchain.ComputeOpRecordHash(pendingOp)
+	pendingOperations.Add(pendingOpHash, pendingOp)
+	submittedOperations.Add(pendingOpHash)
+	if status := getOpStatus(pendingOpHash, 1, GENESIS_BLOCK_HASH); status.Kind != blockartlib.PENDING {
+		t.Errorf("Expected PENDING, but got %s", status)
+	}
+
+	// submitted, but dropped from pending without making it onto the longest chain
+	pendingOperations.Remove(map[string]*blockchain.OpRecord{pendingOpHash: &pendingOp})
+	if status := getOpStatus(pendingOpHash, 1, GENESIS_BLOCK_HASH); status.Kind != blockartlib.ORPHANED {
+		t.Errorf("Expected ORPHANED, but got %s", status)
+	}
+
+	// in a block on a side branch, which stays pending as the branch may still win
+	blockEvents = NewBlockEventLog(GENESIS_BLOCK_HASH)
+	blockEvents.tipHash = blockFourHash
+	pendingOperations.Add(pendingOpHash, pendingOp)
+	sideBlock := blockchain.Block{BlockNum: 3, PrevHash: blockTwoHash, OpRecords: map[string]*blockchain.OpRecord{pendingOpHash: &pendingOp}, MinerPubKey: &minerTwoPublicKey, Nonce: 2}
+	saveBlockToBlockChain(sideBlock)
+	if blockChain.GetNewestHash() != blockFourHash || !pendingOperations.Contains(pendingOpHash) {
+		t.Error("Expected the op of a block off the longest chain to stay pending")
+	}
+	pendingOperations.Remove(map[string]*blockchain.OpRecord{pendingOpHash: &pendingOp})
+	if status := getOpStatus(pendingOpHash, 1, GENESIS_BLOCK_HASH); status.Kind != blockartlib.PENDING {
+		t.Errorf("Expected PENDING for an op on a side branch, but got %s", status)
+	}
+
+	if status := getOpStatus("unknown", 1, GENESIS_BLOCK_HASH); status.Kind != blockartlib.REJECTED {
+		t.Errorf("Expected REJECTED, but got %s", status)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	setUpBlockChain()
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+
+	// a cancel that arrives before its request stops the request before it broadcasts anything
+	var resp blockartlib.CancelRequestResponse
+	if err := artNode.CancelRequest("early", &resp); err != nil || resp.Broadcast {
+		t.Errorf("Expected cancel of unknown request to succeed without broadcast, but got %+v, %v", resp, err)
+	}
+	op := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14}
+	op.Sign(minerOnePrivateKey)
+	var newShapeResp blockartlib.NewShapeResponse
+	err := artNode.AddShape(blockartlib.AddShapeRequest{ValidateNum: 1, OpRecord: op, RequestID: "early"}, &newShapeResp)
+	if err != nil || newShapeResp.Err == nil || newShapeResp.Err.Kind != blockartlib.CANCELLED {
+		t.Errorf("Expected AddShape to be cancelled, but got %v, %v", newShapeResp.Err, err)
+	}
+
+	// a pending op stops being waited on once its request is cancelled
+	pendingOp := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14, AuthorPubKey: minerOnePublicKey}
+	pendingOpHash := blockchain.ComputeOpRecordHash(pendingOp)
+	pendingOperations.Add(pendingOpHash, pendingOp)
+	defer pendingOperations.Remove(map[string]*blockchain.OpRecord{pendingOpHash: &pendingOp})
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, validated := IsValidatedByValidateNum(pendingOpHash, 1, GENESIS_BLOCK_HASH, &minerOnePublicKey, cancel); validated {
+		t.Error("Expected cancelled pending op not to be validated")
+	}
+}
+
+func TestTypedRPCErrors(t *testing.T) {
+	setUpBlockChain()
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+
+	// crosses miner two's shape in block four
+	op := blockchain.OpRecord{Type: blockchain.ADD, Shape: redShape("M 50 60 L 60 50"), InkUsed: 14, Seq: 2}
+	op.Sign(minerOnePrivateKey)
+	var newShapeResp blockartlib.NewShapeResponse
+	if err := artNode.SubmitShape(blockartlib.AddShapeRequest{ValidateNum: 1, OpRecord: op}, &newShapeResp); err != nil {
+		t.Fatalf("Expected the error to be carried in the reply, but got %s", err)
+	}
+	if rpcErr := newShapeResp.Err; rpcErr == nil || rpcErr.Kind != blockartlib.SHAPEOVERLAP || rpcErr.Hash != opRecThreeHash {
+		t.Errorf("Expected SHAPEOVERLAP with hash %s, but got %v", opRecThreeHash, rpcErr)
+	}
+
+	var svgResp blockartlib.SvgStringResponse
+	artNode.GetSvgString("unknown", &svgResp)
+	if rpcErr := svgResp.Err; rpcErr == nil || rpcErr.Kind != blockartlib.INVALIDSHAPEHASH || rpcErr.Hash != "unknown" {
+		t.Errorf("Expected INVALIDSHAPEHASH with hash unknown, but got %v", rpcErr)
+	}
+
+	var hashesResp blockartlib.HashesResponse
+	artNode.GetChildren("unknown", &hashesResp)
+	if rpcErr := hashesResp.Err; rpcErr == nil || rpcErr.Kind != blockartlib.INVALIDBLOCKHASH || rpcErr.Hash != "unknown" {
+		t.Errorf("Expected INVALIDBLOCKHASH with hash unknown, but got %v", rpcErr)
+	}
+
+	if err := insufficientInkErr(-5).(*blockartlib.RPCError); err.Kind != blockartlib.INSUFFICIENTINK || err.InkRemaining != 0 {
+		t.Errorf("Expected INSUFFICIENTINK with no ink remaining, but got %+v", err)
+	}
+}
+
+func TestBlockEventLog(t *testing.T) {
+	setUpBlockChain()
+	eventLog := NewBlockEventLog(GENESIS_BLOCK_HASH)
+	eventLog.tipHash = blockTwoHash
+
+	// block four was added; the tip moves from block two to block four
+	eventLog.BlockAdded(blockFourHash)
+	events, nextSeq := eventLog.EventsFrom(1, 0)
+	if len(events) != 2 || nextSeq != 3 {
+		t.Fatalf("Expected 2 events and next seq 3, but got %v and %d", events, nextSeq)
+	}
+	if e := events[0]; e.Kind != blockartlib.NEWBLOCK || e.BlockHash != blockFourHash || !reflect.DeepEqual(e.AddedShapes, []string{opRecThreeHash}) {
+		t.Errorf("Expected NEWBLOCK adding %s, but got %+v", opRecThreeHash, e)
+	}
+	if e := events[1]; e.Kind != blockartlib.TIPCHANGED || e.PrevTipHash != blockTwoHash || len(e.AddedShapes) != 3 || len(e.RemovedShapes) != 0 {
+		t.Errorf("Expected TIPCHANGED adding 3 shapes, but got %+v", e)
+	}
+
+	// a block on another branch off block two becomes the tip
+	forkBlock := newNoOpBlock(3, blockTwoHash, &minerTwoPublicKey, 0)
+	forkHash := ComputeBlockHash(forkBlock)
+	blockChain.Blocks[forkHash] = &forkBlock
+	blockChain.SetNewestHash(forkHash)
+	eventLog.BlockAdded(forkHash)
+	events, nextSeq = eventLog.EventsFrom(nextSeq, 0)
+	if len(events) != 2 || events[1].Kind != blockartlib.REORG || len(events[1].RemovedShapes) != 3 || len(events[1].AddedShapes) != 0 {
+		t.Errorf("Expected REORG removing 3 shapes, but got %+v", events)
+	}
+
+	// waiting for events that are not recorded yet times out
+	if events, seq := eventLog.EventsFrom(nextSeq, time.Millisecond); len(events) != 0 || seq != nextSeq {
+		t.Errorf("Expected no events, but got %+v", events)
+	}
+
+	// events dropped from the log are replaced by a RESET
+	eventLog.events = eventLog.events[2:]
+	if events, _ := eventLog.EventsFrom(1, 0); len(events) != 1 || events[0].Kind != blockartlib.RESET || len(events[0].AddedShapes) != 0 {
+		t.Errorf("Expected an empty RESET, but got %+v", events)
+	}
+}
+
+func TestGetCanvasTraversal(t *testing.T) {
+	setUpBlockChain()
+
+	shapes := GetCanvasTraversal(blockFourHash)
+	if len(shapes) != 3 || shapes[2].ShapeHash != opRecThreeHash {
+		t.Fatalf("Expected 3 shapes ending with %s, but got %+v", opRecThreeHash, shapes)
+	}
+	shape := shapes[2]
+	if shape.BlockHash != blockFourHash || shape.SvgString != "M 50 50 L 60 60" || shape.Fill != "transparent" || shape.Stroke != "red" ||
+		shape.InkUsed != 10 || shape.ShapeType != blockartlib.PATH || !reflect.DeepEqual(shape.Owner, minerTwoPublicKey) {
+		t.Errorf("Unexpected shape record %+v", shape)
+	}
+
+	if shapes := GetCanvasTraversal(blockTwoHash); len(shapes) != 0 {
+		t.Errorf("Expected no shapes as of block two, but got %+v", shapes)
+	}
+
+	// deleting shape three on top of block four
+	deleteOp := blockchain.OpRecord{Type: blockchain.DELETE, ShapeHash: opRecThreeHash, InkUsed: 10, AuthorPubKey: minerTwoPublicKey}
+	deleteBlock := blockchain.Block{BlockNum: 5, PrevHash: blockFourHash, OpRecords: map[string]*blockchain.OpRecord{blockchain.ComputeOpRecordHash(deleteOp): &deleteOp}}
+	deleteBlockHash := ComputeBlockHash(deleteBlock)
+	blockChain.Blocks[deleteBlockHash] = &deleteBlock
+	for _, shape := range GetCanvasTraversal(deleteBlockHash) {
+		if shape.ShapeHash == opRecThreeHash {
+			t.Errorf("Expected shape %s to be deleted", opRecThreeHash)
+		}
+	}
+}
+
+func TestSubmitShapesBatch(t *testing.T) {
+	setUpBlockChain()
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+
+	valid := newBatchOp(SVG_VALID_OP_ONE, 14, 2, "batch", 2, minerOnePrivateKey)
+	overlapping := newBatchOp(redShape("M 50 60 L 60 50"), 14, 3, "batch", 2, minerOnePrivateKey)
+
+	if err := checkOpGroup([]blockchain.OpRecord{valid, overlapping}); err != nil {
+		t.Errorf("Expected a whole batch, but got %s", err)
+	}
+	if err := checkOpGroup([]blockchain.OpRecord{valid}); err == nil {
+		t.Error("Expected a batch missing an op to be rejected")
+	}
+
+	// one shape of the batch overlaps, so none of it is broadcast
+	_, _, err := artNode.submitShapes([]blockchain.OpRecord{valid, overlapping})
+	if rpcErr, ok := err.(*blockartlib.RPCError); !ok || rpcErr.Kind != blockartlib.SHAPEOVERLAP || rpcErr.Hash != opRecThreeHash {
+		t.Errorf("Expected SHAPEOVERLAP with hash %s, but got %v", opRecThreeHash, err)
+	}
+	if len(pendingOperations.all) != 0 {
+		t.Errorf("Expected no pending operations, but got %d", len(pendingOperations.all))
+	}
+
+	// a batch op cannot be submitted on its own
+	if _, _, err := artNode.submitShape(valid); err == nil {
+		t.Error("Expected a batch op submitted alone to be rejected")
+	}
+}
+
+func TestOpSeqs(t *testing.T) {
+	setUpBlockChain()
+	first := newAddOp(SVG_VALID_OP_ONE, 14, 2, minerOnePrivateKey)
+	second := newAddOp(SVG_VALID_OP_ONE, 14, 3, minerOnePrivateKey)
+	fourth := newAddOp(redShape("M 400 400 L 410 410"), 14, 4, minerOnePrivateKey)
+
+	// the same shape can be drawn again under a new Seq
+	firstHash, secondHash := blockchain.ComputeOpRecordHash(first), blockchain.ComputeOpRecordHash(second)
+	if firstHash == secondHash || !hasValidOperations(&mockInkMiner, opsByHash(&first, &second), blockFourHash) {
+		t.Error("Expected the same shape drawn twice to be valid")
+	}
+	if hasValidOperations(&mockInkMiner, opsByHash(&minerOneOpRecordOne), blockFourHash) {
+		t.Error("Expected a replayed op to be invalid")
+	}
+	if hasValidOperations(&mockInkMiner, opsByHash(&first, &fourth), blockFourHash) {
+		t.Error("Expected an op skipping a Seq to be invalid")
+	}
+
+	// ops after a missing Seq wait until it arrives
+	pending := map[string]*blockchain.OpRecord{"first": &first, "fourth": &fourth}
+	if selected := selectOperations(&mockInkMiner, pending, blockFourHash); len(selected) != 1 || selected["first"] == nil {
+		t.Errorf("Expected only the op with the next Seq to be mined, but got %v", selected)
+	}
+
+	// replayed ops are neither kept nor passed on
+	server := MServer{inkMiner: &mockInkMiner}
+	server.DisseminateOperation(minerOneOpRecordOne, nil)
+	if len(pendingOperations.all) != 0 {
+		t.Errorf("Expected a replayed op not to be pending, but got %d pending", len(pendingOperations.all))
+	}
+
+	// so are forged ops, and ops that could never be valid
+	forged := first
+	forged.AuthorPubKey = minerTwoPublicKey
+	wrongInk := newAddOp(SVG_VALID_OP_ONE, 1, 2, minerOnePrivateKey)
+	outOfBounds := newAddOp(redShape("M 0 0 L 5000 5000"), 14, 2, minerOnePrivateKey)
+	for _, op := range []blockchain.OpRecord{forged, wrongInk, outOfBounds} {
+		server.DisseminateOperation(op, nil)
+	}
+	if len(pendingOperations.all) != 0 {
+		t.Errorf("Expected forged and malformed ops not to be pending, but got %d pending", len(pendingOperations.all))
+	}
+
+	// a relayed op rebroadcast under a fresh Seq no longer carries its author's signature,
+	// however long its path
+	relayed := newAddOp(redShape("M 300 300 L 310 300 L 310 310 L 320 310 L 320 320"), 40, 2, minerOnePrivateKey)
+	rebroadcast := relayed
+	rebroadcast.Seq = 3
+	server.DisseminateOperation(rebroadcast, nil)
+	if len(pendingOperations.all) != 0 {
+		t.Errorf("Expected a rebroadcast op with a new Seq not to be pending, but got %d pending", len(pendingOperations.all))
+	}
+	relayedOps := map[string]*blockchain.OpRecord{blockchain.ComputeOpRecordHash(relayed): &relayed, blockchain.ComputeOpRecordHash(rebroadcast): &rebroadcast}
+	if hasValidOperations(&mockInkMiner, relayedOps, blockFourHash) {
+		t.Error("Expected a block drawing a relayed op again under a new Seq to be invalid")
+	}
+	server.DisseminateOperation(first, nil)
+	if len(pendingOperations.all) != 1 {
+		t.Errorf("Expected a valid op to be pending, but got %d pending", len(pendingOperations.all))
+	}
+	pendingOperations.Remove(map[string]*blockchain.OpRecord{firstHash: &first})
+
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+	var nextSeq uint64
+	if artNode.GetNextSeq(true, &nextSeq); nextSeq != 2 {
+		t.Errorf("Expected next Seq 2, but got %d", nextSeq)
+	}
+	pendingOperations.Add(firstHash, first)
+	if artNode.GetNextSeq(true, &nextSeq); nextSeq != 3 {
+		t.Errorf("Expected next Seq 3 after a pending op, but got %d", nextSeq)
+	}
+
+	if err := artNode.checkOpSeqs([]blockchain.OpRecord{first}); err != nil {
+		t.Errorf("Expected a pending op to be submitted again, but got %s", err)
+	}
+	for name, op := range map[string]blockchain.OpRecord{"replayed": minerOneOpRecordOne, "same Seq as a pending op": newAddOp(SVG_OP_TWO, 14, 2, minerOnePrivateKey), "out of sequence": fourth} {
+		if err := artNode.checkOpSeqs([]blockchain.OpRecord{op}); err == nil {
+			t.Errorf("Expected op to be rejected: %s", name)
+		}
+	}
+
+	// a pending op that is invalid on the tip is dropped, along with the ops after it, which
+	// could never be mined, so that it does not hold up the author's later ops
+	deadDelete := newDeleteOp("unknown", 10, 3, minerOnePrivateKey)
+	pendingOperations.Add(blockchain.ComputeOpRecordHash(deadDelete), deadDelete)
+	pendingOperations.Add(blockchain.ComputeOpRecordHash(fourth), fourth)
+	if selected := pendingOperations.Selection(&mockInkMiner, blockFourHash); len(selected) != 1 || selected[firstHash] == nil {
+		t.Errorf("Expected only the first op to be mined, but got %v", selected)
+	}
+	if len(pendingOperations.all) != 1 {
+		t.Errorf("Expected the invalid delete and the op after it to be dropped, but got %d pending", len(pendingOperations.all))
+	}
+	if artNode.GetNextSeq(true, &nextSeq); nextSeq != 3 {
+		t.Errorf("Expected the Seq of the dropped delete to be free again, but got %d", nextSeq)
+	}
+
+	// ops already on the chain are dropped once their block is the tip
+	pendingOperations.Add(opRecOneHash, minerOneOpRecordOne)
+	if pendingOperations.Selection(&mockInkMiner, blockFourHash); len(pendingOperations.all) != 1 {
+		t.Errorf("Expected an op already on the chain to be dropped, but got %d pending", len(pendingOperations.all))
+	}
+}
+
+func TestInvalidPendingBatch(t *testing.T) {
+	setUpBlockChain()
+	server := MServer{inkMiner: &mockInkMiner}
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+
+	// each op fits in miner one's 130 ink, but the batch overdraws it by its last op
+	for i, svgString := range []string{"M 100 100 L 160 100", "M 100 200 L 160 200", "M 100 300 L 160 300"} {
+		server.DisseminateOperation(newBatchOp(redShape(svgString), 60, uint64(2+i), "batch", 3, minerOnePrivateKey), nil)
+	}
+	if len(pendingOperations.all) != 3 {
+		t.Fatalf("Expected the batch to be pending, but got %d pending", len(pendingOperations.all))
+	}
+	if selected := pendingOperations.Selection(&mockInkMiner, blockFourHash); len(selected) != 0 || len(pendingOperations.all) != 0 {
+		t.Errorf("Expected the whole batch to be dropped, but got %d selected and %d pending", len(selected), len(pendingOperations.all))
+	}
+
+	// the author can go on with the Seqs the batch held
+	var nextSeq uint64
+	if artNode.GetNextSeq(true, &nextSeq); nextSeq != 2 {
+		t.Errorf("Expected next Seq 2, but got %d", nextSeq)
+	}
+	server.DisseminateOperation(newAddOp(SVG_VALID_OP_ONE, 14, nextSeq, minerOnePrivateKey), nil)
+	if selected := pendingOperations.Selection(&mockInkMiner, blockFourHash); len(selected) != 1 {
+		t.Errorf("Expected the new op to be mined, but got %d selected", len(selected))
+	}
+}
+
+func TestLoadStoredBlocks(t *testing.T) {
+	setUpBlockChain()
+	path := filepath.Join(t.TempDir(), "blocks.log")
+
+	chain := blockchain.BlockChain{Blocks: make(map[string]*blockchain.Block)}
+	if err := chain.OpenStore(path, func(string, *blockchain.Block) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	chain.AddBlockAndUpdateTip(&noOPBlockMinerOne, blockOneHash)
+	chain.AddBlockAndUpdateTip(&noOPBlockMinerTwo, blockTwoHash)
+
+	// a block stored under a hash that is not its own, and the child that builds on it
+	misfiled := noOPBlockMinerOne
+	misfiled.PrevHash, misfiled.BlockNum = blockTwoHash, 3
+	misfiledHash := strings.Repeat("0", 32)
+	chain.AddBlockAndUpdateTip(&misfiled, misfiledHash)
+	child := noOPBlockMinerTwo
+	child.PrevHash, child.BlockNum = misfiledHash, 4
+	chain.AddBlockAndUpdateTip(&child, ComputeBlockHash(child))
+
+	// a block stored under its own hash that is not valid on its parent
+	misnumbered := noOPBlockMinerOne
+	misnumbered.PrevHash, misnumbered.BlockNum = blockTwoHash, 9
+	chain.AddBlockAndUpdateTip(&misnumbered, ComputeBlockHash(misnumbered))
+
+	blockChain = blockchain.BlockChain{Blocks: make(map[string]*blockchain.Block)}
+	blockChain.SetNewestHash(GENESIS_BLOCK_HASH)
+	server := MServer{inkMiner: &mockInkMiner}
+	if err := blockChain.OpenStore(path, server.isValidStoredBlock); err != nil {
+		t.Fatal(err)
+	}
+	if blockChain.GetSize() != 2 || blockChain.GetNewestHash() != blockTwoHash {
+		t.Errorf("Expected only the 2 valid blocks up to block two, but got %d up to %s", blockChain.GetSize(), blockChain.GetNewestHash())
+	}
+}
+
+func TestSyncHeaders(t *testing.T) {
+	setUpBlockChain()
+	server := MServer{inkMiner: &mockInkMiner}
+
+	var tip BlockHeader
+	if server.GetTip(true, &tip); tip.Hash != blockFourHash || tip.BlockNum != 4 {
+		t.Errorf("Expected block four as the tip, but got %+v", tip)
+	}
+
+	var headers []BlockHeader
+	server.GetHeaders(HeadersRequest{FromHash: blockFourHash, Max: 2}, &headers)
+	if len(headers) != 2 || headers[0].Hash != blockFourHash || headers[1].Hash != blockThreeHash || headers[1].PrevHash != blockTwoHash {
+		t.Errorf("Expected the headers of blocks four and three, but got %+v", headers)
+	}
+	headers = nil
+	server.GetHeaders(HeadersRequest{FromHash: blockFourHash, Max: SyncHeadersBatchSize}, &headers)
+	if len(headers) != 4 || !server.isKnownBlock(headers[3].PrevHash) {
+		t.Errorf("Expected 4 headers leading back to the genesis block, but got %+v", headers)
+	}
+
+	var block blockchain.Block
+	if err := server.GetBlock("unknown", &block); err == nil {
+		t.Error("Expected an unknown block to be an error")
+	}
+	if err := server.GetBlock(blockTwoHash, &block); err != nil || ComputeBlockHash(block) != blockTwoHash {
+		t.Errorf("Expected block two, but got %+v, %v", block, err)
+	}
+
+	// blocks on the genesis block can be validated, as they are synced oldest first
+	firstBlock := newNoOpBlock(1, GENESIS_BLOCK_HASH, &minerTwoPublicKey, 7)
+	if !server.checkBlock(firstBlock) {
+		t.Error("Expected a block on the genesis block to be valid")
+	}
+	firstBlock.BlockNum = 2
+	if server.checkBlock(firstBlock) {
+		t.Error("Expected a block with the wrong BlockNum to be invalid")
+	}
+}
+
+// A miner that serves an endless chain of made-up headers, named by their BlockNums
+type endlessHeaders struct{}
+
+func (e *endlessHeaders) GetHeaders(req HeadersRequest, headers *[]BlockHeader) error {
+	num, _ := strconv.ParseUint(req.FromHash, 10, 32)
+	for ; len(*headers) < req.Max && num > 0; num-- {
+		*headers = append(*headers, BlockHeader{Hash: fmt.Sprint(num), PrevHash: fmt.Sprint(num - 1), BlockNum: uint32(num)})
+	}
+	return nil
+}
+
+func TestFetchMissingBlocksFromLyingMiner(t *testing.T) {
+	setUpBlockChain()
+	server := MServer{inkMiner: &mockInkMiner}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("MServer", &endlessHeaders{})
+	clientConn, serverConn := net.Pipe()
+	go rpcServer.ServeConn(serverConn)
+	miner := rpc.NewClient(clientConn)
+	defer miner.Close()
+
+	// a tip claimed far beyond any real chain is given up on after SyncMaxHeaders headers
+	if _, err := server.fetchMissingBlocks(miner, fmt.Sprint(uint32(math.MaxUint32)), math.MaxUint32); err == nil {
+		t.Error("Expected an endless chain of headers to be given up on")
+	}
+
+	// headers out of line with the claimed BlockNum are rejected at once
+	if _, err := server.fetchMissingBlocks(miner, "10", 11); err == nil {
+		t.Error("Expected headers with the wrong BlockNums to be rejected")
+	}
+}
+
+func TestOrphanPool(t *testing.T) {
+	pool := OrphanPool{all: make(map[string]*orphanBlock)}
+	first := newNoOpBlock(6, "parent", nil, 0)
+	firstHash := ComputeBlockHash(first)
+	if !pool.Add(firstHash, first) || pool.Add(firstHash, first) {
+		t.Error("Expected an orphan to be added once")
+	}
+	pool.all[firstHash].received = time.Now().Add(-time.Minute)
+	for nonce := uint32(1); nonce < OrphanPoolSize+1; nonce++ {
+		orphan := newNoOpBlock(6, "parent", nil, nonce)
+		pool.Add(ComputeBlockHash(orphan), orphan)
+	}
+	if len(pool.all) != OrphanPoolSize || pool.Contains(firstHash) {
+		t.Errorf("Expected the oldest orphan to be dropped from a full pool, but got %d orphans", len(pool.all))
+	}
+
+	expiredHash := ComputeBlockHash(newNoOpBlock(6, "parent", nil, 1))
+	pool.all[expiredHash].received = time.Now().Add(-OrphanExpiry - time.Second)
+	if children := pool.TakeChildren("parent"); len(children) != OrphanPoolSize-1 || len(pool.all) != 0 {
+		t.Errorf("Expected all but the expired orphan, but got %d", len(children))
+	}
+}
+
+func TestDisseminateOrphanBlock(t *testing.T) {
+	setUpBlockChain()
+	server := MServer{inkMiner: &mockInkMiner}
+	orphanBlocks = OrphanPool{all: make(map[string]*orphanBlock)}
+	blockEvents = NewBlockEventLog(GENESIS_BLOCK_HASH)
+	blockEvents.tipHash = blockFourHash
+
+	parent := newNoOpBlock(5, blockFourHash, &minerOnePublicKey, 0)
+	parentHash := ComputeBlockHash(parent)
+	child := newNoOpBlock(6, parentHash, &minerOnePublicKey, 0)
+	childHash := ComputeBlockHash(child)
+
+	// the child arrives first, from a sender that cannot be reached
+	server.DisseminateBlock(BlockMessage{Block: child, SenderAddr: ""}, nil)
+	if !orphanBlocks.Contains(childHash) || blockChain.DoesBlockExist(childHash) {
+		t.Fatal("Expected the child to wait for its parent")
+	}
+
+	server.DisseminateBlock(BlockMessage{Block: parent}, nil)
+	if orphanBlocks.Contains(childHash) || blockChain.GetNewestHash() != childHash {
+		t.Errorf("Expected the child to be connected once its parent arrived, but the tip is %s", blockChain.GetNewestHash())
+	}
+
+	// orphans whose BlockNum their ancestors cannot reach are not kept
+	for _, blockNum := range []uint32{1, 7 + SyncMaxHeaders} {
+		orphan := newNoOpBlock(blockNum, "unknown", &minerOnePublicKey, 0)
+		server.DisseminateBlock(BlockMessage{Block: orphan}, nil)
+		if orphanBlocks.Contains(ComputeBlockHash(orphan)) {
+			t.Errorf("Expected the orphan with BlockNum %d to be rejected", blockNum)
+		}
+	}
+
+	// nor are those without a valid proof-of-work
+	settings := minerNetSettings
+	settings.PoWDifficultyNoOpBlock = 8
+	powServer := MServer{inkMiner: &InkMiner{settings: &settings}}
+	orphan := newNoOpBlock(8, "unknown", &minerOnePublicKey, 0)
+	for verifyTrailingZeros(ComputeBlockHash(orphan), settings.PoWDifficultyNoOpBlock) {
+		orphan.Nonce++
+	}
+	powServer.DisseminateBlock(BlockMessage{Block: orphan}, nil)
+	if orphanBlocks.Contains(ComputeBlockHash(orphan)) {
+		t.Error("Expected the orphan without a valid proof-of-work to be rejected")
+	}
+}
+
+func TestCanvasEngine(t *testing.T) {
+	setUpBlockChain()
+	crossingShape := blockchain.Shape{SvgString: "M 0 20 L 20 0", Fill: "transparent", Stroke: "blue"}
+
+	canvasEngine.View(blockFourHash, func(state *CanvasState) {
+		if len(state.shapes) != 3 {
+			t.Errorf("Expected 3 shapes on the canvas, but got %d", len(state.shapes))
+		}
+		if candidates := state.Candidates("M 15 15 L 25 25"); !reflect.DeepEqual(candidates, []string{opRecOneHash}) {
+			t.Errorf("Expected only [%s] to be near, but got %v", opRecOneHash, candidates)
+		}
+	})
+
+	if opHash, overlaps := GetOverlappingShapeHash(blockChain.GetNewestHash(), &minerTwoPublicKey, crossingShape); !overlaps || opHash != opRecOneHash {
+		t.Errorf("Expected shape to overlap %s, but got %s, %t", opRecOneHash, opHash, overlaps)
+	}
+	if _, overlaps := GetOverlappingShapeHash(blockChain.GetNewestHash(), &minerOnePublicKey, crossingShape); overlaps {
+		t.Error("Expected shape not to overlap shapes of its own author")
+	}
+
+	// shape one was added in block three and is deleted two blocks later, along with a
+	// delete of shape three by an author who does not own it
+	deleteBlock := blockchain.Block{
+		BlockNum: 5,
+		PrevHash: blockFourHash,
+		OpRecords: map[string]*blockchain.OpRecord{
+			"deleteOne":   {Type: blockchain.DELETE, ShapeHash: opRecOneHash, InkUsed: 20, AuthorPubKey: minerOnePublicKey},
+			"deleteThree": {Type: blockchain.DELETE, ShapeHash: opRecThreeHash, InkUsed: 10, AuthorPubKey: minerOnePublicKey},
+		},
+		MinerPubKey: &minerOnePublicKey,
+	}
+	deleteBlockHash := ComputeBlockHash(deleteBlock)
+	blockChain.Blocks[deleteBlockHash] = &deleteBlock
+	blockChain.SetNewestHash(deleteBlockHash)
+
+	if _, overlaps := GetOverlappingShapeHash(blockChain.GetNewestHash(), &minerTwoPublicKey, crossingShape); overlaps {
+		t.Error("Expected shape not to overlap the deleted shape")
+	}
+	if added, removed := canvasEngine.BlockChanges(deleteBlockHash); len(added) != 0 || !reflect.DeepEqual(removed, []string{opRecOneHash}) {
+		t.Errorf("Expected the block to only remove [%s], but got %v, %v", opRecOneHash, added, removed)
+	}
+	if shape, live, exists := GetShapeOnLongestChain(opRecOneHash); live || !exists || shape.BlockHash != blockThreeHash {
+		t.Errorf("Expected shape %s to be deleted, but got %+v, %t, %t", opRecOneHash, shape, live, exists)
+	}
+	if shapes := shapesNotDrawnBy(deleteBlockHash, minerTwoPublicKey); len(shapes) != 0 {
+		t.Errorf("Expected no shapes drawn by miner 1, but got %v", shapes)
+	}
+
+	// the art node lookups both still find the deleted shape
+	artNode := MArtNode{inkMiner: &mockInkMiner, pubKey: &minerOnePublicKey}
+	var svgResp blockartlib.SvgStringResponse
+	var opRecordResp blockartlib.OpRecordResponse
+	artNode.GetSvgString(opRecOneHash, &svgResp)
+	artNode.GetOpRecord(opRecOneHash, &opRecordResp)
+	if svgResp.Err != nil || opRecordResp.Err != nil || opRecordResp.OpRecord.Shape != minerOneOpRecordOne.Shape {
+		t.Errorf("Expected the deleted shape to be found by both lookups, but got %v, %v", svgResp.Err, opRecordResp.Err)
+	}
+
+	// a longer fork from block four, where shape one is never deleted
+	forkOne := newNoOpBlock(5, blockFourHash, &minerTwoPublicKey, 2)
+	forkOneHash := ComputeBlockHash(forkOne)
+	forkTwo := newNoOpBlock(6, forkOneHash, &minerTwoPublicKey, 2)
+	forkTwoHash := ComputeBlockHash(forkTwo)
+	blockChain.Blocks[forkOneHash] = &forkOne
+	blockChain.Blocks[forkTwoHash] = &forkTwo
+	blockChain.SetNewestHash(forkTwoHash)
+
+	if opHash, overlaps := GetOverlappingShapeHash(blockChain.GetNewestHash(), &minerTwoPublicKey, crossingShape); !overlaps || opHash != opRecOneHash {
+		t.Errorf("Expected the delete to be undone on the fork, but got %s, %t", opHash, overlaps)
+	}
+	if shapes := GetCanvasTraversal(forkTwoHash); !reflect.DeepEqual(shapes, GetCanvasTraversal(blockFourHash)) {
+		t.Errorf("Expected the shapes of block four, but got %+v", shapes)
+	}
+
+	// switching back redoes the delete
+	blockChain.SetNewestHash(deleteBlockHash)
+	if _, live, _ := GetShapeOnLongestChain(opRecOneHash); live {
+		t.Errorf("Expected shape %s to be deleted again", opRecOneHash)
+	}
+	canvasEngine.View(deleteBlockHash, func(state *CanvasState) {
+		if len(state.shapes) != 2 || len(state.deleted) != 1 || len(state.changes) != 5 {
+			t.Errorf("Expected 2 live and 1 deleted shapes after 5 blocks, but got %d, %d, %d", len(state.shapes), len(state.deleted), len(state.changes))
+		}
+	})
+
+	// the changes of a block on the fork, where shape one is still live, are worked out
+	// without moving the state off the tip
+	forkDelete := blockchain.Block{
+		BlockNum:    7,
+		PrevHash:    forkTwoHash,
+		OpRecords:   map[string]*blockchain.OpRecord{"deleteOne": deleteBlock.OpRecords["deleteOne"]},
+		MinerPubKey: &minerTwoPublicKey,
+	}
+	forkDeleteHash := ComputeBlockHash(forkDelete)
+	blockChain.Blocks[forkDeleteHash] = &forkDelete
+	if added, removed := canvasEngine.BlockChanges(forkDeleteHash); len(added) != 0 || !reflect.DeepEqual(removed, []string{opRecOneHash}) {
+		t.Errorf("Expected the fork block to remove [%s], but got %v, %v", opRecOneHash, added, removed)
+	}
+	if canvasEngine.state.TipHash() != deleteBlockHash {
+		t.Errorf("Expected the state to stay on the tip, but it moved to %s", canvasEngine.state.TipHash())
+	}
+}
+
+func TestInkLedgerSwitchesTips(t *testing.T) {
+	setUpBlockChain()
+	if ink := GetInkTraversal(&mockInkMiner, &minerTwoPublicKey); ink != 130 {
+		t.Errorf("Expected ink for miner 2: 130, but got %d", ink)
+	}
+
+	// a longer fork from block two, where miner 2 mines two no-op blocks
+	forkOne := newNoOpBlock(3, blockTwoHash, &minerTwoPublicKey, 2)
+	forkOneHash := ComputeBlockHash(forkOne)
+	forkTwo := newNoOpBlock(4, forkOneHash, &minerTwoPublicKey, 2)
+	forkTwoHash := ComputeBlockHash(forkTwo)
+	forkThree := newNoOpBlock(5, forkTwoHash, &minerTwoPublicKey, 2)
+	forkThreeHash := ComputeBlockHash(forkThree)
+	blockChain.Blocks[forkOneHash] = &forkOne
+	blockChain.Blocks[forkTwoHash] = &forkTwo
+	blockChain.Blocks[forkThreeHash] = &forkThree
+	blockChain.SetNewestHash(forkThreeHash)
+
+	if ink := GetInkTraversal(&mockInkMiner, &minerTwoPublicKey); ink != 200 { // 50 * 4 no-op blocks
+		t.Errorf("Expected ink for miner 2: 200, but got %d", ink)
+	}
+	if ink := GetInkTraversal(&mockInkMiner, &minerOnePublicKey); ink != 50 {
+		t.Errorf("Expected ink for miner 1: 50, but got %d", ink)
+	}
+
+	// switching back uses the ledger already derived for block four
+	blockChain.SetNewestHash(blockFourHash)
+	if ink := GetInkTraversal(&mockInkMiner, &minerTwoPublicKey); ink != 130 {
+		t.Errorf("Expected ink for miner 2: 130, but got %d", ink)
+	}
+	if len(inkLedgers.all) != 7 {
+		t.Errorf("Expected a ledger for each of the 7 blocks, but got %d", len(inkLedgers.all))
+	}
+}
+
+func TestReorgRestoresPendingOps(t *testing.T) {
+	setUpBlockChain()
+	blockEvents = NewBlockEventLog(GENESIS_BLOCK_HASH)
+	blockEvents.tipHash = blockFourHash
+
+	// a longer fork from block two, whose first block holds an op that is still pending
+	pendingOp := blockchain.OpRecord{Type: blockchain.ADD, Shape: SVG_VALID_OP_ONE, InkUsed: 14, AuthorPubKey: minerOnePublicKey}
+	pendingOpHash := blockchain.ComputeOpRecordHash(pendingOp)
+	pendingOperations.Add(pendingOpHash, pendingOp)
+	forkOne := blockchain.Block{BlockNum: 3, PrevHash: blockTwoHash, OpRecords: map[string]*blockchain.OpRecord{pendingOpHash: &pendingOp}, MinerPubKey: &minerTwoPublicKey, Nonce: 2}
+	forkOneHash := ComputeBlockHash(forkOne)
+	forkTwo := newNoOpBlock(4, forkOneHash, &minerTwoPublicKey, 2)
+	forkThree := newNoOpBlock(5, ComputeBlockHash(forkTwo), &minerTwoPublicKey, 2)
+	saveBlockToBlockChain(forkOne)
+	saveBlockToBlockChain(forkTwo)
+	saveBlockToBlockChain(forkThree)
+	if blockChain.GetNewestHash() != ComputeBlockHash(forkThree) {
+		t.Fatal("Expected the longer fork to become the longest chain")
+	}
+
+	// the ops of blocks three and four are pending again, and the op now on the chain is not
+	for _, opHash := range []string{opRecOneHash, opRecTwoHash, opRecThreeHash} {
+		if !pendingOperations.Contains(opHash) {
+			t.Errorf("Expected op %s of an abandoned block to be pending again", opHash)
+		}
+	}
+	if pendingOperations.Contains(pendingOpHash) {
+		t.Error("Expected the op in the fork's block to leave pending")
+	}
+}
+
+func TestDisseminateBlocksConcurrently(t *testing.T) {
+	setUpBlockChain()
+	server := MServer{inkMiner: &mockInkMiner}
+	orphanBlocks = OrphanPool{all: make(map[string]*orphanBlock)}
+	blockEvents = NewBlockEventLog(GENESIS_BLOCK_HASH)
+	blockEvents.tipHash = blockFourHash
+
+	parent := newNoOpBlock(5, blockFourHash, &minerOnePublicKey, 0)
+	parentHash := ComputeBlockHash(parent)
+	child := newNoOpBlock(6, parentHash, &minerOnePublicKey, 0)
+	childHash := ComputeBlockHash(child)
+
+	// the same blocks arrive from several miners at once, the child possibly before its parent
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, block := range []blockchain.Block{child, parent} {
+			wg.Add(1)
+			go func(block blockchain.Block) {
+				defer wg.Done()
+				server.DisseminateBlock(BlockMessage{Block: block}, nil)
+			}(block)
+		}
+	}
+	wg.Wait()
+
+	if orphanBlocks.Contains(childHash) || blockChain.GetNewestHash() != childHash {
+		t.Fatalf("Expected the child to be the tip, but the tip is %s", blockChain.GetNewestHash())
+	}
+	added := make(map[string]int)
+	events, _ := blockEvents.EventsFrom(1, 0)
+	for _, event := range events {
+		if event.Kind == blockartlib.NEWBLOCK {
+			added[event.BlockHash]++
+		}
+	}
+	if added[parentHash] != 1 || added[childHash] != 1 {
+		t.Errorf("Expected each block to be added once, but got %v", added)
+	}
+}
+
+func TestMinedBlockLosesForkRace(t *testing.T) {
+	setUpBlockChain()
+	blockEvents = NewBlockEventLog(GENESIS_BLOCK_HASH)
+	blockEvents.tipHash = blockFourHash
+	server := MServer{inkMiner: &mockInkMiner}
+
+	// mined on block four, while a longer branch off block four arrived
+	pendingOp := newAddOp(SVG_VALID_OP_ONE, 14, 2, minerOnePrivateKey)
+	pendingOpHash := blockchain.ComputeOpRecordHash(pendingOp)
+	pendingOperations.Add(pendingOpHash, pendingOp)
+	forkOne := newNoOpBlock(5, blockFourHash, &minerTwoPublicKey, 1)
+	saveBlockToBlockChain(forkOne)
+	saveBlockToBlockChain(newNoOpBlock(6, ComputeBlockHash(forkOne), &minerTwoPublicKey, 1))
+	minedBlock := blockchain.Block{BlockNum: 5, PrevHash: blockFourHash, OpRecords: opsByHash(&pendingOp), MinerPubKey: &minerOnePublicKey, Nonce: 2}
+	if server.acceptBlock(minedBlock, true) != 1 {
+		t.Fatal("Expected the mined block to be valid")
+	}
+	if blockChain.GetNewestHash() == ComputeBlockHash(minedBlock) {
+		t.Fatal("Expected the mined block to lose to the longer branch")
+	}
+
+	if !pendingOperations.Contains(pendingOpHash) {
+		t.Fatal("Expected the op of the losing mined block to stay pending")
+	}
+	if selected := pendingOperations.Selection(&mockInkMiner, blockChain.GetNewestHash()); selected[pendingOpHash] == nil {
+		t.Error("Expected the op of the losing mined block to be mined again on the tip")
+	}
+
+	// a block numbered out of line with its parent is not added, even if this miner mined it
+	misnumbered := blockchain.Block{BlockNum: 7, PrevHash: blockFourHash, OpRecords: opsByHash(&pendingOp), MinerPubKey: &minerOnePublicKey, Nonce: 3}
+	if server.acceptBlock(misnumbered, true) != 0 || blockChain.DoesBlockExist(ComputeBlockHash(misnumbered)) {
+		t.Error("Expected a mined block with the wrong BlockNum to be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"math"
+	"sort"
+)
+
+// An axis-aligned rectangle enclosing a shape
+type Bounds struct {
+	MinX, MinY float64
+	MaxX, MaxY float64
+}
+
+// Returns the bounding box of the path or circle described by shapeString
+func ShapeBounds(shapeString string) (Bounds, error) {
+	if IsCircleString(shapeString) {
+		circle, err := ConvertCircleStringToCircle(shapeString)
+		if err != nil {
+			return Bounds{}, err
+		}
+		return Bounds{
+			MinX: float64(circle.Cx - circle.R), MinY: float64(circle.Cy - circle.R),
+			MaxX: float64(circle.Cx + circle.R), MaxY: float64(circle.Cy + circle.R),
+		}, nil
+	}
+
+	svgPath, err := ConvertPathToPoints(shapeString)
+	if err != nil {
+		return Bounds{}, err
+	}
+	minX, maxX := minMax(svgPath.XCords)
+	minY, maxY := minMax(svgPath.YCords)
+	return Bounds{MinX: minX, MinY: minY, MaxX: maxX, MaxY: maxY}, nil
+}
+
+// A uniform grid over the canvas, recording which cells each shape's bounds cover,
+// so that overlap checks only look at shapes sharing a cell.
+type ShapeGrid struct {
+	cellSize float64
+	maxCellX int
+	maxCellY int
+	cells    map[[2]int]map[string]bool
+	bounds   map[string]Bounds
+}
+
+// Returns an empty grid of square cells over a canvas of the given size.
+// Bounds reaching past the canvas are clamped to its edge cells.
+func NewShapeGrid(cellSize float64, canvasXMax uint32, canvasYMax uint32) *ShapeGrid {
+	return &ShapeGrid{
+		cellSize: cellSize,
+		maxCellX: int(float64(canvasXMax) / cellSize),
+		maxCellY: int(float64(canvasYMax) / cellSize),
+		cells:    make(map[[2]int]map[string]bool),
+		bounds:   make(map[string]Bounds),
+	}
+}
+
+// Adds the shape with the given key, replacing any shape with the same key
+func (g *ShapeGrid) Insert(key string, bounds Bounds) {
+	g.Remove(key)
+	g.bounds[key] = bounds
+	g.forEachCell(bounds, func(cell [2]int) {
+		if g.cells[cell] == nil {
+			g.cells[cell] = make(map[string]bool)
+		}
+		g.cells[cell][key] = true
+	})
+}
+
+func (g *ShapeGrid) Remove(key string) {
+	bounds, exists := g.bounds[key]
+	if !exists {
+		return
+	}
+	delete(g.bounds, key)
+	g.forEachCell(bounds, func(cell [2]int) {
+		delete(g.cells[cell], key)
+		if len(g.cells[cell]) == 0 {
+			delete(g.cells, cell)
+		}
+	})
+}
+
+// Returns the keys of the shapes whose bounds intersect or touch the given bounds, sorted
+func (g *ShapeGrid) Candidates(bounds Bounds) []string {
+	found := make(map[string]bool)
+	g.forEachCell(bounds, func(cell [2]int) {
+		for key := range g.cells[cell] {
+			other := g.bounds[key]
+			if other.MinX <= bounds.MaxX && bounds.MinX <= other.MaxX && other.MinY <= bounds.MaxY && bounds.MinY <= other.MaxY {
+				found[key] = true
+			}
+		}
+	})
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Calls fn for every cell the bounds cover. A coordinate on a cell edge belongs to the
+// cell after the edge only, which still leaves shapes that only touch sharing that cell.
+func (g *ShapeGrid) forEachCell(bounds Bounds, fn func(cell [2]int)) {
+	minX, maxX := g.cellIndex(bounds.MinX, g.maxCellX), g.cellIndex(bounds.MaxX, g.maxCellX)
+	minY, maxY := g.cellIndex(bounds.MinY, g.maxCellY), g.cellIndex(bounds.MaxY, g.maxCellY)
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			fn([2]int{x, y})
+		}
+	}
+}
+
+func (g *ShapeGrid) cellIndex(coordinate float64, maxCell int) int {
+	cell := math.Floor(coordinate / g.cellSize)
+	if !(cell > 0) {
+		// also catches NaN
+		return 0
+	} else if cell > float64(maxCell) {
+		return maxCell
+	}
+	return int(cell)
+}
@@ -0,0 +1,194 @@
+package util
+
+import (
+	"errors"
+	"math"
+	"reflect"
+)
+
+// The part of the canvas covered by a path or circle: its outline, plus its
+// inside when it is filled
+type shapeRegion struct {
+	path   SVGPathCoordinates
+	circle *Circle
+	edges  [][2]Point
+	filled bool
+}
+
+// Returns an error if two shapes overlap, where each shape string is either a path or a circle.
+// A filled (non-transparent) shape covers its inside as well as its outline, so a shape
+// drawn entirely inside it overlaps too. Paths are filled with the even-odd rule, each
+// subpath being closed implicitly, like the area CalculateInkRequired charges for.
+// Shapes that only touch, at a point or along a line, overlap.
+func CheckFilledShapeOverlap(shapeOne string, isFilledOne bool, shapeTwo string, isFilledTwo bool) error {
+	regionOne, err := newShapeRegion(shapeOne, isFilledOne)
+	if err != nil {
+		return err
+	}
+	regionTwo, err := newShapeRegion(shapeTwo, isFilledTwo)
+	if err != nil {
+		return err
+	}
+
+	if regionOne.outlinesCross(regionTwo) || regionOne.containsAny(regionTwo) || regionTwo.containsAny(regionOne) {
+		return errors.New(ShapeErrorName[SHAPEOVERLAP])
+	}
+	return nil
+}
+
+func newShapeRegion(shapeString string, isFilled bool) (shapeRegion, error) {
+	region := shapeRegion{filled: isFilled}
+	if IsCircleString(shapeString) {
+		circle, err := ConvertCircleStringToCircle(shapeString)
+		if err != nil {
+			return shapeRegion{}, err
+		}
+		region.circle = &circle
+		return region, nil
+	}
+
+	path, err := ConvertPathToPoints(shapeString)
+	if err != nil {
+		return shapeRegion{}, err
+	}
+	region.path = path
+	region.edges = path.segments()
+
+	// a filled path closes all of its subpaths, a final Z only the last one
+	subpaths := path.subpaths()
+	for i, subpath := range subpaths {
+		if isFilled || (i == len(subpaths)-1 && IsClosedShape(shapeString)) {
+			region.edges = append(region.edges, [2]Point{path.point(subpath[1] - 1), path.point(subpath[0])})
+		}
+	}
+	return region, nil
+}
+
+// Returns true if the outlines of the two regions cross or touch
+func (r shapeRegion) outlinesCross(other shapeRegion) bool {
+	switch {
+	case r.circle != nil && other.circle != nil:
+		return CheckCircleOverlap(*r.circle, *other.circle) != nil
+	case r.circle != nil:
+		return circleCrossesEdges(*r.circle, other.edges)
+	case other.circle != nil:
+		return circleCrossesEdges(*other.circle, r.edges)
+	}
+
+	if reflect.DeepEqual(r.path, other.path) {
+		return true
+	}
+	for _, edge := range r.edges {
+		for _, otherEdge := range other.edges {
+			if intersect(edge[0], edge[1], otherEdge[0], otherEdge[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if the region is filled and holds a point of the other region.
+// Only meaningful once outlinesCross is false: the other region is then either
+// entirely inside or entirely outside of each of its fills.
+func (r shapeRegion) containsAny(other shapeRegion) bool {
+	if !r.filled {
+		return false
+	}
+	for _, p := range other.samplePoints() {
+		if r.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a point of the region's outline, for every separate part of it
+func (r shapeRegion) samplePoints() []Point {
+	if r.circle != nil {
+		return []Point{{xCord: float64(r.circle.Cx + r.circle.R), yCord: float64(r.circle.Cy)}}
+	}
+	var points []Point
+	for _, subpath := range r.path.subpaths() {
+		points = append(points, r.path.point(subpath[0]))
+	}
+	return points
+}
+
+// Returns true if p is inside the filled region or on its outline
+func (r shapeRegion) contains(p Point) bool {
+	if r.circle != nil {
+		return dist(p, Point{xCord: float64(r.circle.Cx), yCord: float64(r.circle.Cy)}) <= float64(r.circle.R)
+	}
+
+	inside := false
+	for _, subpath := range r.path.subpaths() {
+		j := subpath[1] - 1
+		for i := subpath[0]; i < subpath[1]; i++ {
+			a, b := r.path.point(j), r.path.point(i)
+			if orientation(a, b, p) == 0 && onSegment(a, b, p) {
+				return true
+			}
+			// even-odd rule: count the edges crossed by a ray going right from p
+			if (a.yCord > p.yCord) != (b.yCord > p.yCord) &&
+				p.xCord < float64((b.xCord-a.xCord)*(p.yCord-a.yCord)/(b.yCord-a.yCord))+a.xCord {
+				inside = !inside
+			}
+			j = i
+		}
+	}
+	return inside
+}
+
+// Returns true if the outline of the circle crosses or touches any of the edges
+func circleCrossesEdges(circle Circle, edges [][2]Point) bool {
+	centre := Point{xCord: float64(circle.Cx), yCord: float64(circle.Cy)}
+	r := float64(circle.R)
+	for _, edge := range edges {
+		nearest := distToSegment(centre, edge[0], edge[1])
+		farthest := math.Max(dist(centre, edge[0]), dist(centre, edge[1]))
+		if nearest <= r && farthest >= r {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if line segments p1p2 and p3p4 intersect, including when they only
+// touch at an end point or lie on the same line and share a part
+func intersect(p1, p2, p3, p4 Point) bool {
+	o1 := orientation(p1, p2, p3)
+	o2 := orientation(p1, p2, p4)
+	o3 := orientation(p3, p4, p1)
+	o4 := orientation(p3, p4, p2)
+
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+
+	// collinear points, which the orientations above cannot tell apart
+	return (o1 == 0 && onSegment(p1, p2, p3)) ||
+		(o2 == 0 && onSegment(p1, p2, p4)) ||
+		(o3 == 0 && onSegment(p3, p4, p1)) ||
+		(o4 == 0 && onSegment(p3, p4, p2))
+}
+
+// Returns 1 if p1, p2, p3 turn counter clock wise, -1 if clock wise and 0 if they are collinear
+func orientation(p1, p2, p3 Point) int {
+	// the products are converted explicitly so that no miner fuses them into an FMA
+	cross := float64((p2.xCord-p1.xCord)*(p3.yCord-p1.yCord)) - float64((p2.yCord-p1.yCord)*(p3.xCord-p1.xCord))
+	switch {
+	case cross > 0:
+		return 1
+	case cross < 0:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// Returns true if p, collinear with p1 and p2, lies between them
+func onSegment(p1, p2, p Point) bool {
+	return math.Min(p1.xCord, p2.xCord) <= p.xCord && p.xCord <= math.Max(p1.xCord, p2.xCord) &&
+		math.Min(p1.yCord, p2.yCord) <= p.yCord && p.yCord <= math.Max(p1.yCord, p2.yCord)
+}
@@ -0,0 +1,431 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Number of line segments every curve command is flattened into
+const CurveSegments = 16
+
+// Flattened curve points are rounded to this many decimal places, so that the
+// same path gives the same points, ink and overlaps on every miner.
+const curvePrecision = 1000
+
+// Number of numbers each path command takes
+var commandArgCount = map[rune]int{
+	'M': 2, 'L': 2, 'H': 1, 'V': 1, 'Z': 0,
+	'C': 6, 'S': 4, 'Q': 4, 'T': 2, 'A': 7,
+}
+
+// Describes why a svg path string could not be parsed, and where.
+type PathParseError struct {
+	// The offending token, "" if the path ended too early
+	Token string
+
+	// Byte offset of the token in the path string
+	Offset int
+
+	Reason string
+}
+
+func (e *PathParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s: %s at offset %d, got end of path", ShapeErrorName[INVALIDSHAPESVGSTRING], e.Reason, e.Offset)
+	}
+	return fmt.Sprintf("%s: %s at offset %d, got %q", ShapeErrorName[INVALIDSHAPESVGSTRING], e.Reason, e.Offset, e.Token)
+}
+
+// Reads command letters and numbers from a svg path string ("M10,20L-5.5 3").
+// Numbers may be separated by whitespace, a comma, or nothing at all when the next
+// one starts with a sign or a second decimal point ("M10-5", "L.5.5").
+type pathScanner struct {
+	s   string
+	pos int
+
+	// true if the last thing read was a number, which a comma may follow
+	afterNumber bool
+}
+
+func (sc *pathScanner) skipSpace() {
+	for sc.pos < len(sc.s) && isPathSpace(sc.s[sc.pos]) {
+		sc.pos++
+	}
+}
+
+// Skips whitespace and at most one comma, which must follow a number
+func (sc *pathScanner) skipSeparators() error {
+	sc.skipSpace()
+	if sc.pos < len(sc.s) && sc.s[sc.pos] == ',' {
+		if !sc.afterNumber {
+			return sc.parseError("expected a number before comma")
+		}
+		sc.pos++
+		sc.afterNumber = false
+		sc.skipSpace()
+	}
+	return nil
+}
+
+// Returns true if a number follows, continuing the current command
+func (sc *pathScanner) hasNumber() bool {
+	sc.skipSpace()
+	if sc.pos < len(sc.s) && sc.s[sc.pos] == ',' {
+		// a comma is always followed by a number
+		return true
+	}
+	return sc.pos < len(sc.s) && isPathNumberStart(sc.s[sc.pos])
+}
+
+// Returns the next command letter, or false at the end of the string
+func (sc *pathScanner) command() (rune, bool, error) {
+	sc.skipSpace()
+	if sc.pos == len(sc.s) {
+		return 0, false, nil
+	}
+	command := rune(sc.s[sc.pos])
+	if !isOperationValid(command) {
+		return 0, false, sc.parseError("expected a path command")
+	}
+	sc.pos++
+	sc.afterNumber = false
+	return command, true, nil
+}
+
+// Reads a number: an optional sign, digits with at most one decimal point, and an optional exponent
+func (sc *pathScanner) number() (float64, error) {
+	if err := sc.skipSeparators(); err != nil {
+		return 0, err
+	}
+	start := sc.pos
+	end := scanPathNumber(sc.s, start)
+	number, err := strconv.ParseFloat(sc.s[start:end], 64)
+	if err != nil || math.IsInf(number, 0) {
+		return 0, sc.parseError("expected a number")
+	}
+	sc.pos = end
+	sc.afterNumber = true
+	return number, nil
+}
+
+// Reads an arc flag, a single 0 or 1 that needs no separator after it ("a 5 5 0 1150 50")
+func (sc *pathScanner) flag() (float64, error) {
+	if err := sc.skipSeparators(); err != nil {
+		return 0, err
+	}
+	if sc.pos == len(sc.s) || (sc.s[sc.pos] != '0' && sc.s[sc.pos] != '1') {
+		return 0, sc.parseError("expected an arc flag 0 or 1")
+	}
+	flag := float64(sc.s[sc.pos] - '0')
+	sc.pos++
+	sc.afterNumber = true
+	return flag, nil
+}
+
+// Returns a PathParseError for the token at the scanner's position
+func (sc *pathScanner) parseError(reason string) *PathParseError {
+	token := ""
+	if sc.pos < len(sc.s) {
+		if isPathNumberStart(sc.s[sc.pos]) {
+			token = sc.s[sc.pos:scanPathNumber(sc.s, sc.pos)]
+		} else {
+			_, size := utf8.DecodeRuneInString(sc.s[sc.pos:])
+			token = sc.s[sc.pos : sc.pos+size]
+		}
+	}
+	return &PathParseError{Token: token, Offset: sc.pos, Reason: reason}
+}
+
+func isPathSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '\f'
+}
+
+func isPathDigit(char byte) bool {
+	return '0' <= char && char <= '9'
+}
+
+func isPathNumberStart(char byte) bool {
+	return isPathDigit(char) || char == '-' || char == '+' || char == '.'
+}
+
+// Returns the index just past the number starting at start
+func scanPathNumber(s string, start int) int {
+	i := start
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	for i < len(s) && isPathDigit(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isPathDigit(s[i]) {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		exponent := i + 1
+		if exponent < len(s) && (s[exponent] == '-' || s[exponent] == '+') {
+			exponent++
+		}
+		if exponent < len(s) && isPathDigit(s[exponent]) {
+			for i = exponent; i < len(s) && isPathDigit(s[i]); i++ {
+			}
+		}
+	}
+	return i
+}
+
+// Convert a SVG path string to list of x and y points.
+// Returns a *PathParseError naming the offending token if the string is not a valid path.
+// Supports the M, L, H, V, Z, C, S, Q, T and A commands in absolute and relative
+// form, with implicitly repeated commands: extra coordinates after M are lines.
+// Curves and arcs are flattened into CurveSegments line segments each.
+// A Z that is not the last command closes its subpath with an explicit point;
+// a final Z is left to the isClosed argument of CalculateInkRequired.
+func ConvertPathToPoints(shapeSvgString string) (SVGPathCoordinates, error) {
+	sc := &pathScanner{s: shapeSvgString}
+	sc.skipSpace()
+	if sc.pos == len(sc.s) || (sc.s[sc.pos] != 'M' && sc.s[sc.pos] != 'm') {
+		return SVGPathCoordinates{}, sc.parseError("expected a move command M or m")
+	}
+	command, _, _ := sc.command()
+
+	b := &pathBuilder{}
+	for {
+		if err := b.readCommand(sc, command); err != nil {
+			return SVGPathCoordinates{}, err
+		}
+
+		// further numbers repeat the command, and lines follow a move
+		if toUpper(command) != 'Z' && sc.hasNumber() {
+			switch command {
+			case 'M':
+				command = 'L'
+			case 'm':
+				command = 'l'
+			}
+			continue
+		}
+
+		var ok bool
+		var err error
+		if command, ok, err = sc.command(); err != nil {
+			return SVGPathCoordinates{}, err
+		} else if !ok {
+			break
+		}
+	}
+
+	// a final Z only moves back to the start of the subpath
+	if b.closedAt == len(b.path.XCords) {
+		b.path.XCords = b.path.XCords[:len(b.path.XCords)-1]
+		b.path.YCords = b.path.YCords[:len(b.path.YCords)-1]
+	}
+	return b.path, nil
+}
+
+// Builds the points of a path one command at a time
+type pathBuilder struct {
+	path         SVGPathCoordinates
+	x, y         float64
+	startX       float64
+	startY       float64
+	lastCommand  rune
+	lastControlX float64
+	lastControlY float64
+
+	// number of points when the last subpath was closed
+	closedAt int
+}
+
+// Reads the arguments of the command and adds its points to the path
+func (b *pathBuilder) readCommand(sc *pathScanner, command rune) error {
+	upper := toUpper(command)
+	args := make([]float64, commandArgCount[upper])
+	for i := range args {
+		var err error
+		if upper == 'A' && (i == 3 || i == 4) {
+			args[i], err = sc.flag()
+		} else {
+			args[i], err = sc.number()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// make coordinates absolute
+	if command != upper {
+		switch upper {
+		case 'H':
+			args[0] += b.x
+		case 'V':
+			args[0] += b.y
+		case 'A':
+			// radii, rotation and flags are not coordinates
+			args[5] += b.x
+			args[6] += b.y
+		default:
+			for i := 0; i < len(args); i += 2 {
+				args[i] += b.x
+				args[i+1] += b.y
+			}
+		}
+	}
+
+	switch upper {
+	case 'M':
+		if len(b.path.XCords) > 0 {
+			b.path.SubpathStarts = append(b.path.SubpathStarts, len(b.path.XCords))
+		}
+		b.startX, b.startY = args[0], args[1]
+		b.lineTo(args[0], args[1])
+	case 'L':
+		b.lineTo(args[0], args[1])
+	case 'H':
+		b.lineTo(args[0], b.y)
+	case 'V':
+		b.lineTo(b.x, args[0])
+	case 'Z':
+		b.lineTo(b.startX, b.startY)
+		b.closedAt = len(b.path.XCords)
+	case 'C':
+		b.cubicTo(args[0], args[1], args[2], args[3], args[4], args[5])
+	case 'S':
+		x1, y1 := b.reflectedControl('C', 'S')
+		b.cubicTo(x1, y1, args[0], args[1], args[2], args[3])
+	case 'Q':
+		b.quadTo(args[0], args[1], args[2], args[3])
+	case 'T':
+		x1, y1 := b.reflectedControl('Q', 'T')
+		b.quadTo(x1, y1, args[0], args[1])
+	case 'A':
+		b.arcTo(args[0], args[1], args[2], args[3] != 0, args[4] != 0, args[5], args[6])
+	}
+	b.lastCommand = upper
+	return nil
+}
+
+func (b *pathBuilder) lineTo(x, y float64) {
+	b.path.XCords = append(b.path.XCords, x)
+	b.path.YCords = append(b.path.YCords, y)
+	b.x, b.y = x, y
+}
+
+// Adds a flattened curve point, rounded so that every miner gets the same point
+func (b *pathBuilder) curvePointTo(x, y float64) {
+	b.lineTo(math.Round(x*curvePrecision)/curvePrecision, math.Round(y*curvePrecision)/curvePrecision)
+}
+
+// Returns the reflection of the last control point if the last command was one
+// of the given curves, and the current point otherwise
+func (b *pathBuilder) reflectedControl(curves ...rune) (float64, float64) {
+	for _, curve := range curves {
+		if b.lastCommand == curve {
+			return float64(2*b.x) - b.lastControlX, float64(2*b.y) - b.lastControlY
+		}
+	}
+	return b.x, b.y
+}
+
+// Curve points must come out the same on every miner, so every product that is added to
+// something is converted to float64 explicitly, which rounds it and keeps the compiler from
+// fusing the multiply and add into one FMA instruction on the architectures that have it.
+func (b *pathBuilder) cubicTo(x1, y1, x2, y2, x, y float64) {
+	x0, y0 := b.x, b.y
+	for i := 1; i < CurveSegments; i++ {
+		t := float64(i) / CurveSegments
+		u := 1 - t
+		b.curvePointTo(
+			float64(u*u*u*x0)+float64(3*u*u*t*x1)+float64(3*u*t*t*x2)+float64(t*t*t*x),
+			float64(u*u*u*y0)+float64(3*u*u*t*y1)+float64(3*u*t*t*y2)+float64(t*t*t*y))
+	}
+	b.lineTo(x, y)
+	b.lastControlX, b.lastControlY = x2, y2
+}
+
+func (b *pathBuilder) quadTo(x1, y1, x, y float64) {
+	x0, y0 := b.x, b.y
+	for i := 1; i < CurveSegments; i++ {
+		t := float64(i) / CurveSegments
+		u := 1 - t
+		b.curvePointTo(
+			float64(u*u*x0)+float64(2*u*t*x1)+float64(t*t*x),
+			float64(u*u*y0)+float64(2*u*t*y1)+float64(t*t*y))
+	}
+	b.lineTo(x, y)
+	b.lastControlX, b.lastControlY = x1, y1
+}
+
+// Flattens an elliptical arc, converting its endpoint parameters to a centre and
+// angles as described in the SVG specification's implementation notes.
+// Unlike the products above, math.Sin, math.Cos and math.Atan2 are not guaranteed to give
+// the same bits everywhere: some architectures (s390x) use their own implementations, which
+// may differ in the last bit. Rounding to curvePrecision hides such differences except when
+// a point falls right on a rounding boundary, so miners on different architectures may
+// rarely disagree on the points, ink or overlaps of an arc.
+func (b *pathBuilder) arcTo(rx, ry, rotation float64, largeArc, sweep bool, x, y float64) {
+	x0, y0 := b.x, b.y
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || (x0 == x && y0 == y) {
+		b.lineTo(x, y)
+		return
+	}
+
+	phi := rotation * math.Pi / 180
+	cosPhi, sinPhi := math.Cos(phi), math.Sin(phi)
+	dx, dy := (x0-x)/2, (y0-y)/2
+	x1 := float64(cosPhi*dx) + float64(sinPhi*dy)
+	y1 := float64(-sinPhi*dx) + float64(cosPhi*dy)
+
+	// scale up radii that are too small to reach the end point
+	if scale := float64(x1*x1/(rx*rx)) + float64(y1*y1/(ry*ry)); scale > 1 {
+		rx *= math.Sqrt(scale)
+		ry *= math.Sqrt(scale)
+	}
+
+	numerator := float64(rx*rx*ry*ry) - float64(rx*rx*y1*y1) - float64(ry*ry*x1*x1)
+	denominator := float64(rx*rx*y1*y1) + float64(ry*ry*x1*x1)
+	coef := math.Sqrt(math.Max(0, numerator/denominator))
+	if largeArc == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+	cx := float64(cosPhi*cx1) - float64(sinPhi*cy1) + (x0+x)/2
+	cy := float64(sinPhi*cx1) + float64(cosPhi*cy1) + (y0+y)/2
+
+	theta := math.Atan2((y1-cy1)/ry, (x1-cx1)/rx)
+	delta := math.Atan2((-y1-cy1)/ry, (-x1-cx1)/rx) - theta
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+
+	for i := 1; i < CurveSegments; i++ {
+		angle := theta + float64(delta*float64(i)/CurveSegments)
+		cosAngle, sinAngle := math.Cos(angle), math.Sin(angle)
+		b.curvePointTo(
+			cx+float64(rx*cosAngle*cosPhi)-float64(ry*sinAngle*sinPhi),
+			cy+float64(rx*cosAngle*sinPhi)+float64(ry*sinAngle*cosPhi))
+	}
+	b.lineTo(x, y)
+}
+
+// Returns true if the path ends by closing its last subpath, or describes a circle
+func IsClosedShape(shapeString string) bool {
+	shapeString = strings.TrimRight(shapeString, " \t\n\r\f")
+	return IsCircleString(shapeString) || strings.HasSuffix(shapeString, "Z") || strings.HasSuffix(shapeString, "z")
+}
+
+func toUpper(command rune) rune {
+	if 'a' <= command && command <= 'z' {
+		return command - 'a' + 'A'
+	}
+	return command
+}
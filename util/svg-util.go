@@ -6,8 +6,6 @@ import (
 	"math"
 	"strconv"
 	"strings"
-	"unicode"
-	"reflect"
 )
 
 // SHAPE ERRORS
@@ -27,16 +25,27 @@ var ShapeErrorName = []string{
 	OUTOFBOUNDS:           "OUTOFBOUNDS",
 }
 
-var validOperations = []rune{'M', 'm', 'L', 'l', 'H', 'h', 'V', 'v', 'Z', 'z'}
+var validOperations = []rune{'M', 'm', 'L', 'l', 'H', 'h', 'V', 'v', 'Z', 'z', 'C', 'c', 'S', 's', 'Q', 'q', 'T', 't', 'A', 'a'}
 
 type SVGPathCoordinates struct {
-	XCords []int
-	YCords []int
+	XCords []float64
+	YCords []float64
+
+	// Index of the first point of every subpath but the first, where the path moves
+	// without drawing. nil for paths with a single subpath.
+	SubpathStarts []int
 }
 
 type Point struct {
-	xCord int
-	yCord int
+	xCord float64
+	yCord float64
+}
+
+// A circle given by its centre (Cx, Cy) and radius R
+type Circle struct {
+	Cx int
+	Cy int
+	R  int
 }
 
 func ConvertToSvgPathString(shapeSvgString string, stroke string, fill string) string {
@@ -56,28 +65,64 @@ func ConvertToSvgPathString(shapeSvgString string, stroke string, fill string) s
 	return buf.String()
 }
 
+func ConvertToSvgCircleString(shapeSvgString string, stroke string, fill string) string {
+	circle, _ := ConvertCircleStringToCircle(shapeSvgString)
+	var buf bytes.Buffer
+	buf.WriteString("<circle cx=")
+	buf.WriteString("\"")
+	buf.WriteString(strconv.Itoa(circle.Cx))
+	buf.WriteString("\" ")
+	buf.WriteString("cy=")
+	buf.WriteString("\"")
+	buf.WriteString(strconv.Itoa(circle.Cy))
+	buf.WriteString("\" ")
+	buf.WriteString("r=")
+	buf.WriteString("\"")
+	buf.WriteString(strconv.Itoa(circle.R))
+	buf.WriteString("\" ")
+	buf.WriteString("stroke=")
+	buf.WriteString("\"")
+	buf.WriteString(stroke)
+	buf.WriteString("\" ")
+	buf.WriteString("fill=")
+	buf.WriteString("\"")
+	buf.WriteString(fill)
+	buf.WriteString("\"/>")
+	return buf.String()
+}
+
+// Returns true if the shape string describes a circle ("cx 50 cy 50 r 10")
+// rather than a path
+func IsCircleString(shapeSvgString string) bool {
+	return strings.HasPrefix(shapeSvgString, "cx ")
+}
+
 // Validate SVG Path String ("M 0 0 L 0 5")
 // Returns the following errors:
 // - ShapeSVGStringTooLongError
-// - InvalidShapeSvgStringError
+// - InvalidShapeSvgStringError, as a *PathParseError
 func ValidateShapeSVGString(shapeSvgString string) (bool, error) {
 	if len(shapeSvgString) > 128 {
 		return false, errors.New(ShapeErrorName[SHAPESVGSTRINGTOOLONG])
 	}
 
-	for _, char := range shapeSvgString {
-		if unicode.IsLetter(char) {
-			if !isOperationValid(char) {
-				return false, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-		} else {
-			if !unicode.IsSpace(char) && !unicode.IsDigit(char) {
-				return false, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-		}
+	if _, err := ConvertPathToPoints(shapeSvgString); err != nil {
+		return false, err
 	}
 
-	if _, err := ConvertPathToPoints(shapeSvgString); err != nil {
+	return true, nil
+}
+
+// Validate circle string ("cx 50 cy 50 r 10")
+// Returns the following errors:
+// - ShapeSVGStringTooLongError
+// - InvalidShapeSvgStringError
+func ValidateCircleSVGString(shapeSvgString string) (bool, error) {
+	if len(shapeSvgString) > 128 {
+		return false, errors.New(ShapeErrorName[SHAPESVGSTRINGTOOLONG])
+	}
+
+	if _, err := ConvertCircleStringToCircle(shapeSvgString); err != nil {
 		return false, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
 	}
 
@@ -88,40 +133,59 @@ func ValidateShapeSVGString(shapeSvgString string) (bool, error) {
 // @param isTransparent - true if svg command issued is transparent, false if non-transparent
 // @param isClosed - true if svg path is a closed shape
 func CalculateInkRequired(svgPath SVGPathCoordinates, isTransparent bool, isClosed bool) uint32 {
-	var ink int
-	numPoints := len(svgPath.XCords)
+	var ink float64
+	subpaths := svgPath.subpaths()
 	// if SVG is transparent, then the ink required is just the length of all the path
 	// if SVG is non-transparent, then ink required is the area
 	if isTransparent {
-		for i := 0; i < len(svgPath.XCords)-1; i++ {
-			xSqrd := math.Pow(float64(svgPath.XCords[i+1]-svgPath.XCords[i]), 2)
-			ySqrd := math.Pow(float64(svgPath.YCords[i+1]-svgPath.YCords[i]), 2)
-			length := math.Sqrt(xSqrd + ySqrd)
-			ink += int(length)
+		for _, segment := range svgPath.segments() {
+			ink += dist(segment[0], segment[1])
 		}
 
 		// if the shape is closed, we need to add an additional line from the last point to the first point
-		if isClosed {
-			xSqrd := math.Pow(float64(svgPath.XCords[len(svgPath.XCords)-1]-svgPath.XCords[0]), 2)
-			ySqrd := math.Pow(float64(svgPath.YCords[len(svgPath.YCords)-1]-svgPath.YCords[0]), 2)
-			length := math.Sqrt(xSqrd + ySqrd)
-			ink += int(length)
+		// of the last subpath
+		if isClosed && len(subpaths) > 0 {
+			last := subpaths[len(subpaths)-1]
+			ink += dist(svgPath.point(last[1]-1), svgPath.point(last[0]))
 		}
 	} else {
-		// calculate area of a polygon
-		j := numPoints - 1
-		for i := 0; i < numPoints; i++ {
-			ink += int((svgPath.XCords[j] + svgPath.XCords[i]) * (svgPath.YCords[j] - svgPath.YCords[i]))
-			j = i
-		}
-		ink = int(ink / 2)
+		// calculate area of a polygon, for each subpath
+		for _, subpath := range subpaths {
+			var area float64
+			j := subpath[1] - 1
+			for i := subpath[0]; i < subpath[1]; i++ {
+				// converted explicitly so that no miner fuses the multiply and add into an FMA
+				area += float64((svgPath.XCords[j] + svgPath.XCords[i]) * (svgPath.YCords[j] - svgPath.YCords[i]))
+				j = i
+			}
 
-		// if the path was constructed counter clock wise, the area would be negative
-		// we need to convert it to positive before casting it as an uint32
-		if ink < 0 {
-			ink = -ink
+			// if the path was constructed counter clock wise, the area would be negative
+			// we need to convert it to positive before casting it as an uint32
+			ink += math.Abs(area / 2)
 		}
 	}
+	return inkToUint32(ink)
+}
+
+// Returns the ink required to draw a circle
+// @param isTransparent - true if the circle is transparent (circumference), false if filled (area)
+func CalculateCircleInkRequired(circle Circle, isTransparent bool) uint32 {
+	r := float64(circle.R)
+	if isTransparent {
+		return inkToUint32(2 * math.Pi * r)
+	}
+	return inkToUint32(math.Pi * r * r)
+}
+
+// Converts an amount of ink to a uint32, capping it at the largest one so that a huge shape
+// cannot wrap around to a cheap one
+func inkToUint32(ink float64) uint32 {
+	if !(ink < math.MaxUint32) {
+		// also catches NaN
+		return math.MaxUint32
+	} else if ink < 0 {
+		return 0
+	}
 	return uint32(ink)
 }
 
@@ -132,98 +196,156 @@ func CheckOutOfBounds(svgPath SVGPathCoordinates, canvasXMax uint32, canvasYMax
 
 	if minX < 0 || minY < 0 {
 		return errors.New(ShapeErrorName[OUTOFBOUNDS])
-	} else if uint32(maxX) > canvasXMax || uint32(maxY) > canvasYMax {
+	} else if maxX > float64(canvasXMax) || maxY > float64(canvasYMax) {
+		return errors.New(ShapeErrorName[OUTOFBOUNDS])
+	}
+
+	return nil
+}
+
+// Returns an error if the given circle goes out of the bounds of the canvas
+func CheckCircleOutOfBounds(circle Circle, canvasXMax uint32, canvasYMax uint32) error {
+	cx, cy, r := int64(circle.Cx), int64(circle.Cy), int64(circle.R)
+	// no value can exceed the canvas on its own, so the sums below cannot overflow
+	if cx > int64(canvasXMax) || cy > int64(canvasYMax) || r > int64(canvasXMax) || r > int64(canvasYMax) {
+		return errors.New(ShapeErrorName[OUTOFBOUNDS])
+	} else if cx-r < 0 || cy-r < 0 {
+		return errors.New(ShapeErrorName[OUTOFBOUNDS])
+	} else if cx+r > int64(canvasXMax) || cy+r > int64(canvasYMax) {
 		return errors.New(ShapeErrorName[OUTOFBOUNDS])
 	}
 
 	return nil
 }
 
-// Return true if two svgPath overlaps
-func CheckOverlap(svgPathOne SVGPathCoordinates, svgPathTwo SVGPathCoordinates) error {
-	if reflect.DeepEqual(svgPathOne, svgPathTwo) {
+// Returns an error if the outlines of two circles overlap
+func CheckCircleOverlap(circleOne Circle, circleTwo Circle) error {
+	dx := circleOne.Cx - circleTwo.Cx
+	dy := circleOne.Cy - circleTwo.Cy
+	distSqrd := dx*dx + dy*dy
+	radiusDiff := circleOne.R - circleTwo.R
+	radiusSum := circleOne.R + circleTwo.R
+
+	if radiusDiff*radiusDiff <= distSqrd && distSqrd <= radiusSum*radiusSum {
 		return errors.New(ShapeErrorName[SHAPEOVERLAP])
 	}
 
-	for i := 0; i < len(svgPathOne.XCords)-1; i++ {
-		p1 := Point{xCord: svgPathOne.XCords[i], yCord: svgPathOne.YCords[i]}
-		p2 := Point{xCord: svgPathOne.XCords[i+1], yCord: svgPathOne.YCords[i+1]}
+	return nil
+}
 
-		for j := 0; j < len(svgPathTwo.XCords)-1; j++ {
-			p3 := Point{xCord: svgPathTwo.XCords[j], yCord: svgPathTwo.YCords[j]}
-			p4 := Point{xCord: svgPathTwo.XCords[j+1], yCord: svgPathTwo.YCords[j+1]}
-			if intersect(p1, p2, p3, p4) {
-				return errors.New(ShapeErrorName[SHAPEOVERLAP])
-			}
+// Returns an error if the outline of the circle crosses any line segment of the svg path
+func CheckCirclePathOverlap(circle Circle, svgPath SVGPathCoordinates) error {
+	centre := Point{xCord: float64(circle.Cx), yCord: float64(circle.Cy)}
+	r := float64(circle.R)
+
+	for _, segment := range svgPath.segments() {
+		p1, p2 := segment[0], segment[1]
+
+		nearest := distToSegment(centre, p1, p2)
+		farthest := math.Max(dist(centre, p1), dist(centre, p2))
+		if nearest <= r && farthest >= r {
+			return errors.New(ShapeErrorName[SHAPEOVERLAP])
 		}
 	}
 
 	return nil
 }
 
-// Convert a SVG path string to list of x and y points
-func ConvertPathToPoints(shapeSvgString string) (SVGPathCoordinates, error) {
-	var xCords []int
-	var yCords []int
+// Returns an error if the path or circle described by shapeString goes out of the bounds of the canvas
+func CheckShapeOutOfBounds(shapeString string, canvasXMax uint32, canvasYMax uint32) error {
+	if IsCircleString(shapeString) {
+		circle, err := ConvertCircleStringToCircle(shapeString)
+		if err != nil {
+			return err
+		}
+		return CheckCircleOutOfBounds(circle, canvasXMax, canvasYMax)
+	}
+
+	svgPath, err := ConvertPathToPoints(shapeString)
+	if err != nil {
+		return err
+	}
+	return CheckOutOfBounds(svgPath, canvasXMax, canvasYMax)
+}
+
+// Returns the ink required to draw the path or circle described by shapeString
+func CalculateShapeInkRequired(shapeString string, isTransparent bool, isClosed bool) uint32 {
+	if IsCircleString(shapeString) {
+		circle, _ := ConvertCircleStringToCircle(shapeString)
+		return CalculateCircleInkRequired(circle, isTransparent)
+	}
+
+	svgPath, _ := ConvertPathToPoints(shapeString)
+	return CalculateInkRequired(svgPath, isTransparent, isClosed)
+}
+
+// Convert a circle string ("cx 50 cy 50 r 10") to a Circle
+func ConvertCircleStringToCircle(shapeSvgString string) (Circle, error) {
 	splitStrings := strings.Split(shapeSvgString, " ")
-	for i, str := range splitStrings {
-		switch str {
-		case "M", "L":
-			absXCord, xerr := strconv.Atoi(splitStrings[i+1])
-			absYCord, yerr := strconv.Atoi(splitStrings[i+2])
-			if xerr != nil || yerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, absXCord)
-			yCords = append(yCords, absYCord)
-		case "m", "l":
-			relXCord, xerr := strconv.Atoi(splitStrings[i+1])
-			relYCord, yerr := strconv.Atoi(splitStrings[i+2])
-			if xerr != nil || yerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, xCords[len(xCords)-1]+relXCord)
-			yCords = append(yCords, yCords[len(yCords)-1]+relYCord)
-		case "V":
-			absYCord, yerr := strconv.Atoi(splitStrings[i+1])
-			if yerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, xCords[len(xCords)-1])
-			yCords = append(yCords, absYCord)
-		case "v":
-			relYCord, yerr := strconv.Atoi(splitStrings[i+1])
-			if yerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, xCords[len(xCords)-1])
-			yCords = append(yCords, yCords[len(yCords)-1]+relYCord)
-		case "H":
-			absXCord, xerr := strconv.Atoi(splitStrings[i+1])
-			if xerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, absXCord)
-			yCords = append(yCords, yCords[len(yCords)-1])
-		case "h":
-			relXCord, xerr := strconv.Atoi(splitStrings[i+1])
-			if xerr != nil {
-				return SVGPathCoordinates{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
-			}
-			xCords = append(xCords, xCords[len(xCords)-1]+relXCord)
-			yCords = append(yCords, yCords[len(yCords)-1])
+	if len(splitStrings) != 6 || splitStrings[0] != "cx" || splitStrings[2] != "cy" || splitStrings[4] != "r" {
+		return Circle{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
+	}
+
+	// values are limited to 32 bits, like the canvas, so that no arithmetic on them overflows
+	cx, xerr := strconv.ParseInt(splitStrings[1], 10, 32)
+	cy, yerr := strconv.ParseInt(splitStrings[3], 10, 32)
+	r, rerr := strconv.ParseInt(splitStrings[5], 10, 32)
+	if xerr != nil || yerr != nil || rerr != nil || r <= 0 {
+		return Circle{}, errors.New(ShapeErrorName[INVALIDSHAPESVGSTRING])
+	}
+
+	return Circle{Cx: int(cx), Cy: int(cy), R: int(r)}, nil
+}
+
+// Returns the i-th point of the path
+func (p SVGPathCoordinates) point(i int) Point {
+	return Point{xCord: p.XCords[i], yCord: p.YCords[i]}
+}
+
+// Returns the start and end index of every subpath
+func (p SVGPathCoordinates) subpaths() [][2]int {
+	if len(p.XCords) == 0 {
+		return nil
+	}
+	var subpaths [][2]int
+	start := 0
+	for _, next := range p.SubpathStarts {
+		subpaths = append(subpaths, [2]int{start, next})
+		start = next
+	}
+	return append(subpaths, [2]int{start, len(p.XCords)})
+}
+
+// Returns the line segments drawn by the path, leaving out the moves between subpaths
+func (p SVGPathCoordinates) segments() [][2]Point {
+	var segments [][2]Point
+	for _, subpath := range p.subpaths() {
+		for i := subpath[0]; i < subpath[1]-1; i++ {
+			segments = append(segments, [2]Point{p.point(i), p.point(i + 1)})
 		}
 	}
-	return SVGPathCoordinates{XCords: xCords, YCords: yCords}, nil
+	return segments
 }
 
-// Return true if line segments p1p2 and p3p4 intersect
-func intersect(p1, p2, p3, p4 Point) bool {
-	return (ccw(p1, p3, p4) != ccw(p2, p3, p4)) && (ccw(p1, p2, p3) != ccw(p1, p2, p4))
+// Returns the distance between two points
+func dist(p1, p2 Point) float64 {
+	return math.Hypot(p2.xCord-p1.xCord, p2.yCord-p1.yCord)
 }
 
-func ccw(p1, p2, p3 Point) bool {
-	return (p3.yCord-p1.yCord)*(p2.xCord-p1.xCord) > (p2.yCord-p1.yCord)*(p3.xCord-p1.xCord)
+// Returns the shortest distance between point p and line segment p1p2
+func distToSegment(p, p1, p2 Point) float64 {
+	dx := p2.xCord - p1.xCord
+	dy := p2.yCord - p1.yCord
+	lenSqrd := float64(dx*dx) + float64(dy*dy)
+	if lenSqrd == 0 {
+		return dist(p, p1)
+	}
+
+	t := (float64((p.xCord-p1.xCord)*dx) + float64((p.yCord-p1.yCord)*dy)) / lenSqrd
+	t = math.Max(0, math.Min(1, t))
+	nearestX := p1.xCord + float64(t*dx)
+	nearestY := p1.yCord + float64(t*dy)
+	return math.Hypot(p.xCord-nearestX, p.yCord-nearestY)
 }
 
 func isOperationValid(op rune) bool {
@@ -235,9 +357,12 @@ func isOperationValid(op rune) bool {
 	return false
 }
 
-func minMax(array []int) (int, int) {
-	var max int = array[0]
-	var min int = array[0]
+func minMax(array []float64) (float64, float64) {
+	if len(array) == 0 {
+		return 0, 0
+	}
+	var max float64 = array[0]
+	var min float64 = array[0]
 	for _, value := range array {
 		if max < value {
 			max = value
@@ -4,43 +4,54 @@ import (
 	"testing"
 	"reflect"
 	"fmt"
+	"math"
 )
 
 // go test svg_util_test.go
 
 // "M 150 150 V 50 H 20 Z", area = 6500, perimeter = 394.01
-var rightAngleTriangle = SVGPathCoordinates{ XCords: []int{150, 150, 20}, YCords: []int{150, 50, 50} }
+var rightAngleTriangle = SVGPathCoordinates{ XCords: []float64{150, 150, 20}, YCords: []float64{150, 50, 50} }
 
 // "M 150 150 v 50 L 100 100 Z"
-var weirdAssTriangle = SVGPathCoordinates{ XCords: []int{150, 150, 100}, YCords: []int{150, 200, 100} }
+var weirdAssTriangle = SVGPathCoordinates{ XCords: []float64{150, 150, 100}, YCords: []float64{150, 200, 100} }
 
 // "M 100 100 L 100 200 h 100 v -100 Z"
-var regularAssSquare = SVGPathCoordinates{ XCords: []int{100, 100, 200, 200}, YCords: []int{100, 200, 200, 100} }
+var regularAssSquare = SVGPathCoordinates{ XCords: []float64{100, 100, 200, 200}, YCords: []float64{100, 200, 200, 100} }
 
 // "M 50 50 L 50 150 h 100 v -100 Z"
-var squareThatOverlapsRegularAssSquare = SVGPathCoordinates{ XCords: []int{50, 50, 150, 150}, YCords: []int{50, 150, 150, 50} }
+var squareThatOverlapsRegularAssSquare = SVGPathCoordinates{ XCords: []float64{50, 50, 150, 150}, YCords: []float64{50, 150, 150, 50} }
 
 // "M 50 50 L 50 80 h 30 v -30 Z"
-var squareThatDoesntOverLap = SVGPathCoordinates{ XCords: []int{50, 50, 80, 80}, YCords: []int{50, 80, 80, 50} }
+var squareThatDoesntOverLap = SVGPathCoordinates{ XCords: []float64{50, 50, 80, 80}, YCords: []float64{50, 80, 80, 50} }
 
 // "M 100 100 L 300 100 L 300 200 L 100 200 Z"
-var regularAssRectangle = SVGPathCoordinates{ XCords: []int{100, 300, 300, 100}, YCords: []int{100, 100, 200, 200} }
+var regularAssRectangle = SVGPathCoordinates{ XCords: []float64{100, 300, 300, 100}, YCords: []float64{100, 100, 200, 200} }
 
 // "M 100 100 L 300 100 L 400 200 L 200 200 Z"
-var regularAssPolygon = SVGPathCoordinates{ XCords: []int{100, 300, 400, 200}, YCords: []int{100, 100, 200, 200} }
+var regularAssPolygon = SVGPathCoordinates{ XCords: []float64{100, 300, 400, 200}, YCords: []float64{100, 100, 200, 200} }
 
 func TestValidateShapeSVGString(t *testing.T) {
 	if _, err := ValidateShapeSVGString("M 0 0 L 0 5"); err != nil {
 		t.Errorf("SVG String is valid but got error: %s", err)
 	}
 
-	// Q operation not supported
+	// Q operation is missing its end point
 	if isValid, _ := ValidateShapeSVGString("M 0 0 Q 0 5"); isValid {
 		t.Error("SVG String is invalid but got true")
 	}
 
-	// no comma seperators allowed
-	if isValid, _ := ValidateShapeSVGString("M 0, 0 L 0, 5"); isValid {
+	// comma seperators, decimals, negatives and no whitespace are allowed
+	if _, err := ValidateShapeSVGString("M10,20L-5.5 3"); err != nil {
+		t.Errorf("SVG String is valid but got error: %s", err)
+	}
+
+	// a comma must seperate two numbers
+	if isValid, _ := ValidateShapeSVGString("M 0,, 0 L 0 5"); isValid {
+		t.Error("SVG String is invalid but got true")
+	}
+
+	// path must start with a move
+	if isValid, _ := ValidateShapeSVGString("L 0 5"); isValid {
 		t.Error("SVG String is invalid but got true")
 	}
 
@@ -81,9 +92,78 @@ func TestConvertPathToPoints(t *testing.T) {
 	}
 }
 
+func TestConvertPathToPointsGrammar(t *testing.T) {
+	expected := SVGPathCoordinates{ XCords: []float64{10, -5.5, 4.5, 4.5}, YCords: []float64{20, 3, 3, 0.25} }
+	if svgPath, err := ConvertPathToPoints("M10,20L-5.5 3h10V.25"); err != nil || !reflect.DeepEqual(svgPath, expected) {
+		t.Errorf("Expected: %+v, but got %+v, %v", expected, svgPath, err)
+	}
+
+	// extra coordinates after a move are lines, relative to the move if it is
+	expected = SVGPathCoordinates{ XCords: []float64{1, 2, 4}, YCords: []float64{1, 3, 6} }
+	if svgPath, err := ConvertPathToPoints("m 1 1 1 2 2 3"); err != nil || !reflect.DeepEqual(svgPath, expected) {
+		t.Errorf("Expected: %+v, but got %+v, %v", expected, svgPath, err)
+	}
+
+	// a closed subpath followed by another one; the move between them draws nothing
+	expected = SVGPathCoordinates{ XCords: []float64{0, 10, 0, 20, 30}, YCords: []float64{0, 0, 0, 20, 20}, SubpathStarts: []int{3} }
+	if svgPath, err := ConvertPathToPoints("M 0 0 H 10 Z M 20 20 h 10"); err != nil || !reflect.DeepEqual(svgPath, expected) {
+		t.Errorf("Expected: %+v, but got %+v, %v", expected, svgPath, err)
+	}
+	if ink := CalculateInkRequired(expected, true, false); ink != uint32(30) {
+		t.Errorf("Expected ink: 30, but got %d", ink)
+	}
+
+	for _, invalid := range []string{"M 0 0 L 1", "M 0 0 Z 1 1", "M 0 0 L 1 1,", "M 1e 2", "M 0 0 P 1 1"} {
+		if _, err := ConvertPathToPoints(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestConvertCurvesToPoints(t *testing.T) {
+	// quadratic curves are flattened, reaching halfway to their control point
+	quad, err := ConvertPathToPoints("M 0 0 Q 50 100 100 0")
+	if err != nil || len(quad.XCords) != CurveSegments+1 {
+		t.Fatalf("Expected %d points, but got %+v, %v", CurveSegments+1, quad, err)
+	}
+	if quad.XCords[CurveSegments/2] != 50 || quad.YCords[CurveSegments/2] != 50 || quad.XCords[CurveSegments] != 100 {
+		t.Errorf("Expected curve through (50, 50) to (100, 0), but got %+v", quad)
+	}
+	if err := CheckOutOfBounds(quad, 100, 49); err == nil {
+		t.Error("Curve is out of bounds but got within bounds")
+	}
+
+	// a half circle of radius 50, with flags written without separators
+	arc, err := ConvertPathToPoints("M 0 50 a50,50 0 01100 0")
+	if expected, _ := ConvertPathToPoints("M 0 50 A 50 50 0 0 1 100 50"); err != nil || !reflect.DeepEqual(arc, expected) {
+		t.Errorf("Expected: %+v, but got %+v, %v", expected, arc, err)
+	}
+	if arc.YCords[CurveSegments/2] != 0 {
+		t.Errorf("Expected arc through (50, 0), but got %+v", arc)
+	}
+	if ink := CalculateInkRequired(arc, true, false); ink != uint32(156) {
+		t.Errorf("Expected ink: 156, but got %d", ink)
+	}
+
+	// smooth curves reflect the previous control point
+	smooth, err := ConvertPathToPoints("M 0 0 C 0 10 10 10 10 0 s 10 -10 10 0")
+	if expected, _ := ConvertPathToPoints("M 0 0 C 0 10 10 10 10 0 C 10 -10 20 -10 20 0"); err != nil || !reflect.DeepEqual(smooth, expected) {
+		t.Errorf("Expected: %+v, but got %+v, %v", expected, smooth, err)
+	}
+
+	// curves overlap the lines they cross
+	if err := CheckFilledShapeOverlap("M 0 0 Q 50 100 100 0", false, "M 0 40 H 100", false); err == nil {
+		t.Error("The curve and line over lap but got that they don't")
+	}
+
+	if _, err := ConvertPathToPoints("M 0 0 A 5 5 0 2 0 10 0"); err == nil {
+		t.Error("Expected arc flag 2 to be invalid")
+	}
+}
+
 func TestCalculateInkRequired(t *testing.T) {
 	// Basic right angle triangle with 300, 400, 500 side length
-	rightAngleTriangle := SVGPathCoordinates{ XCords: []int{150, 150, 550}, YCords: []int{150, 450, 450}}
+	rightAngleTriangle := SVGPathCoordinates{ XCords: []float64{150, 150, 550}, YCords: []float64{150, 450, 450}}
 	if ink := CalculateInkRequired(rightAngleTriangle, true, true); ink != uint32(1200) {
 		t.Errorf("Expected ink: 1200, but got %d", ink)
 	}
@@ -132,36 +212,187 @@ func TestCheckOutOfBounds(t *testing.T) {
 }
 
 func TestCheckOverLap(t *testing.T) {
-	simpleLine := SVGPathCoordinates{ XCords: []int{100, 150}, YCords: []int{100, 150} }
-	sameSimpleLine := SVGPathCoordinates{ XCords: []int{100, 150}, YCords: []int{100, 150} }
-	intersectsSimpleLine :=  SVGPathCoordinates{ XCords: []int{150, 50}, YCords: []int{120, 120} }
-	noIntersect := SVGPathCoordinates{ XCords: []int{150, 50}, YCords: []int{90, 90} }
+	simpleLine := "M 100 100 L 150 150"
+	intersectsSimpleLine := "M 150 120 L 50 120"
+	noIntersect := "M 150 90 L 50 90"
 
 	// Two lines that intersect
-	if err := CheckOverlap(simpleLine, intersectsSimpleLine); err == nil {
+	if err := CheckFilledShapeOverlap(simpleLine, false, intersectsSimpleLine, false); err == nil {
 		t.Error("The two path over laps but got that they don't")
 	}
 
-	if err := CheckOverlap(simpleLine, sameSimpleLine); err == nil {
+	if err := CheckFilledShapeOverlap(simpleLine, false, simpleLine, false); err == nil {
 		t.Error("The two path over laps but got that they don't")
 	}
 
 	// Two lines that don't intersect
-	if err := CheckOverlap(simpleLine, noIntersect); err != nil {
+	if err := CheckFilledShapeOverlap(simpleLine, false, noIntersect, false); err != nil {
 		t.Error("The two path DO NOT over laps but got that they do")
 	}
 
 	// Two squares that overlap
-	if err := CheckOverlap(regularAssSquare, squareThatOverlapsRegularAssSquare); err == nil {
+	if err := CheckFilledShapeOverlap("M 100 100 L 100 200 h 100 v -100 Z", false, "M 50 50 L 50 150 h 100 v -100 Z", false); err == nil {
 		t.Error("The two path over laps but got that they don't")
 	}
 
 	// Two squares that don't overlap
-	if err := CheckOverlap(regularAssSquare, squareThatDoesntOverLap); err != nil {
+	if err := CheckFilledShapeOverlap("M 100 100 L 100 200 h 100 v -100 Z", false, "M 50 50 L 50 80 h 30 v -30 Z", false); err != nil {
 		t.Error("The two path DO NOT over laps but got that they do")
 	}
 }
 
+func TestConvertCircleStringToCircle(t *testing.T) {
+	expected := Circle{Cx: 50, Cy: 60, R: 10}
+	if circle, err := ConvertCircleStringToCircle("cx 50 cy 60 r 10"); err != nil || !reflect.DeepEqual(circle, expected) {
+		t.Errorf("Expected: %+v, but got %+v", expected, circle)
+	}
+
+	if _, err := ConvertCircleStringToCircle("cx 50 cy 60"); err == nil {
+		t.Error("Circle string is missing r but got no error")
+	}
+
+	if _, err := ConvertCircleStringToCircle("cx 50 cy 60 r 0"); err == nil {
+		t.Error("Circle radius must be positive but got no error")
+	}
+
+	if _, err := ConvertCircleStringToCircle("cx 4611686018427387904 cy 4611686018427387904 r 4611686018427387904"); err == nil {
+		t.Error("Circle values beyond 32 bits but got no error")
+	}
+
+	if isValid, _ := ValidateCircleSVGString("M 0 0 L 0 5"); isValid {
+		t.Error("Path string is not a valid circle but got true")
+	}
+}
+
+func TestCalculateCircleInkRequired(t *testing.T) {
+	circle := Circle{Cx: 50, Cy: 50, R: 10}
+	if ink := CalculateCircleInkRequired(circle, true); ink != uint32(62) {
+		t.Errorf("Expected ink: 62, but got %d", ink)
+	}
+
+	if ink := CalculateCircleInkRequired(circle, false); ink != uint32(314) {
+		t.Errorf("Expected ink: 314, but got %d", ink)
+	}
+
+	// too much ink for a uint32 is capped rather than wrapping around
+	if ink := CalculateCircleInkRequired(Circle{R: math.MaxInt32}, false); ink != math.MaxUint32 {
+		t.Errorf("Expected ink: %d, but got %d", uint32(math.MaxUint32), ink)
+	}
+}
+
+func TestCheckCircleOutOfBounds(t *testing.T) {
+	if err := CheckCircleOutOfBounds(Circle{Cx: 50, Cy: 50, R: 50}, 100, 100); err != nil {
+		t.Error("Circle is within bound but got out of bounds")
+	}
+
+	if err := CheckCircleOutOfBounds(Circle{Cx: 50, Cy: 50, R: 51}, 1000, 1000); err == nil {
+		t.Error("Circle is out of bounds but got within bounds")
+	}
+
+	if err := CheckCircleOutOfBounds(Circle{Cx: 950, Cy: 50, R: 51}, 1000, 1000); err == nil {
+		t.Error("Circle is out of bounds but got within bounds")
+	}
+
+	// sums that overflow an int must not wrap back into the canvas
+	huge := Circle{Cx: math.MaxInt64 / 2, Cy: math.MaxInt64 / 2, R: math.MaxInt64/2 + 1}
+	if err := CheckCircleOutOfBounds(huge, 1000, 1000); err == nil {
+		t.Error("Circle is out of bounds but got within bounds")
+	}
+}
+
+func TestCheckCircleOverlap(t *testing.T) {
+	circle := Circle{Cx: 100, Cy: 100, R: 20}
+
+	// Outlines cross
+	if err := CheckCircleOverlap(circle, Circle{Cx: 130, Cy: 100, R: 20}); err == nil {
+		t.Error("The two circles overlap but got that they don't")
+	}
+
+	// Same circle
+	if err := CheckCircleOverlap(circle, circle); err == nil {
+		t.Error("The two circles overlap but got that they don't")
+	}
+
+	// Far apart
+	if err := CheckCircleOverlap(circle, Circle{Cx: 200, Cy: 200, R: 20}); err != nil {
+		t.Error("The two circles DO NOT overlap but got that they do")
+	}
+
+	// Small circle strictly inside a bigger one does not touch its outline
+	if err := CheckCircleOverlap(circle, Circle{Cx: 100, Cy: 100, R: 5}); err != nil {
+		t.Error("The two circles DO NOT overlap but got that they do")
+	}
+
+	// Line through the circle
+	if err := CheckCirclePathOverlap(circle, SVGPathCoordinates{XCords: []float64{50, 150}, YCords: []float64{100, 100}}); err == nil {
+		t.Error("The circle and path overlap but got that they don't")
+	}
+
+	// Square around the circle
+	if err := CheckCirclePathOverlap(Circle{Cx: 150, Cy: 150, R: 20}, regularAssSquare); err != nil {
+		t.Error("The circle and path DO NOT overlap but got that they do")
+	}
+}
+
+func TestCheckFilledShapeOverlap(t *testing.T) {
+	square := "M 0 0 H 100 V 100 H 0 Z"
+	smallSquare := "M 40 40 H 60 V 60 H 40 Z"
+
+	// a shape inside a filled shape overlaps it, but not inside a transparent one
+	if err := CheckFilledShapeOverlap(square, true, smallSquare, false); err == nil {
+		t.Error("The small square is inside the filled square but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap(smallSquare, false, square, true); err == nil {
+		t.Error("The small square is inside the filled square but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap(square, false, smallSquare, false); err != nil {
+		t.Error("The outlines DO NOT over lap but got that they do")
+	}
+
+	// the hole of a filled shape is not covered, with the even-odd rule
+	donut := "M 0 0 H 100 V 100 H 0 Z M 30 30 H 70 V 70 H 30 Z"
+	if err := CheckFilledShapeOverlap(donut, true, smallSquare, true); err != nil {
+		t.Error("The small square is in the hole of the donut but got that they over lap")
+	}
+
+	// circles inside filled shapes, and shapes inside filled circles
+	if err := CheckFilledShapeOverlap(square, true, "cx 50 cy 50 r 10", false); err == nil {
+		t.Error("The circle is inside the filled square but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap("cx 50 cy 50 r 40", true, smallSquare, false); err == nil {
+		t.Error("The small square is inside the filled circle but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap("cx 50 cy 50 r 40", true, "cx 50 cy 50 r 10", false); err == nil {
+		t.Error("The circle is inside the filled circle but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap("cx 50 cy 50 r 40", false, "cx 50 cy 50 r 10", false); err != nil {
+		t.Error("The outlines DO NOT over lap but got that they do")
+	}
+	if err := CheckFilledShapeOverlap(square, true, "cx 200 cy 200 r 10", true); err != nil {
+		t.Error("The shapes are apart but got that they over lap")
+	}
+
+	// the closing line of a filled path is drawn even without Z
+	if err := CheckFilledShapeOverlap("M 0 0 H 100 V 100", true, "M 50 40 L 50 60", false); err == nil {
+		t.Error("The line crosses the closing line of the filled path but got that they don't over lap")
+	}
+}
+
+func TestCheckOverlapTouching(t *testing.T) {
+	// lines touching at an end point
+	if err := CheckFilledShapeOverlap("M 0 0 L 10 10", false, "M 10 10 L 20 0", false); err == nil {
+		t.Error("The lines touch but got that they don't over lap")
+	}
+
+	// collinear lines sharing a part, and collinear lines apart
+	if err := CheckFilledShapeOverlap("M 0 0 H 10", false, "M 5 0 H 20", false); err == nil {
+		t.Error("The lines share a part but got that they don't over lap")
+	}
+	if err := CheckFilledShapeOverlap("M 0 0 H 10", false, "M 11 0 H 20", false); err != nil {
+		t.Error("The lines are apart but got that they over lap")
+	}
+}
+
 func TestConvertToSvgPathString(t *testing.T) {
 	// check manually because can't compare strings with escaped characters...
 	shapeSvgStr := "M 0 0 L 0 5"
@@ -171,3 +402,91 @@ func TestConvertToSvgPathString(t *testing.T) {
 	ActualSvgPathStr := ConvertToSvgPathString(shapeSvgStr, stroke, fill)
 	fmt.Printf("conversion: actual: %s , expected: %s \n", ActualSvgPathStr, ExpectedSvgPathStr)
 }
+
+func TestConvertToSvgCircleString(t *testing.T) {
+	expected := "<circle cx=\"50\" cy=\"60\" r=\"10\" stroke=\"red\" fill=\"transparent\"/>"
+	if actual := ConvertToSvgCircleString("cx 50 cy 60 r 10", "red", "transparent"); actual != expected {
+		t.Errorf("Expected: %s, but got %s", expected, actual)
+	}
+}
+
+func TestPathParseError(t *testing.T) {
+	tests := []struct {
+		path   string
+		token  string
+		offset int
+	}{
+		{"M 0", "", 3},
+		{"l 1 1", "l", 0},
+		{"", "", 0},
+		{"M 0 0 L 5 x", "x", 10},
+		{"M 0 0 L 5,,5", ",", 10},
+		{"M 0 0 Z 5", "5", 8},
+		{"M 0 0 A 5 5 0 2 0 9 9", "2", 14},
+		{"M 0 0 L 1 1 ÿ", "ÿ", 12},
+	}
+	for _, test := range tests {
+		_, err := ConvertPathToPoints(test.path)
+		parseErr, ok := err.(*PathParseError)
+		if !ok {
+			t.Errorf("Expected PathParseError for %q, but got %v", test.path, err)
+			continue
+		}
+		if parseErr.Token != test.token || parseErr.Offset != test.offset {
+			t.Errorf("Expected token %q at offset %d for %q, but got %s", test.token, test.offset, test.path, parseErr)
+		}
+	}
+}
+
+// go test -fuzz FuzzConvertPathToPoints
+func FuzzConvertPathToPoints(f *testing.F) {
+	for _, seed := range []string{"M 0", "l 1 1", "M 0 0 L 0 5", "M10,20L-5.5 3", "M 0 0 Q 50 100 100 0 T 200 0", "M 0 50 a50,50 0 01100 0 Z M 1 1 h 1e2 z"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		svgPath, err := ConvertPathToPoints(path)
+		if err != nil {
+			parseErr, ok := err.(*PathParseError)
+			if !ok {
+				t.Fatalf("Expected PathParseError for %q, but got %v", path, err)
+			}
+			if parseErr.Offset < 0 || parseErr.Offset+len(parseErr.Token) > len(path) || path[parseErr.Offset:parseErr.Offset+len(parseErr.Token)] != parseErr.Token {
+				t.Fatalf("Error %s does not point into %q", parseErr, path)
+			}
+			return
+		}
+
+		if len(svgPath.XCords) == 0 || len(svgPath.XCords) != len(svgPath.YCords) {
+			t.Fatalf("Expected as many x as y coordinates for %q, but got %+v", path, svgPath)
+		}
+		CalculateInkRequired(svgPath, true, true)
+		CalculateInkRequired(svgPath, false, true)
+		CheckOutOfBounds(svgPath, 1024, 1024)
+		CheckFilledShapeOverlap(path, true, path, false)
+	})
+}
+
+func TestShapeGrid(t *testing.T) {
+	grid := NewShapeGrid(10, 100, 100)
+	squareBounds, _ := ShapeBounds("M 0 0 H 10 V 10 H 0 Z")
+	grid.Insert("square", squareBounds)
+	circleBounds, _ := ShapeBounds("cx 50 cy 50 r 5")
+	grid.Insert("circle", circleBounds)
+
+	// bounds touching at a cell edge
+	if candidates := grid.Candidates(Bounds{MinX: 10, MinY: 10, MaxX: 20, MaxY: 20}); !reflect.DeepEqual(candidates, []string{"square"}) {
+		t.Errorf("Expected [square], but got %v", candidates)
+	}
+	if candidates := grid.Candidates(Bounds{MinX: 0, MinY: 0, MaxX: 100, MaxY: 100}); !reflect.DeepEqual(candidates, []string{"circle", "square"}) {
+		t.Errorf("Expected [circle square], but got %v", candidates)
+	}
+	if candidates := grid.Candidates(Bounds{MinX: 20, MinY: 20, MaxX: 30, MaxY: 30}); len(candidates) != 0 {
+		t.Errorf("Expected no candidates, but got %v", candidates)
+	}
+
+	// bounds past the canvas are clamped to its edge cells
+	if candidates := grid.Candidates(Bounds{MinX: -50, MinY: -50, MaxX: -1, MaxY: 5}); len(candidates) != 0 {
+		t.Errorf("Expected no candidates, but got %v", candidates)
+	}
+}